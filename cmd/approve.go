@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"piper/internal/engine"
+	"piper/internal/loader"
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+var approvalComment string
+
+var approveCmd = &cobra.Command{
+	Use:   "approve <run-id>",
+	Short: "Approve a run waiting at an approval step and continue it",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return resolveApproval(args[0], true)
+	},
+}
+
+var rejectCmd = &cobra.Command{
+	Use:   "reject <run-id>",
+	Short: "Reject a run waiting at an approval step",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return resolveApproval(args[0], false)
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{approveCmd, rejectCmd} {
+		c.Flags().StringVar(&approvalComment, "comment", "", "reason for the decision, available as steps.<name>.output.comment")
+		rootCmd.AddCommand(c)
+	}
+}
+
+func resolveApproval(runID string, approved bool) error {
+	flows, err := loader.LoadFlows(flowsDir)
+	if err != nil {
+		return fmt.Errorf("loading flows: %w", err)
+	}
+
+	registry := defaultRegistry()
+	eng := engine.NewEngine(registry)
+	eng.Store = store.NewDirStore(runsDir)
+	eng.Strict = strictRefs
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
+		f, ok := flows[name]
+		if !ok {
+			return nil, fmt.Errorf("flow %q not found", name)
+		}
+		return f, nil
+	}
+
+	run, err := eng.Store.Get(runID)
+	if err != nil {
+		return err
+	}
+	flow, ok := flows[run.Flow]
+	if !ok {
+		return fmt.Errorf("flow %q not found in %s", run.Flow, flowsDir)
+	}
+	secrets, err := loadSecrets(runFlows(flow, flows)...)
+	if err != nil {
+		return err
+	}
+
+	decision := engine.Decision{Approved: approved, Comment: approvalComment}
+	result, err := eng.ResolveApproval(context.Background(), runID, decision, secrets)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"piper/internal/config"
+	"piper/internal/engine"
+	"piper/internal/secrets"
+	"piper/internal/types"
+)
+
+// loadConfig reads the project config: the --config file, or piper.yaml in
+// the working directory if it exists. Without one, the config is empty.
+func loadConfig() (*config.Config, error) {
+	path := configFile
+	if path == "" {
+		path = config.DefaultFile
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return &config.Config{}, nil
+		}
+	}
+	return config.Load(path)
+}
+
+// loadSecrets loads the secrets of the configured providers, followed by
+// the --secrets-file. Vault secrets are only decrypted if one of the given
+// flows references them.
+func loadSecrets(flows ...*types.FlowDef) (map[string]string, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	providers, err := cfg.SecretProviders()
+	if err != nil {
+		return nil, err
+	}
+	if secretsFile != "" {
+		providers = append(providers, &secrets.EnvFile{Path: secretsFile})
+	}
+	values, err := secrets.LoadUsed(engine.SecretRefs(flows...), providers...)
+	if err != nil {
+		return nil, err
+	}
+	warnShortSecrets(values)
+	return values, nil
+}
+
+// warnShortSecrets warns about secrets too short to be masked in results.
+func warnShortSecrets(values map[string]string) {
+	names := make([]string, 0, len(values))
+	for name, value := range values {
+		if len(value) < engine.MinSecretLength {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "warning: secret %s is shorter than %d characters and will not be masked in run results or logs\n", name, engine.MinSecretLength)
+	}
+}
+
+// runFlows returns the flows a run of flow can execute: flow and the child
+// flows it reaches through flow steps, or every flow if a child is only
+// named at run time.
+func runFlows(flow *types.FlowDef, flows map[string]*types.FlowDef) []*types.FlowDef {
+	if reached, ok := engine.ReachableFlows(flow, flows); ok {
+		return reached
+	}
+	return allFlows(flows)
+}
+
+// allFlows returns every loaded flow, for servers that can run any of them.
+func allFlows(flows map[string]*types.FlowDef) []*types.FlowDef {
+	defs := make([]*types.FlowDef, 0, len(flows))
+	for _, f := range flows {
+		defs = append(defs, f)
+	}
+	return defs
+}
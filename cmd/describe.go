@@ -3,12 +3,16 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
+	"sort"
+	"strings"
 	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 
 	"piper/internal/loader"
+	"piper/internal/types"
 )
 
 var describeCmd = &cobra.Command{
@@ -47,23 +51,28 @@ func describeFlow(cmd *cobra.Command, args []string) error {
 	if flow.Trigger != nil {
 		fmt.Printf("Trigger:     %s (%s)\n", flow.Trigger.Type, flow.Trigger.Path)
 	}
+	if len(flow.RequiresSecrets) > 0 {
+		fmt.Printf("Secrets:     %s\n", strings.Join(flow.RequiresSecrets, ", "))
+	}
 
 	if flow.Input != nil && len(flow.Input.Properties) > 0 {
 		fmt.Println("\nInput Schema:")
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(w, "  FIELD\tTYPE\tREQUIRED\tDESCRIPTION")
-		for name, field := range flow.Input.Properties {
-			fmt.Fprintf(w, "  %s\t%s\t%v\t%s\n", name, field.Type, field.Required, field.Description)
-		}
+		fmt.Fprintln(w, "  FIELD\tTYPE\tREQUIRED\tDEFAULT\tCONSTRAINTS\tDESCRIPTION")
+		describeFields(w, "", flow.Input.Properties)
 		w.Flush()
 	}
 
 	if flow.Output != nil && len(flow.Output.Properties) > 0 {
 		fmt.Println("\nOutput Schema:")
 		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(w, "  FIELD\tTYPE\tDESCRIPTION")
+		fmt.Fprintln(w, "  FIELD\tTYPE\tVALUE\tDESCRIPTION")
 		for name, field := range flow.Output.Properties {
-			fmt.Fprintf(w, "  %s\t%s\t%s\n", name, field.Type, field.Description)
+			value := field.Value
+			if value == "" {
+				value = "-"
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", name, field.Type, value, field.Description)
 		}
 		w.Flush()
 	}
@@ -80,3 +89,62 @@ func describeFlow(cmd *cobra.Command, args []string) error {
 	}
 	return w.Flush()
 }
+
+// describeFields prints schema fields sorted by name, followed by the fields
+// of nested objects ("parent.child") and array elements ("parent[]").
+func describeFields(w io.Writer, prefix string, fields map[string]types.FieldDef) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := fields[name]
+		path := prefix + name
+		def := "-"
+		if field.Default != nil {
+			data, _ := json.Marshal(field.Default)
+			def = string(data)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%v\t%s\t%s\t%s\n", path, field.Type, field.Required, def, constraints(field), field.Description)
+		describeFields(w, path+".", field.Properties)
+		if field.Items != nil {
+			describeFields(w, "", map[string]types.FieldDef{path + "[]": *field.Items})
+		}
+	}
+}
+
+// constraints summarizes a field's JSON Schema constraints, or "-".
+func constraints(field types.FieldDef) string {
+	var parts []string
+	if len(field.Enum) > 0 {
+		values := make([]string, len(field.Enum))
+		for i, v := range field.Enum {
+			values[i] = fmt.Sprintf("%v", v)
+		}
+		parts = append(parts, "enum="+strings.Join(values, "|"))
+	}
+	if field.Pattern != "" {
+		parts = append(parts, "pattern="+field.Pattern)
+	}
+	if field.Format != "" {
+		parts = append(parts, "format="+field.Format)
+	}
+	if field.Minimum != nil {
+		parts = append(parts, fmt.Sprintf("min=%v", *field.Minimum))
+	}
+	if field.Maximum != nil {
+		parts = append(parts, fmt.Sprintf("max=%v", *field.Maximum))
+	}
+	if field.MinLength != nil {
+		parts = append(parts, fmt.Sprintf("minLength=%d", *field.MinLength))
+	}
+	if field.MaxLength != nil {
+		parts = append(parts, fmt.Sprintf("maxLength=%d", *field.MaxLength))
+	}
+	if len(parts) == 0 {
+		return "-"
+	}
+	return strings.Join(parts, " ")
+}
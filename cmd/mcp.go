@@ -8,6 +8,7 @@ import (
 	"piper/internal/engine"
 	"piper/internal/loader"
 	"piper/internal/server"
+	"piper/internal/store"
 	"piper/internal/types"
 )
 
@@ -19,7 +20,14 @@ var mcpCmd = &cobra.Command{
 	RunE:  serveMCP,
 }
 
+var (
+	mcpMappedOutput   bool
+	mcpAllowApprovals bool
+)
+
 func init() {
+	mcpCmd.Flags().BoolVar(&mcpMappedOutput, "mapped-output", false, "return only each flow's mapped output from tools/call")
+	mcpCmd.Flags().BoolVar(&mcpAllowApprovals, "allow-approvals", false, "expose the piper_resolve_approval tool, letting the MCP client approve or reject waiting runs")
 	rootCmd.AddCommand(mcpCmd)
 }
 
@@ -31,6 +39,11 @@ func serveMCP(cmd *cobra.Command, args []string) error {
 
 	registry := defaultRegistry()
 	eng := engine.NewEngine(registry)
+	eng.Store = store.NewDirStore(runsDir)
+	eng.Strict = strictRefs
+	if eng.Secrets, err = loadSecrets(allFlows(flows)...); err != nil {
+		return err
+	}
 	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
 		f, ok := flows[name]
 		if !ok {
@@ -40,5 +53,7 @@ func serveMCP(cmd *cobra.Command, args []string) error {
 	}
 
 	srv := server.NewMCPServer(eng, flows)
+	srv.MappedOutput = mcpMappedOutput
+	srv.AllowApprovals = mcpAllowApprovals
 	return srv.ServeStdio()
 }
@@ -0,0 +1,82 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"piper/internal/engine"
+	"piper/internal/loader"
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+var resumeFrom string
+
+var resumeCmd = &cobra.Command{
+	Use:   "resume <run-id>",
+	Short: "Re-run a stored run from its first failed step",
+	Long: "Starts a new run of the same flow with the same input. Steps that succeeded in the\n" +
+		"previous run are restored from its stored outputs instead of being executed again.",
+	Args: cobra.ExactArgs(1),
+	RunE: resumeRun,
+}
+
+func init() {
+	resumeCmd.Flags().StringVar(&resumeFrom, "from", "", "re-run from this step instead of the first failed one")
+	rootCmd.AddCommand(resumeCmd)
+}
+
+func resumeRun(cmd *cobra.Command, args []string) error {
+	runs := store.NewDirStore(runsDir)
+	prev, err := runs.Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	flows, err := loader.LoadFlows(flowsDir)
+	if err != nil {
+		return fmt.Errorf("loading flows: %w", err)
+	}
+
+	flow, ok := flows[prev.Flow]
+	if !ok {
+		return fmt.Errorf("flow %q not found in %s", prev.Flow, flowsDir)
+	}
+
+	registry := defaultRegistry()
+	eng := engine.NewEngine(registry)
+	eng.Store = runs
+	eng.Strict = strictRefs
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
+		f, ok := flows[name]
+		if !ok {
+			return nil, fmt.Errorf("flow %q not found", name)
+		}
+		return f, nil
+	}
+
+	if err := engine.ValidateFlow(flow, registry); err != nil {
+		return err
+	}
+	if _, err := engine.CheckChildFlows(flow, flows); err != nil {
+		return err
+	}
+
+	secrets, err := loadSecrets(runFlows(flow, flows)...)
+	if err != nil {
+		return err
+	}
+
+	result, err := eng.Resume(context.Background(), flow, prev, resumeFrom, secrets)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(result)
+}
@@ -7,6 +7,10 @@ import (
 var (
 	flowsDir     string
 	outputFormat string
+	runsDir      string
+	strictRefs   bool
+	configFile   string
+	secretsFile  string
 )
 
 var rootCmd = &cobra.Command{
@@ -19,6 +23,10 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&flowsDir, "flows-dir", "./flows", "directory containing flow YAML files")
 	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "table", "output format: table or json")
 	rootCmd.PersistentFlags().StringVar(&pluginsDir, "plugins-dir", "./plugins", "directory containing external plugin executables")
+	rootCmd.PersistentFlags().StringVar(&runsDir, "runs-dir", "./.piper/runs", "directory where run history is stored")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "project config file (default ./piper.yaml if it exists)")
+	rootCmd.PersistentFlags().StringVar(&secretsFile, "secrets-file", "", "path to .env-style secrets file, read after the configured secret providers")
+	rootCmd.PersistentFlags().BoolVar(&strictRefs, "strict", false, "fail on unresolved ${{ }} references in every flow instead of using empty values")
 }
 
 func Execute() error {
@@ -10,13 +10,13 @@ import (
 
 	"piper/internal/engine"
 	"piper/internal/loader"
+	"piper/internal/store"
 	"piper/internal/types"
 )
 
 var (
-	inputJSON   string
-	dryRun      bool
-	secretsFile string
+	inputJSON string
+	dryRun    bool
 )
 
 var runCmd = &cobra.Command{
@@ -29,7 +29,6 @@ var runCmd = &cobra.Command{
 func init() {
 	runCmd.Flags().StringVar(&inputJSON, "input", "{}", "JSON input for the flow")
 	runCmd.Flags().BoolVar(&dryRun, "dry-run", false, "show what would execute without running")
-	runCmd.Flags().StringVar(&secretsFile, "secrets-file", "", "path to .env-style secrets file")
 	rootCmd.AddCommand(runCmd)
 }
 
@@ -53,6 +52,8 @@ func runFlow(cmd *cobra.Command, args []string) error {
 
 	registry := defaultRegistry()
 	eng := engine.NewEngine(registry)
+	eng.Store = store.NewDirStore(runsDir)
+	eng.Strict = strictRefs
 
 	// Enable flow composition.
 	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
@@ -66,22 +67,20 @@ func runFlow(cmd *cobra.Command, args []string) error {
 	if err := engine.ValidateFlow(flow, registry); err != nil {
 		return err
 	}
+	if _, err := engine.CheckChildFlows(flow, flows); err != nil {
+		return err
+	}
+
+	secrets, err := loadSecrets(runFlows(flow, flows)...)
+	if err != nil {
+		return err
+	}
 
 	var result any
 	if dryRun {
-		result, err = eng.DryRun(flow, input)
+		result, err = eng.DryRunWithSecrets(flow, input, secrets)
 	} else {
 		ctx := context.Background()
-
-		// Load secrets if provided.
-		var secrets map[string]string
-		if secretsFile != "" {
-			secrets, err = engine.LoadSecrets(secretsFile)
-			if err != nil {
-				return fmt.Errorf("loading secrets: %w", err)
-			}
-		}
-
 		flowResult, runErr := eng.RunWithSecrets(ctx, flow, input, secrets)
 		result = flowResult
 		err = runErr
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+var (
+	runsFlow   string
+	runsStatus string
+	runsSince  string
+	runsUntil  string
+	runsLimit  int
+)
+
+var runsCmd = &cobra.Command{
+	Use:   "runs",
+	Short: "Inspect run history",
+}
+
+var runsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List past runs, newest first",
+	Args:  cobra.NoArgs,
+	RunE:  listRuns,
+}
+
+var runsShowCmd = &cobra.Command{
+	Use:   "show <run-id>",
+	Short: "Show the full result of a run",
+	Args:  cobra.ExactArgs(1),
+	RunE:  showRun,
+}
+
+func init() {
+	runsListCmd.Flags().StringVar(&runsFlow, "flow", "", "only runs of this flow")
+	runsListCmd.Flags().StringVar(&runsStatus, "status", "", "only runs with this status (e.g. success, failed)")
+	runsListCmd.Flags().StringVar(&runsSince, "since", "", "only runs started after this time (RFC 3339, YYYY-MM-DD, or a duration like 24h)")
+	runsListCmd.Flags().StringVar(&runsUntil, "until", "", "only runs started before this time (same formats as --since)")
+	runsListCmd.Flags().IntVar(&runsLimit, "limit", 20, "maximum number of runs to show (0 for all)")
+	runsCmd.AddCommand(runsListCmd, runsShowCmd)
+	rootCmd.AddCommand(runsCmd)
+}
+
+func listRuns(cmd *cobra.Command, args []string) error {
+	filter := store.Filter{Flow: runsFlow, Status: runsStatus, Limit: runsLimit}
+	var err error
+	if filter.Since, err = parseTimeFlag(runsSince); err != nil {
+		return fmt.Errorf("invalid --since: %w", err)
+	}
+	if filter.Until, err = parseTimeFlag(runsUntil); err != nil {
+		return fmt.Errorf("invalid --until: %w", err)
+	}
+
+	runs, err := store.NewDirStore(runsDir).List(filter)
+	var skipped *store.SkippedError
+	if errors.As(err, &skipped) {
+		for _, e := range skipped.Errs {
+			fmt.Fprintf(os.Stderr, "warning: skipping run: %v\n", e)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if outputFormat == "json" {
+		type runSummary struct {
+			RunID      string    `json:"run_id"`
+			Flow       string    `json:"flow"`
+			Status     string    `json:"status"`
+			StartedAt  time.Time `json:"started_at"`
+			DurationMs int64     `json:"duration_ms"`
+			Steps      int       `json:"steps"`
+			Error      string    `json:"error,omitempty"`
+		}
+		summaries := make([]runSummary, 0, len(runs))
+		for _, r := range runs {
+			summaries = append(summaries, runSummary{
+				RunID:      r.RunID,
+				Flow:       r.Flow,
+				Status:     r.Status,
+				StartedAt:  r.StartedAt,
+				DurationMs: r.CompletedAt.Sub(r.StartedAt).Milliseconds(),
+				Steps:      len(r.Steps),
+				Error:      r.Error,
+			})
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(summaries)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "RUN ID\tFLOW\tSTATUS\tSTARTED\tDURATION\tSTEPS")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", r.RunID, r.Flow, r.Status,
+			r.StartedAt.Local().Format(time.DateTime), runDuration(r.StartedAt, r.CompletedAt), len(r.Steps))
+	}
+	return w.Flush()
+}
+
+func showRun(cmd *cobra.Command, args []string) error {
+	result, err := store.NewDirStore(runsDir).Get(args[0])
+	if err != nil {
+		return err
+	}
+
+	if outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	fmt.Printf("Run:      %s\n", result.RunID)
+	fmt.Printf("Flow:     %s\n", result.Flow)
+	fmt.Printf("Status:   %s\n", result.Status)
+	fmt.Printf("Started:  %s\n", result.StartedAt.Local().Format(time.DateTime))
+	fmt.Printf("Duration: %s\n", runDuration(result.StartedAt, result.CompletedAt))
+	if result.Error != "" {
+		fmt.Printf("Error:    %s\n", result.Error)
+	}
+
+	if len(result.Input) > 0 {
+		input, _ := json.Marshal(result.Input)
+		fmt.Printf("Input:    %s\n", input)
+	}
+
+	sections := []struct {
+		title string
+		steps []types.StepResult
+	}{
+		{"Steps", result.Steps},
+		{"Compensations", result.Compensations},
+		{"On Failure", result.OnFailure},
+		{"Finally", result.Finally},
+	}
+	for _, section := range sections {
+		if len(section.steps) == 0 {
+			continue
+		}
+		fmt.Printf("\n%s:\n", section.title)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "  NAME\tCONNECTOR\tSTATUS\tDURATION\tERROR")
+		for _, sr := range section.steps {
+			printStepRow(w, sr, "  ")
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+// printStepRow prints a step of a run and, for a flow step, the steps of
+// its child flow indented below it.
+func printStepRow(w io.Writer, sr types.StepResult, indent string) {
+	fmt.Fprintf(w, "%s%s\t%s\t%s\t%dms\t%s\n", indent, sr.Name, sr.Connector, sr.Status, sr.DurationMs, sr.Error)
+	if sr.Child != nil {
+		for _, child := range sr.Child.Steps {
+			printStepRow(w, child, indent+"  ")
+		}
+	}
+}
+
+// parseTimeFlag parses an absolute time (RFC 3339 or YYYY-MM-DD) or a
+// duration, which is taken as that long ago. An empty value is the zero time.
+func parseTimeFlag(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a time or duration", s)
+}
+
+func runDuration(start, end time.Time) string {
+	if end.IsZero() {
+		return "-"
+	}
+	return end.Sub(start).Round(time.Millisecond).String()
+}
@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"piper/internal/secrets"
+)
+
+// newPassphraseEnv holds the new vault passphrase for rotate when no
+// --new-key-file is given.
+const newPassphraseEnv = "PIPER_VAULT_NEW_PASSPHRASE"
+
+var (
+	vaultPath       string
+	vaultKeyFile    string
+	vaultNewKeyFile string
+)
+
+var secretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Manage the encrypted secrets vault",
+	Long: "Manage an encrypted vault file that can be committed next to the flows. The vault is\n" +
+		"--vault, or the first vault in the project config, or ./secrets.vault. Its key is the\n" +
+		"contents of --key-file (or the configured key_file), or the passphrase in " + secrets.DefaultPassphraseEnv + ".",
+}
+
+var secretsSetCmd = &cobra.Command{
+	Use:   "set <key> [value]",
+	Short: "Add or replace a secret, reading the value from stdin or a prompt",
+	Long: "Add or replace a secret. The value is read from stdin, or prompted for without echo\n" +
+		"when stdin is a terminal. Passing it as an argument is unsafe: it ends up in the shell\n" +
+		"history and is visible to other users in the process list.",
+	Args: cobra.RangeArgs(1, 2),
+	RunE: setSecret,
+}
+
+var secretsGetCmd = &cobra.Command{
+	Use:   "get <key>",
+	Short: "Print a decrypted secret",
+	Args:  cobra.ExactArgs(1),
+	RunE:  getSecret,
+}
+
+var secretsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the names of the secrets in the vault",
+	Args:  cobra.NoArgs,
+	RunE:  listSecrets,
+}
+
+var secretsRmCmd = &cobra.Command{
+	Use:   "rm <key>",
+	Short: "Remove a secret",
+	Args:  cobra.ExactArgs(1),
+	RunE:  removeSecret,
+}
+
+var secretsRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Re-encrypt every secret with a new key",
+	Long: "Re-encrypts every secret with the key in --new-key-file, or the passphrase in\n" +
+		newPassphraseEnv + ". Afterwards, use the new key for the vault.",
+	Args: cobra.NoArgs,
+	RunE: rotateSecrets,
+}
+
+func init() {
+	secretsCmd.PersistentFlags().StringVar(&vaultPath, "vault", "", "vault file (default: from the project config, or ./secrets.vault)")
+	secretsCmd.PersistentFlags().StringVar(&vaultKeyFile, "key-file", "", "file holding the vault key (default: from the project config, or $"+secrets.DefaultPassphraseEnv+")")
+	secretsRotateCmd.Flags().StringVar(&vaultNewKeyFile, "new-key-file", "", "file holding the new vault key (default: $"+newPassphraseEnv+")")
+	secretsCmd.AddCommand(secretsSetCmd, secretsGetCmd, secretsListCmd, secretsRmCmd, secretsRotateCmd)
+	rootCmd.AddCommand(secretsCmd)
+}
+
+// vaultFile returns the vault the secrets commands manage.
+func vaultFile() (*secrets.VaultFile, error) {
+	vf := &secrets.VaultFile{Path: "secrets.vault"}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	providers, err := cfg.SecretProviders()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range providers {
+		if configured, ok := p.(*secrets.VaultFile); ok {
+			vf = configured
+			break
+		}
+	}
+	if vaultPath != "" {
+		vf.Path = vaultPath
+	}
+	if vaultKeyFile != "" {
+		vf.KeyFile = vaultKeyFile
+	}
+	return vf, nil
+}
+
+// openVault reads and unlocks the vault. With create set, a vault that does
+// not exist yet is created; it is written on Save.
+func openVault(create bool) (*secrets.Vault, error) {
+	vf, err := vaultFile()
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := secrets.VaultPassphrase(vf.KeyFile, vf.PassphraseEnv)
+	if err != nil {
+		return nil, err
+	}
+	v, err := secrets.ReadVault(vf.Path)
+	if create && errors.Is(err, os.ErrNotExist) {
+		return secrets.CreateVault(vf.Path, passphrase)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Unlock(passphrase); err != nil {
+		return nil, fmt.Errorf("%s: %w", vf.Path, err)
+	}
+	return v, nil
+}
+
+func setSecret(cmd *cobra.Command, args []string) error {
+	key := args[0]
+	var value string
+	if len(args) == 2 {
+		fmt.Fprintln(os.Stderr, "warning: a secret passed as an argument is visible in the shell history and process list; omit it to read the value from stdin")
+		value = args[1]
+	} else {
+		var err error
+		if value, err = readSecretValue(key); err != nil {
+			return err
+		}
+	}
+
+	v, err := openVault(true)
+	if err != nil {
+		return err
+	}
+	if err := v.Set(key, value); err != nil {
+		return err
+	}
+	if err := v.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Set secret %q in %s\n", key, v.Path())
+	return nil
+}
+
+// readSecretValue reads a secret value from stdin, prompting for it without
+// echo if stdin is a terminal.
+func readSecretValue(key string) (string, error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintf(os.Stderr, "Value for %s: ", key)
+		// Without stty, as on Windows, the value is echoed.
+		if stty("-echo") == nil {
+			defer func() {
+				stty("echo")
+				fmt.Fprintln(os.Stderr)
+			}()
+		}
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", fmt.Errorf("reading secret: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", fmt.Errorf("reading secret from stdin: %w", err)
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), nil
+}
+
+// stty changes the settings of the terminal on stdin.
+func stty(arg string) error {
+	cmd := exec.Command("stty", arg)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+func getSecret(cmd *cobra.Command, args []string) error {
+	v, err := openVault(false)
+	if err != nil {
+		return err
+	}
+	value, err := v.Get(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
+
+func listSecrets(cmd *cobra.Command, args []string) error {
+	vf, err := vaultFile()
+	if err != nil {
+		return err
+	}
+	// Names are stored in the clear, so listing needs no key.
+	v, err := secrets.ReadVault(vf.Path)
+	if err != nil {
+		return err
+	}
+
+	if outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v.Keys())
+	}
+	for _, key := range v.Keys() {
+		fmt.Println(key)
+	}
+	return nil
+}
+
+func removeSecret(cmd *cobra.Command, args []string) error {
+	v, err := openVault(false)
+	if err != nil {
+		return err
+	}
+	if !v.Remove(args[0]) {
+		return fmt.Errorf("vault %s has no secret %q", v.Path(), args[0])
+	}
+	if err := v.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Removed secret %q from %s\n", args[0], v.Path())
+	return nil
+}
+
+func rotateSecrets(cmd *cobra.Command, args []string) error {
+	v, err := openVault(false)
+	if err != nil {
+		return err
+	}
+	newPassphrase, err := secrets.VaultPassphrase(vaultNewKeyFile, newPassphraseEnv)
+	if err != nil {
+		return fmt.Errorf("new key: %w", err)
+	}
+	if err := v.Rotate(newPassphrase); err != nil {
+		return err
+	}
+	if err := v.Save(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Re-encrypted %d secret(s) in %s with the new key\n", len(v.Keys()), v.Path())
+	return nil
+}
@@ -2,16 +2,24 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 
 	"piper/internal/engine"
 	"piper/internal/loader"
 	"piper/internal/server"
+	"piper/internal/store"
 	"piper/internal/types"
 )
 
-var servePort int
+var (
+	servePort          int
+	serveAllowApproval bool
+)
+
+// approvalTokenEnv holds the bearer token for the /runs/ routes of flow serve.
+const approvalTokenEnv = "PIPER_APPROVAL_TOKEN"
 
 var serveCmd = &cobra.Command{
 	Use:   "serve",
@@ -22,6 +30,7 @@ var serveCmd = &cobra.Command{
 
 func init() {
 	serveCmd.Flags().IntVar(&servePort, "port", 8080, "port to listen on")
+	serveCmd.Flags().BoolVar(&serveAllowApproval, "allow-approvals", false, "serve /runs/<id> and its approve and reject routes to requests with the bearer token in $"+approvalTokenEnv)
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -33,6 +42,11 @@ func serveWebhook(cmd *cobra.Command, args []string) error {
 
 	registry := defaultRegistry()
 	eng := engine.NewEngine(registry)
+	eng.Store = store.NewDirStore(runsDir)
+	eng.Strict = strictRefs
+	if eng.Secrets, err = loadSecrets(allFlows(flows)...); err != nil {
+		return err
+	}
 	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
 		f, ok := flows[name]
 		if !ok {
@@ -42,6 +56,13 @@ func serveWebhook(cmd *cobra.Command, args []string) error {
 	}
 
 	srv := server.NewWebhookServer(eng, flows)
+	if serveAllowApproval {
+		srv.AllowApprovals = true
+		srv.ApprovalToken = os.Getenv(approvalTokenEnv)
+		if srv.ApprovalToken == "" {
+			return fmt.Errorf("--allow-approvals requires a token in $%s", approvalTokenEnv)
+		}
+	}
 	addr := fmt.Sprintf(":%d", servePort)
 	fmt.Printf("Starting webhook server on %s\n", addr)
 	fmt.Printf("Loaded %d flow(s)\n", len(flows))
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 
@@ -30,8 +32,35 @@ func validateFlow(cmd *cobra.Command, args []string) error {
 
 	registry := defaultRegistry()
 
-	if err := engine.ValidateFlow(flow, registry); err != nil {
-		return err
+	diags, err := engine.CheckFlow(flow, registry)
+	// Child flows are looked up in --flows-dir, if it can be loaded.
+	if flows, loadErr := loader.LoadFlows(flowsDir); loadErr == nil {
+		childDiags, childErr := engine.CheckChildFlows(flow, flows)
+		diags = append(diags, childDiags...)
+		if err == nil {
+			err = childErr
+		}
+	}
+	if outputFormat == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if diags == nil {
+			diags = []engine.Diagnostic{}
+		}
+		if encErr := enc.Encode(map[string]any{"flow": flow.Name, "valid": err == nil, "diagnostics": diags}); encErr != nil {
+			return encErr
+		}
+		if err != nil {
+			return fmt.Errorf("flow %q is invalid", flow.Name)
+		}
+		return nil
+	}
+
+	for _, d := range diags {
+		fmt.Fprintln(os.Stderr, d)
+	}
+	if err != nil {
+		return fmt.Errorf("flow %q is invalid", flow.Name)
 	}
 
 	fmt.Printf("Flow %q is valid.\n", flow.Name)
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+
+	"piper/internal/secrets"
+)
+
+// DefaultFile is the project config read from the working directory when
+// no other file is given.
+const DefaultFile = "piper.yaml"
+
+// Config is the project configuration.
+type Config struct {
+	// Secrets lists the secret providers, in order; later providers
+	// override keys of earlier ones.
+	Secrets []secrets.Spec `yaml:"secrets"`
+
+	// dir is the directory of the config file, which relative paths in it
+	// are resolved against.
+	dir string
+}
+
+// Load reads a config file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	var cfg Config
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	cfg.dir = filepath.Dir(path)
+	if _, err := cfg.SecretProviders(); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// SecretProviders creates the configured secret providers.
+func (c *Config) SecretProviders() ([]secrets.Provider, error) {
+	providers := make([]secrets.Provider, 0, len(c.Secrets))
+	for i, spec := range c.Secrets {
+		p, err := secrets.New(spec, c.dir)
+		if err != nil {
+			return nil, fmt.Errorf("secrets[%d]: %w", i, err)
+		}
+		providers = append(providers, p)
+	}
+	return providers, nil
+}
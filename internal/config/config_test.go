@@ -0,0 +1,53 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"piper/internal/secrets"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "piper.yaml")
+	os.WriteFile(path, []byte(`
+secrets:
+  - type: env-file
+    path: .env
+  - type: env
+  - type: vault
+    path: secrets.vault
+    key_file: /etc/piper/vault.key
+`), 0644)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	providers, err := cfg.SecretProviders()
+	if err != nil {
+		t.Fatalf("SecretProviders error: %v", err)
+	}
+	if len(providers) != 3 {
+		t.Fatalf("expected 3 providers, got %d", len(providers))
+	}
+	if p, ok := providers[0].(*secrets.EnvFile); !ok || p.Path != filepath.Join(dir, ".env") {
+		t.Errorf("providers[0] = %#v, want env-file relative to the config", providers[0])
+	}
+	if p, ok := providers[1].(*secrets.Env); !ok || p.Prefix != secrets.DefaultEnvPrefix {
+		t.Errorf("providers[1] = %#v, want env with the default prefix", providers[1])
+	}
+	if p, ok := providers[2].(*secrets.VaultFile); !ok || p.KeyFile != "/etc/piper/vault.key" {
+		t.Errorf("providers[2] = %#v", providers[2])
+	}
+}
+
+func TestLoadInvalidProvider(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "piper.yaml")
+	os.WriteFile(path, []byte("secrets:\n  - type: keychain\n"), 0644)
+
+	if _, err := Load(path); err == nil {
+		t.Fatal("expected error for an unknown provider type")
+	}
+}
@@ -0,0 +1,304 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"time"
+
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+// ErrNotWaiting is returned when a decision is made for a run that is not
+// waiting for approval, e.g. because another decision was made first.
+var ErrNotWaiting = errors.New("not waiting for approval")
+
+// Decision is the answer to the approval steps a run is waiting on.
+type Decision struct {
+	Approved bool
+	Comment  string
+}
+
+// executeApproval handles connector "approval". On first execution the step
+// suspends the run with status "waiting_approval"; when the run is continued
+// by ResolveApproval, the recorded decision is returned instead.
+//
+// Input: message, timeout (a duration, optional) and default ("approve" or
+// "reject", applied when the timeout has passed).
+func (e *Engine) executeApproval(step types.StepDef, sctx *StepContext) types.StepResult {
+	if sr, ok := sctx.approvals[step.Name]; ok {
+		return sr
+	}
+
+	sr := types.StepResult{
+		Name:      step.Name,
+		Connector: "approval",
+		Action:    step.Action,
+	}
+	if e.Store == nil {
+		sr.Status = "error"
+		sr.Error = "approval steps require a run store"
+		return sr
+	}
+
+	input, err := sctx.ResolveMap(step.Input)
+	if err != nil {
+		sr.Status = "error"
+		sr.Error = fmt.Sprintf("resolving input: %v", err)
+		return sr
+	}
+
+	now := time.Now().UTC()
+	sr.Status = "waiting_approval"
+	sr.Output = map[string]any{
+		"message":      input["message"],
+		"requested_at": now.Format(time.RFC3339),
+	}
+	if t, ok := input["timeout"].(string); ok && t != "" {
+		timeout, err := time.ParseDuration(t)
+		if err != nil {
+			sr.Status = "error"
+			sr.Error = fmt.Sprintf("invalid approval timeout %q", t)
+			return sr
+		}
+		sr.Output["expires_at"] = now.Add(timeout).Format(time.RFC3339)
+	}
+	if d, ok := input["default"].(string); ok && d != "" {
+		if d != "approve" && d != "reject" {
+			sr.Status = "error"
+			sr.Error = fmt.Sprintf("invalid approval default %q (must be approve or reject)", d)
+			return sr
+		}
+		sr.Output["default"] = d
+	}
+	return sr
+}
+
+// ResolveApproval records a decision for every approval step the stored run
+// runID is waiting on, then continues the run under the same run ID. An
+// approval whose timeout has passed gets its default decision instead, or
+// the status "timed_out" if it has none.
+func (e *Engine) ResolveApproval(ctx context.Context, runID string, d Decision, secrets map[string]string) (*types.FlowResult, error) {
+	return e.resolveApprovals(ctx, runID, &d, secrets)
+}
+
+// ExpireApprovals continues every stored run with an approval step whose
+// timeout has passed, applying the step's default decision. It returns the
+// runs it continued.
+func (e *Engine) ExpireApprovals(ctx context.Context, secrets map[string]string) ([]*types.FlowResult, error) {
+	if e.Store == nil {
+		return nil, nil
+	}
+	// Runs that cannot be read cannot be continued either; the others still
+	// expire.
+	waiting, err := e.Store.List(store.Filter{Status: "waiting_approval"})
+	var skipped *store.SkippedError
+	if err != nil && !errors.As(err, &skipped) {
+		return nil, err
+	}
+	// Runs whose continuation died are still waiting.
+	running, err := e.Store.List(store.Filter{Status: "running"})
+	if err != nil && !errors.As(err, &skipped) {
+		return nil, err
+	}
+	for _, run := range running {
+		if store.Stale(run) {
+			waiting = append(waiting, run)
+		}
+	}
+
+	now := time.Now()
+	var resolved []*types.FlowResult
+	for _, run := range waiting {
+		expired := false
+		for _, sr := range run.Steps {
+			if sr.Status == "waiting_approval" && approvalExpired(sr, now) {
+				expired = true
+			}
+		}
+		if !expired {
+			continue
+		}
+		result, err := e.resolveApprovals(ctx, run.RunID, nil, secrets)
+		if errors.Is(err, ErrNotWaiting) {
+			// Decided since it was listed.
+			continue
+		}
+		if err != nil {
+			return resolved, fmt.Errorf("run %s: %w", run.RunID, err)
+		}
+		resolved = append(resolved, result)
+	}
+	return resolved, nil
+}
+
+// resolveApprovals continues a waiting run. A nil decision only resolves
+// expired approvals; the others keep waiting.
+func (e *Engine) resolveApprovals(ctx context.Context, runID string, d *Decision, secrets map[string]string) (*types.FlowResult, error) {
+	if e.Store == nil {
+		return nil, fmt.Errorf("approvals require a run store")
+	}
+	if e.FlowLoader == nil {
+		return nil, fmt.Errorf("approvals require a flow loader")
+	}
+	// Claim the run, so that concurrent decisions, from the CLI, the
+	// webhook or MCP servers or the expiry ticker, continue it only once.
+	run, err := e.Store.SwapStatus(runID, "waiting_approval", "running")
+	var se *store.StatusError
+	if errors.As(err, &se) {
+		return nil, fmt.Errorf("run %s is %w (status %q)", runID, ErrNotWaiting, se.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// release hands the run back if it cannot be continued.
+	release := func(err error) (*types.FlowResult, error) {
+		if _, rerr := e.Store.SwapStatus(runID, "running", "waiting_approval"); rerr != nil {
+			return nil, errors.Join(err, rerr)
+		}
+		return nil, err
+	}
+
+	run, err = e.unmasked(run, secrets)
+	if err != nil {
+		return release(err)
+	}
+	flow, err := e.FlowLoader(run.Flow)
+	if err != nil {
+		return release(err)
+	}
+
+	restored := ranSteps(flow, run)
+
+	result := &types.FlowResult{
+		RunID:       run.RunID,
+		ResumedFrom: run.ResumedFrom,
+		Flow:        run.Flow,
+		Status:      "success",
+		StartedAt:   run.StartedAt,
+		Input:       run.Input,
+		Steps:       make([]types.StepResult, 0, len(run.Steps)),
+	}
+	sctx := NewStepContext(run.Input)
+	if secrets != nil {
+		sctx.Secrets = secrets
+	}
+	restoreResults(flow, run, restored, result, sctx, false)
+	// Failures the run continued past still count towards its status.
+	defs := make(map[string]types.StepDef)
+	for _, step := range flow.Steps {
+		defs[step.Name] = step
+		for _, ps := range step.Parallel {
+			defs[ps.Name] = ps
+		}
+	}
+	for _, sr := range result.Steps {
+		e.handleStepError(&sr, defs[sr.Name].OnError, result)
+	}
+
+	now := time.Now().UTC()
+	sctx.approvals = make(map[string]types.StepResult)
+	for _, sr := range run.Steps {
+		if sr.Status == "waiting_approval" {
+			sctx.approvals[sr.Name] = decideApproval(sr, d, now)
+		}
+	}
+
+	result, err = e.runWithContext(ctx, flow, result, sctx, restored)
+	if err != nil {
+		return release(err)
+	}
+	return e.persist(result, secrets)
+}
+
+// ranSteps returns the top-level steps of flow that ran before run stopped
+// at its approval steps, whatever their status, so that continuing the run
+// only executes the approval steps and the steps after them.
+func ranSteps(flow *types.FlowDef, run *types.FlowResult) map[string]bool {
+	nodeOf := stepNodes(flow.Steps)
+	ran := make(map[string]bool)
+	waiting := make(map[string]bool)
+	for _, sr := range run.Steps {
+		node, ok := nodeOf[sr.Name]
+		if !ok {
+			continue
+		}
+		if sr.Status == "waiting_approval" {
+			waiting[node] = true
+		} else {
+			ran[node] = true
+		}
+	}
+	for node := range waiting {
+		delete(ran, node)
+	}
+	return ran
+}
+
+// decideApproval applies a decision to a waiting approval result. Expired
+// approvals take their default decision; with no decision the result is
+// returned unchanged.
+func decideApproval(sr types.StepResult, d *Decision, now time.Time) types.StepResult {
+	var approved bool
+	var comment string
+	out := maps.Clone(sr.Output)
+	if out == nil {
+		out = map[string]any{}
+	}
+
+	switch {
+	case approvalExpired(sr, now):
+		out["timed_out"] = true
+		switch out["default"] {
+		case "approve":
+			approved = true
+		case "reject":
+		default:
+			sr.Output = out
+			sr.Status = "timed_out"
+			sr.Error = "approval timed out"
+			sr.DurationMs = approvalWait(sr, now)
+			return sr
+		}
+	case d == nil:
+		return sr
+	default:
+		approved = d.Approved
+		comment = d.Comment
+	}
+
+	out["approved"] = approved
+	out["comment"] = comment
+	out["decided_at"] = now.Format(time.RFC3339)
+	sr.Output = out
+	sr.DurationMs = approvalWait(sr, now)
+	if approved {
+		sr.Status = "success"
+	} else {
+		sr.Status = "rejected"
+		sr.Error = "approval rejected"
+	}
+	return sr
+}
+
+// approvalExpired reports whether a waiting approval's timeout has passed.
+func approvalExpired(sr types.StepResult, now time.Time) bool {
+	s, ok := sr.Output["expires_at"].(string)
+	if !ok {
+		return false
+	}
+	expires, err := time.Parse(time.RFC3339, s)
+	return err == nil && now.After(expires)
+}
+
+// approvalWait returns how long an approval waited for its decision, in ms.
+func approvalWait(sr types.StepResult, now time.Time) int64 {
+	s, _ := sr.Output["requested_at"].(string)
+	requested, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0
+	}
+	return now.Sub(requested).Milliseconds()
+}
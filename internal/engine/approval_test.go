@@ -0,0 +1,250 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"piper/internal/plugin"
+	"piper/internal/plugin/builtin"
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+func approvalEngine(t *testing.T, flow *types.FlowDef) *Engine {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	eng := NewEngine(registry)
+	eng.Store = store.NewDirStore(t.TempDir())
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
+		if name == flow.Name {
+			return flow, nil
+		}
+		return nil, fmt.Errorf("not found")
+	}
+	return eng
+}
+
+func approvalFlow(input map[string]any) *types.FlowDef {
+	return &types.FlowDef{
+		Name: "gated",
+		Steps: []types.StepDef{
+			{Name: "build", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo built"}},
+			{Name: "gate", Connector: "approval", Input: input},
+			{Name: "deploy", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo deploy ${{ steps.gate.output.comment }}"}},
+		},
+	}
+}
+
+func TestEngineApproval(t *testing.T) {
+	flow := approvalFlow(map[string]any{"message": "Ship ${{ steps.build.output.stdout }}?"})
+	eng := approvalEngine(t, flow)
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "waiting_approval" || len(result.Steps) != 2 {
+		t.Fatalf("status = %q with %d steps, want waiting_approval after gate", result.Status, len(result.Steps))
+	}
+	if result.Steps[1].Output["message"] != "Ship built?" {
+		t.Errorf("message = %v, want resolved message", result.Steps[1].Output["message"])
+	}
+
+	saved, err := eng.Store.Get(result.RunID)
+	if err != nil || saved.Status != "waiting_approval" {
+		t.Fatalf("stored run = %+v, %v; want waiting_approval", saved, err)
+	}
+
+	result, err = eng.ResolveApproval(context.Background(), result.RunID, Decision{Approved: true, Comment: "lgtm"}, nil)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if result.Status != "success" || len(result.Steps) != 3 {
+		t.Fatalf("status = %q with %d steps, want success with 3", result.Status, len(result.Steps))
+	}
+	if got := result.Steps[2].Output["stdout"]; got != "deploy lgtm" {
+		t.Errorf("deploy stdout = %v, want %q", got, "deploy lgtm")
+	}
+
+	if _, err := eng.ResolveApproval(context.Background(), result.RunID, Decision{Approved: true}, nil); err == nil {
+		t.Error("expected error approving a finished run")
+	}
+}
+
+func TestEngineApprovalReject(t *testing.T) {
+	flow := approvalFlow(map[string]any{"message": "Ship?"})
+	eng := approvalEngine(t, flow)
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, err = eng.ResolveApproval(context.Background(), result.RunID, Decision{Approved: false}, nil)
+	if err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+	if result.Status != "failed" || result.Steps[len(result.Steps)-1].Status != "rejected" {
+		t.Errorf("status = %q, last step = %+v; want failed at rejected gate", result.Status, result.Steps[len(result.Steps)-1])
+	}
+}
+
+func TestEngineApprovalKeepsStepsBeforeGate(t *testing.T) {
+	calls := filepath.Join(t.TempDir(), "calls")
+	flow := &types.FlowDef{
+		Name: "gated",
+		Steps: []types.StepDef{
+			{Name: "flaky", Connector: "shell", Action: "run", OnError: "continue",
+				Input: map[string]any{"command": "echo flaky >> " + calls + " && exit 1"}},
+			{Name: "build", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo build >> " + calls}},
+			{Name: "gate", Connector: "approval", Input: map[string]any{"message": "Ship?"}},
+			{Name: "deploy", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo deploy >> " + calls}},
+		},
+	}
+	eng := approvalEngine(t, flow)
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil || result.Status != "waiting_approval" {
+		t.Fatalf("run: %v, status %q; want waiting_approval", err, result.Status)
+	}
+	result, err = eng.ResolveApproval(context.Background(), result.RunID, Decision{Approved: true}, nil)
+	if err != nil {
+		t.Fatalf("approve: %v", err)
+	}
+	if result.Status != "partial" || len(result.Steps) != 4 || result.Steps[0].Status != "failed" {
+		t.Errorf("status = %q, steps = %+v; want partial with the failed step kept", result.Status, result.Steps)
+	}
+	data, _ := os.ReadFile(calls)
+	if got := strings.Fields(string(data)); strings.Join(got, ",") != "flaky,build,deploy" {
+		t.Errorf("steps ran %v, want each once: flaky, build, deploy", got)
+	}
+}
+
+func TestEngineApprovalTimeoutDefault(t *testing.T) {
+	flow := approvalFlow(map[string]any{"message": "Ship?", "timeout": "1s", "default": "approve"})
+	eng := approvalEngine(t, flow)
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if resolved, err := eng.ExpireApprovals(context.Background(), nil); err != nil || len(resolved) != 0 {
+		t.Fatalf("expected no expired approvals yet, got %d, %v", len(resolved), err)
+	}
+
+	// Expiry has one-second resolution.
+	time.Sleep(2100 * time.Millisecond)
+	resolved, err := eng.ExpireApprovals(context.Background(), nil)
+	if err != nil || len(resolved) != 1 {
+		t.Fatalf("expected 1 expired approval, got %d, %v", len(resolved), err)
+	}
+	if resolved[0].RunID != result.RunID || resolved[0].Status != "success" {
+		t.Errorf("resolved run = %s %q, want %s success", resolved[0].RunID, resolved[0].Status, result.RunID)
+	}
+	if resolved[0].Steps[1].Output["timed_out"] != true {
+		t.Errorf("gate output = %v, want timed_out", resolved[0].Steps[1].Output)
+	}
+}
+
+func TestEngineApprovalConcurrentDecisions(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "deploys")
+	flow := approvalFlow(map[string]any{"message": "Ship?"})
+	flow.Steps[2].Input = map[string]any{"command": "echo deployed >> " + marker}
+	eng := approvalEngine(t, flow)
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	const callers = 8
+	errs := make(chan error, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := eng.ResolveApproval(context.Background(), result.RunID, Decision{Approved: true}, nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if !errors.Is(err, ErrNotWaiting) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Errorf("%d decisions continued the run, want 1", succeeded)
+	}
+	data, _ := os.ReadFile(marker)
+	if got := strings.Count(string(data), "deployed"); got != 1 {
+		t.Errorf("deploy ran %d times, want 1", got)
+	}
+}
+
+func TestEngineApprovalReleasedOnError(t *testing.T) {
+	flow := approvalFlow(map[string]any{"message": "Ship?"})
+	eng := approvalEngine(t, flow)
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	loader := eng.FlowLoader
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) { return nil, fmt.Errorf("flows unavailable") }
+	if _, err := eng.ResolveApproval(context.Background(), result.RunID, Decision{Approved: true}, nil); err == nil {
+		t.Fatal("expected the flow loader error")
+	}
+	if saved, _ := eng.Store.Get(result.RunID); saved.Status != "waiting_approval" {
+		t.Fatalf("status after a failed continuation = %q, want waiting_approval", saved.Status)
+	}
+
+	eng.FlowLoader = loader
+	if result, err = eng.ResolveApproval(context.Background(), result.RunID, Decision{Approved: true}, nil); err != nil || result.Status != "success" {
+		t.Errorf("approve after release: %v, %v", result, err)
+	}
+}
+
+func TestEngineApprovalStaleClaim(t *testing.T) {
+	flow := approvalFlow(map[string]any{"message": "Ship?", "timeout": "1ms", "default": "approve"})
+	eng := approvalEngine(t, flow)
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// A process that claimed the run and died leaves it "running" with the
+	// claim of a process that no longer exists.
+	claimed, err := eng.Store.SwapStatus(result.RunID, "waiting_approval", "running")
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	claimed.Claim.PID = -1
+	if err := eng.Store.Save(claimed); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	time.Sleep(5 * time.Millisecond)
+	resolved, err := eng.ExpireApprovals(context.Background(), nil)
+	if err != nil || len(resolved) != 1 || resolved[0].Status != "success" {
+		t.Fatalf("ExpireApprovals = %v, %v; want the stale run continued", resolved, err)
+	}
+	if saved, _ := eng.Store.Get(result.RunID); saved.Status != "success" || saved.Claim != nil {
+		t.Errorf("stored run = %q claimed by %+v, want success without a claim", saved.Status, saved.Claim)
+	}
+}
@@ -1,10 +1,14 @@
 package engine
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
 
 	"piper/internal/types"
@@ -18,6 +22,18 @@ type StepContext struct {
 	Steps   map[string]*types.StepResult
 	Env     map[string]string
 	Secrets map[string]string
+	// Vars holds named variables such as the current foreach item.
+	Vars map[string]any
+	// Strict makes missing input fields, environment variables and secrets
+	// errors instead of empty strings.
+	Strict bool
+
+	// approvals holds decided (or still pending) approval results when a
+	// waiting run is continued.
+	approvals map[string]types.StepResult
+
+	// mu guards Steps, which is written while other steps are still running.
+	mu *sync.RWMutex
 }
 
 // NewStepContext creates a StepContext from flow input.
@@ -33,14 +49,39 @@ func NewStepContext(input map[string]any) *StepContext {
 		Steps:   make(map[string]*types.StepResult),
 		Env:     env,
 		Secrets: make(map[string]string),
+		mu:      &sync.RWMutex{},
 	}
 }
 
 // AddStepResult records the result of a step for later reference.
 func (sc *StepContext) AddStepResult(name string, result *types.StepResult) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
 	sc.Steps[name] = result
 }
 
+// withVars returns a child context that shares input and step results with
+// sc and additionally exposes the given variables.
+func (sc *StepContext) withVars(vars map[string]any) *StepContext {
+	child := *sc
+	child.Vars = make(map[string]any, len(sc.Vars)+len(vars))
+	for k, v := range sc.Vars {
+		child.Vars[k] = v
+	}
+	for k, v := range vars {
+		child.Vars[k] = v
+	}
+	return &child
+}
+
+// stepResult returns the recorded result of a step, if any.
+func (sc *StepContext) stepResult(name string) (*types.StepResult, bool) {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+	sr, ok := sc.Steps[name]
+	return sr, ok
+}
+
 // ResolveMap recursively resolves all expressions in a map.
 func (sc *StepContext) ResolveMap(m map[string]any) (map[string]any, error) {
 	result := make(map[string]any, len(m))
@@ -91,240 +132,256 @@ func (sc *StepContext) resolveString(s string) (any, error) {
 			evalErr = err
 			return match
 		}
+		if val == nil {
+			return ""
+		}
 		return fmt.Sprintf("%v", val)
 	})
 	return result, evalErr
 }
 
-// evaluateExpr evaluates a single expression like "input.name | slugify".
+// evaluateExpr evaluates a single expression like "input.name | slugify"
+// or "steps.test.status == 'success' && input.deploy".
 func (sc *StepContext) evaluateExpr(expr string) (any, error) {
-	parts := strings.SplitN(expr, "|", 2)
-	path := strings.TrimSpace(parts[0])
-
-	val, err := sc.resolvePath(path)
+	node, err := parseExpr(expr)
 	if err != nil {
 		return nil, err
 	}
-
-	if len(parts) == 2 {
-		pipeFn := strings.TrimSpace(parts[1])
-		val, err = applyPipe(val, pipeFn)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	return val, nil
+	return sc.eval(node)
 }
 
-// resolvePath resolves a dotted path like "input.name" or "steps.create-repo.output.repo_url".
-func (sc *StepContext) resolvePath(path string) (any, error) {
-	segments := strings.SplitN(path, ".", 2)
-	root := segments[0]
-
-	switch root {
+// resolvePath resolves a variable path like "input.name",
+// "steps.create-repo.output.repo_url" or "steps.fetch.output.items[0].id".
+func (sc *StepContext) resolvePath(p *pathNode) (any, error) {
+	switch p.root {
 	case "input":
-		if len(segments) < 2 {
-			return sc.Input, nil
-		}
-		val, err := lookupNested(sc.Input, segments[1])
+		val, err := sc.traverse(sc.Input, p.segments)
 		if err != nil {
+			if sc.Strict {
+				return nil, err
+			}
 			// Missing input fields resolve to empty string (supports optional fields).
 			return "", nil
 		}
 		return val, nil
 
 	case "steps":
-		if len(segments) < 2 {
-			return nil, fmt.Errorf("incomplete step reference: %q", path)
-		}
-		rest := segments[1]
-		// rest is like "create-repo.output.repo_url"
-		stepParts := strings.SplitN(rest, ".output.", 2)
-		if len(stepParts) != 2 {
-			// Could be "create-repo.status"
-			stepParts2 := strings.SplitN(rest, ".", 2)
-			stepName := stepParts2[0]
-			sr, ok := sc.Steps[stepName]
-			if !ok {
-				return nil, fmt.Errorf("step %q not found", stepName)
-			}
-			if len(stepParts2) == 2 && stepParts2[1] == "status" {
-				return sr.Status, nil
-			}
-			return nil, fmt.Errorf("invalid step reference: %q", path)
+		if len(p.segments) == 0 || p.segments[0].kind != segKey {
+			return nil, fmt.Errorf("incomplete step reference: %q", p.raw)
 		}
-		stepName := stepParts[0]
-		outputField := stepParts[1]
-		sr, ok := sc.Steps[stepName]
+		stepName := p.segments[0].key
+		sr, ok := sc.stepResult(stepName)
 		if !ok {
 			return nil, fmt.Errorf("step %q not found", stepName)
 		}
-		if sr.Output == nil {
-			return nil, fmt.Errorf("step %q has no output", stepName)
+		if len(p.segments) < 2 || p.segments[1].kind != segKey {
+			return nil, fmt.Errorf("invalid step reference: %q", p.raw)
 		}
-		return lookupNested(sr.Output, outputField)
+		switch p.segments[1].key {
+		case "status":
+			if len(p.segments) == 2 {
+				return sr.Status, nil
+			}
+		case "output":
+			if sr.Output == nil {
+				return nil, fmt.Errorf("step %q has no output", stepName)
+			}
+			return sc.traverse(sr.Output, p.segments[2:])
+		}
+		return nil, fmt.Errorf("invalid step reference: %q", p.raw)
 
-	case "env":
-		if len(segments) < 2 {
-			return nil, fmt.Errorf("incomplete env reference: %q", path)
+	case "env", "secret":
+		if len(p.segments) == 0 {
+			return nil, fmt.Errorf("incomplete %s reference: %q", p.root, p.raw)
 		}
-		val, ok := sc.Env[segments[1]]
-		if !ok {
-			return "", nil
+		if len(p.segments) > 1 || p.segments[0].kind != segKey {
+			return nil, fmt.Errorf("invalid %s reference: %q", p.root, p.raw)
 		}
-		return val, nil
-
-	case "secret":
-		if len(segments) < 2 {
-			return nil, fmt.Errorf("incomplete secret reference: %q", path)
+		values := sc.Env
+		if p.root == "secret" {
+			values = sc.Secrets
 		}
-		val, ok := sc.Secrets[segments[1]]
+		val, ok := values[p.segments[0].key]
 		if !ok {
+			if sc.Strict {
+				return nil, fmt.Errorf("%s %q is not set", p.root, p.segments[0].key)
+			}
 			return "", nil
 		}
 		return val, nil
 
 	default:
-		return nil, fmt.Errorf("unknown variable root %q in %q", root, path)
+		val, ok := sc.Vars[p.root]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable root %q in %q", p.root, p.raw)
+		}
+		return sc.traverse(val, p.segments)
 	}
 }
 
-func lookupNested(m map[string]any, path string) (any, error) {
-	parts := strings.Split(path, ".")
-	var current any = m
-	for _, part := range parts {
-		mp, ok := current.(map[string]any)
-		if !ok {
-			return nil, fmt.Errorf("cannot index into non-object at %q", part)
-		}
-		current, ok = mp[part]
-		if !ok {
-			return nil, fmt.Errorf("key %q not found", part)
+// traverse applies path segments to a value. Keys index objects (and arrays,
+// when numeric), indexes count from the end when negative, and wildcards and
+// filters return an array holding the rest of the path applied to each
+// matching element; elements where it does not resolve are left out.
+func (sc *StepContext) traverse(val any, segments []pathSegment) (any, error) {
+	current := val
+	for i, seg := range segments {
+		switch seg.kind {
+		case segKey:
+			if m, ok := asObject(current); ok {
+				v, found := m[seg.key]
+				if !found {
+					return nil, fmt.Errorf("key %q not found", seg.key)
+				}
+				current = v
+				continue
+			}
+			n, err := strconv.Atoi(seg.key)
+			if list, ok := asList(current); ok && err == nil {
+				v, err := indexList(list, n)
+				if err != nil {
+					return nil, err
+				}
+				current = v
+				continue
+			}
+			return nil, fmt.Errorf("cannot index into non-object at %q", seg.key)
+
+		case segIndex:
+			list, ok := asList(current)
+			if !ok {
+				return nil, fmt.Errorf("cannot index into %s with [%d]", typeName(current), seg.index)
+			}
+			v, err := indexList(list, seg.index)
+			if err != nil {
+				return nil, err
+			}
+			current = v
+
+		case segWildcard, segFilter:
+			elems, ok := asList(current)
+			if !ok {
+				m, isObj := asObject(current)
+				if !isObj {
+					return nil, fmt.Errorf("cannot select elements of %s", typeName(current))
+				}
+				elems = objectValues(m)
+			}
+			out := make([]any, 0, len(elems))
+			for _, elem := range elems {
+				if seg.kind == segFilter {
+					// A filter that cannot be evaluated for an element,
+					// e.g. because a field is missing, does not match it.
+					keep, err := sc.withVars(map[string]any{"@": elem}).eval(seg.filter)
+					if err != nil || !isTruthy(keep) {
+						continue
+					}
+				}
+				v, err := sc.traverse(elem, segments[i+1:])
+				if err != nil {
+					continue
+				}
+				out = append(out, v)
+			}
+			return out, nil
 		}
 	}
 	return current, nil
 }
 
-func applyPipe(val any, fn string) (any, error) {
-	s := fmt.Sprintf("%v", val)
-	switch fn {
-	case "slugify":
-		return slugify(s), nil
-	case "upper":
-		return strings.ToUpper(s), nil
-	case "lower":
-		return strings.ToLower(s), nil
-	case "trim":
-		return strings.TrimSpace(s), nil
-	default:
-		return nil, fmt.Errorf("unknown pipe function %q", fn)
+// indexList returns list[n], counting from the end for negative n.
+func indexList(list []any, n int) (any, error) {
+	i := n
+	if i < 0 {
+		i += len(list)
+	}
+	if i < 0 || i >= len(list) {
+		return nil, fmt.Errorf("index %d out of range (length %d)", n, len(list))
 	}
+	return list[i], nil
 }
 
-// conditionRegex matches comparison expressions like: value == "string" or value != "string"
-var conditionRegex = regexp.MustCompile(`^(.+?)\s*(==|!=|>=|<=|>|<)\s*(.+)$`)
-
-// EvaluateCondition evaluates a when expression and returns true if the step should run.
-// Supports: ${{ expr == "value" }}, ${{ expr != "value" }}, ${{ expr }}, boolean comparisons.
-func (sc *StepContext) EvaluateCondition(when string) (bool, error) {
-	if when == "" {
-		return true, nil
+// asObject converts maps with string keys to map[string]any.
+func asObject(val any) (map[string]any, bool) {
+	switch m := val.(type) {
+	case map[string]any:
+		return m, true
+	case map[string]string:
+		out := make(map[string]any, len(m))
+		for k, v := range m {
+			out[k] = v
+		}
+		return out, true
 	}
+	return nil, false
+}
 
-	// Strip ${{ }} wrapper if present.
-	w := strings.TrimSpace(when)
-	if strings.HasPrefix(w, "${{") && strings.HasSuffix(w, "}}") {
-		w = strings.TrimSpace(w[3 : len(w)-2])
+// objectValues returns an object's values ordered by key.
+func objectValues(m map[string]any) []any {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
 	}
+	sort.Strings(keys)
+	values := make([]any, len(keys))
+	for i, k := range keys {
+		values[i] = m[k]
+	}
+	return values
+}
 
-	// Check for comparison operators.
-	if m := conditionRegex.FindStringSubmatch(w); m != nil {
-		leftExpr := strings.TrimSpace(m[1])
-		op := m[2]
-		rightExpr := strings.TrimSpace(m[3])
-
-		left, err := sc.resolveConditionValue(leftExpr)
-		if err != nil {
-			return false, fmt.Errorf("evaluating condition left side: %w", err)
+// resolveItems evaluates a foreach expression to the list of items to
+// iterate over. Strings holding a JSON array (e.g. shell stdout) are decoded.
+func (sc *StepContext) resolveItems(expr string) ([]any, error) {
+	val, err := sc.resolveString(expr)
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case []any:
+		return v, nil
+	case []string:
+		items := make([]any, len(v))
+		for i, s := range v {
+			items[i] = s
 		}
-		right, err := sc.resolveConditionValue(rightExpr)
-		if err != nil {
-			return false, fmt.Errorf("evaluating condition right side: %w", err)
+		return items, nil
+	case []map[string]any:
+		items := make([]any, len(v))
+		for i, m := range v {
+			items[i] = m
 		}
-
-		leftStr := fmt.Sprintf("%v", left)
-		rightStr := fmt.Sprintf("%v", right)
-
-		switch op {
-		case "==":
-			return leftStr == rightStr, nil
-		case "!=":
-			return leftStr != rightStr, nil
-		case ">", ">=", "<", "<=":
-			return compareNumeric(leftStr, rightStr, op), nil
+		return items, nil
+	case string:
+		var items []any
+		if err := json.Unmarshal([]byte(v), &items); err == nil {
+			return items, nil
 		}
 	}
-
-	// No operator — evaluate as truthy.
-	val, err := sc.resolveConditionValue(w)
-	if err != nil {
-		return false, err
-	}
-	return isTruthy(val), nil
+	return nil, fmt.Errorf("foreach expression %q evaluated to %T, not an array", expr, val)
 }
 
-func (sc *StepContext) resolveConditionValue(expr string) (any, error) {
-	// Quoted string literal.
-	if (strings.HasPrefix(expr, `"`) && strings.HasSuffix(expr, `"`)) ||
-		(strings.HasPrefix(expr, `'`) && strings.HasSuffix(expr, `'`)) {
-		return expr[1 : len(expr)-1], nil
-	}
-	// Boolean literals.
-	if expr == "true" {
+// EvaluateCondition evaluates a when expression and returns true if the step
+// should run. The ${{ }} wrapper is optional; the result is tested for
+// truthiness.
+func (sc *StepContext) EvaluateCondition(when string) (bool, error) {
+	if when == "" {
 		return true, nil
 	}
-	if expr == "false" {
-		return false, nil
+	val, err := sc.evaluateExpr(conditionExpr(when))
+	if err != nil {
+		return false, err
 	}
-	// Try as path reference.
-	return sc.resolvePath(expr)
+	return isTruthy(val), nil
 }
 
-func compareNumeric(a, b, op string) bool {
-	af, aErr := parseFloat(a)
-	bf, bErr := parseFloat(b)
-	if aErr != nil || bErr != nil {
-		// Fall back to string comparison.
-		switch op {
-		case ">":
-			return a > b
-		case ">=":
-			return a >= b
-		case "<":
-			return a < b
-		case "<=":
-			return a <= b
-		}
-		return false
-	}
-	switch op {
-	case ">":
-		return af > bf
-	case ">=":
-		return af >= bf
-	case "<":
-		return af < bf
-	case "<=":
-		return af <= bf
+// conditionExpr strips the optional ${{ }} wrapper from a condition.
+func conditionExpr(when string) string {
+	w := strings.TrimSpace(when)
+	if strings.HasPrefix(w, "${{") && strings.HasSuffix(w, "}}") {
+		w = strings.TrimSpace(w[3 : len(w)-2])
 	}
-	return false
-}
-
-func parseFloat(s string) (float64, error) {
-	var f float64
-	_, err := fmt.Sscanf(s, "%f", &f)
-	return f, err
+	return w
 }
 
 func isTruthy(v any) bool {
@@ -341,6 +398,9 @@ func isTruthy(v any) bool {
 	case float64:
 		return val != 0
 	}
+	if f, ok := toFloat(v); ok {
+		return f != 0
+	}
 	return true
 }
 
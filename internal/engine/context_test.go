@@ -1,6 +1,8 @@
 package engine
 
 import (
+	"reflect"
+	"strings"
 	"testing"
 
 	"piper/internal/types"
@@ -243,3 +245,146 @@ func TestEvaluateConditionNumeric(t *testing.T) {
 		}
 	}
 }
+
+func TestResolveItems(t *testing.T) {
+	ctx := NewStepContext(map[string]any{"list": []any{"a", "b"}})
+	ctx.AddStepResult("ls", &types.StepResult{
+		Status: "success",
+		Output: map[string]any{"stdout": `["x", "y", "z"]`},
+	})
+
+	items, err := ctx.resolveItems("${{ input.list }}")
+	if err != nil || len(items) != 2 {
+		t.Errorf("resolveItems(input.list) = %v, %v; want 2 items", items, err)
+	}
+
+	items, err = ctx.resolveItems("${{ steps.ls.output.stdout }}")
+	if err != nil || len(items) != 3 {
+		t.Errorf("resolveItems(stdout) = %v, %v; want 3 items", items, err)
+	}
+
+	if _, err := ctx.resolveItems("${{ steps.ls.status }}"); err == nil {
+		t.Error("expected error for non-array foreach value")
+	}
+}
+
+func TestResolvePathIndexing(t *testing.T) {
+	ctx := NewStepContext(map[string]any{"regions": []string{"eu", "us"}})
+	ctx.AddStepResult("fetch", &types.StepResult{
+		Status: "success",
+		Output: map[string]any{
+			"headers": map[string]any{"Content-Type": "application/json"},
+			"body": map[string]any{
+				"items": []any{
+					map[string]any{"id": float64(1), "name": "a", "active": true, "tags": []any{"x"}},
+					map[string]any{"id": float64(2), "name": "b", "active": false},
+					map[string]any{"id": float64(3), "name": "c", "active": true, "tags": []any{"y", "z"}},
+				},
+			},
+		},
+	})
+	ctx = ctx.withVars(map[string]any{"item": map[string]any{"ports": []any{80, 443}}})
+
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{`${{ steps.fetch.output.body.items[0].id }}`, float64(1)},
+		{`${{ steps.fetch.output.body.items[-1].name }}`, "c"},
+		{`${{ steps.fetch.output.body.items.1.name }}`, "b"},
+		{`${{ steps.fetch.output.headers["Content-Type"] }}`, "application/json"},
+		{`${{ steps.fetch.output.body["items"][1]["name"] }}`, "b"},
+		{`${{ steps.fetch.output.body.items[*].name }}`, []any{"a", "b", "c"}},
+		{`${{ steps.fetch.output.body.items[*].tags[0] }}`, []any{"x", "y"}},
+		{`${{ steps.fetch.output.body.items[?(@.active)].id }}`, []any{float64(1), float64(3)}},
+		{`${{ steps.fetch.output.body.items[?(@.id >= 2 && @.name != "c")].name }}`, []any{"b"}},
+		{`${{ steps.fetch.output.body.items[?(@.tags)] | length }}`, 2},
+		{`${{ steps.fetch.output.headers[*] }}`, []any{"application/json"}},
+		{`${{ input.regions[1] }}`, "us"},
+		{`${{ input.regions[5] }}`, ""},
+		{`${{ item.ports[1] }}`, 443},
+		{`first=${{ steps.fetch.output.body.items[0].name }}`, "first=a"},
+	}
+
+	for _, tt := range tests {
+		result, err := ctx.resolveString(tt.input)
+		if err != nil {
+			t.Errorf("resolveString(%q) error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("resolveString(%q) = %#v, want %#v", tt.input, result, tt.expected)
+		}
+	}
+
+	for _, bad := range []string{
+		`${{ steps.fetch.output.body.items[3] }}`,
+		`${{ steps.fetch.output.headers[0] }}`,
+		`${{ steps.fetch.output.body.items[1.5] }}`,
+		`${{ steps.fetch.output.body.items[?@.active] }}`,
+	} {
+		if _, err := ctx.resolveString(bad); err == nil {
+			t.Errorf("resolveString(%q): expected error", bad)
+		}
+	}
+
+	items, err := ctx.resolveItems(`${{ steps.fetch.output.body.items[?(@.active)] }}`)
+	if err != nil || len(items) != 2 {
+		t.Errorf("resolveItems(filter) = %v, %v; want 2 items", items, err)
+	}
+}
+
+func TestResolveStrictMode(t *testing.T) {
+	ctx := NewStepContext(map[string]any{"name": "acme", "blank": ""})
+	ctx.Secrets = map[string]string{"TOKEN": "t0k"}
+	ctx.AddStepResult("skipped", &types.StepResult{Status: "skipped"})
+	ctx.Strict = true
+
+	for _, tt := range []struct {
+		input string
+		want  string
+	}{
+		{"${{ input.slack_webhook }}", `unresolved reference "input.slack_webhook": key "slack_webhook" not found`},
+		{`rm -rf "${{ env.PIPER_TEST_UNSET_DIR }}/"`, `unresolved reference "env.PIPER_TEST_UNSET_DIR": env "PIPER_TEST_UNSET_DIR" is not set`},
+		{"${{ secret.MISSING }}", `secret "MISSING" is not set`},
+		{"${{ steps.skipped.output.id }}", `unresolved reference "steps.skipped.output.id": step "skipped" has no output`},
+	} {
+		if _, err := ctx.resolveString(tt.input); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("resolveString(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		input    string
+		expected any
+	}{
+		{"${{ input.name }}", "acme"},
+		{"${{ input.blank }}", ""},
+		{"${{ secret.TOKEN }}", "t0k"},
+		{"${{ input.nickname? }}", nil},
+		{"hi ${{ input.nickname? }}!", "hi !"},
+		{`${{ input.nickname | default("anon") }}`, "anon"},
+		{`${{ steps.skipped.output.id | default(0) }}`, 0},
+		{`${{ steps.missing.output.id? | default("none") }}`, "none"},
+		{`${{ input.blank | default("x") }}`, "x"},
+		{`${{ input.name | default("x") }}`, "acme"},
+	} {
+		result, err := ctx.resolveString(tt.input)
+		if err != nil {
+			t.Errorf("resolveString(%q) error: %v", tt.input, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("resolveString(%q) = %#v, want %#v", tt.input, result, tt.expected)
+		}
+	}
+
+	// Without strict mode missing inputs stay empty strings.
+	ctx.Strict = false
+	if result, err := ctx.resolveString("${{ input.slack_webhook }}"); err != nil || result != "" {
+		t.Errorf("non-strict missing input = %#v, %v; want empty string", result, err)
+	}
+	if _, err := ctx.resolveString("${{ input.name | upper(1) | default(\"x\") }}"); err == nil {
+		t.Error("default should not swallow pipe errors")
+	}
+}
@@ -2,12 +2,17 @@ package engine
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
 	"piper/internal/plugin"
+	"piper/internal/store"
 	"piper/internal/types"
 )
 
@@ -16,6 +21,14 @@ type Engine struct {
 	Registry *plugin.Registry
 	// FlowLoader is set when flow composition is enabled (avoids import cycle).
 	FlowLoader func(name string) (*types.FlowDef, error)
+	// Store, if set, persists the result of every top-level run.
+	Store store.RunStore
+	// Strict makes unresolved references errors in every flow, as if each
+	// flow set strict: true.
+	Strict bool
+	// Secrets are used by runs started without their own: Run, and
+	// approvals decided through the webhook and MCP servers.
+	Secrets map[string]string
 }
 
 // NewEngine creates a new flow execution engine.
@@ -23,35 +36,92 @@ func NewEngine(registry *plugin.Registry) *Engine {
 	return &Engine{Registry: registry}
 }
 
-// RunWithSecrets executes a flow with the given input and secrets.
+// RunWithSecrets executes a flow with the given input and secrets. Each call
+// is a new run: it gets a run ID and, if a Store is set, is persisted.
 func (e *Engine) RunWithSecrets(ctx context.Context, flow *types.FlowDef, input map[string]any, secrets map[string]string) (*types.FlowResult, error) {
-	if err := ValidateInput(flow, input); err != nil {
+	result, err := e.execute(ctx, flow, input, secrets, store.NewRunID())
+	if err != nil {
 		return nil, err
 	}
+	return e.persist(result, secrets)
+}
 
-	result := &types.FlowResult{
-		Flow:      flow.Name,
-		Status:    "success",
-		StartedAt: time.Now().UTC(),
-		Input:     input,
-		Steps:     make([]types.StepResult, 0, len(flow.Steps)),
+// persist masks secrets in a top-level run's result, which is about to leave
+// the engine, and saves it if a Store is set. The result is saved first as
+// the run's state, with secrets replaced by references rather than masked,
+// so resumed and approved runs restore the real step outputs rather than
+// "***" without secret values being written to disk.
+func (e *Engine) persist(result *types.FlowResult, secrets map[string]string) (*types.FlowResult, error) {
+	if e.Store != nil {
+		state, err := runState(result, secrets)
+		if err == nil {
+			err = e.Store.SaveState(state)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("saving run %s: %w", result.RunID, err)
+		}
+	}
+	newRedactor(secrets).Result(result)
+	if e.Store != nil {
+		if err := e.Store.Save(result); err != nil {
+			return result, fmt.Errorf("saving run %s: %w", result.RunID, err)
+		}
 	}
+	return result, nil
+}
 
-	sctx := NewStepContext(input)
-	if secrets != nil {
-		sctx.Secrets = secrets
+// runState returns a copy of result with secrets replaced by references.
+func runState(result *types.FlowResult, secrets map[string]string) (*types.FlowResult, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	var state types.FlowResult
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
 	}
+	newReferencer(secrets).Result(&state)
+	return &state, nil
+}
 
-	return e.runWithContext(ctx, flow, result, sctx)
+// unmasked returns the stored state of run, with secret references replaced
+// by the current values of secrets, to restore step outputs from. Runs saved
+// without a state are restored from their masked result.
+func (e *Engine) unmasked(run *types.FlowResult, secrets map[string]string) (*types.FlowResult, error) {
+	if e.Store == nil {
+		return run, nil
+	}
+	state, err := e.Store.State(run.RunID)
+	if errors.Is(err, store.ErrNotFound) {
+		return run, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	newRestorer(secrets).Result(state)
+	return state, nil
 }
 
-// Run executes a flow with the given input.
+// Run executes a flow with the given input and the engine's Secrets.
 func (e *Engine) Run(ctx context.Context, flow *types.FlowDef, input map[string]any) (*types.FlowResult, error) {
+	return e.RunWithSecrets(ctx, flow, input, e.Secrets)
+}
+
+// execute runs a flow without persisting it. Child flows use it directly so
+// only top-level runs appear in the store.
+func (e *Engine) execute(ctx context.Context, flow *types.FlowDef, input map[string]any, secrets map[string]string, runID string) (*types.FlowResult, error) {
+	if input == nil {
+		input = make(map[string]any)
+	}
 	if err := ValidateInput(flow, input); err != nil {
 		return nil, err
 	}
+	if err := checkRequiredSecrets(flow, secrets); err != nil {
+		return nil, err
+	}
 
 	result := &types.FlowResult{
+		RunID:     runID,
 		Flow:      flow.Name,
 		Status:    "success",
 		StartedAt: time.Now().UTC(),
@@ -60,81 +130,543 @@ func (e *Engine) Run(ctx context.Context, flow *types.FlowDef, input map[string]
 	}
 
 	sctx := NewStepContext(input)
+	if secrets != nil {
+		sctx.Secrets = secrets
+	}
+
+	return e.runWithContext(ctx, flow, result, sctx, nil)
+}
 
-	return e.runWithContext(ctx, flow, result, sctx)
+// runWithContext runs the flow's steps and finishing blocks. Top-level steps
+// in restored already have their results in result and sctx and are skipped.
+func (e *Engine) runWithContext(ctx context.Context, flow *types.FlowDef, result *types.FlowResult, sctx *StepContext, restored map[string]bool) (*types.FlowResult, error) {
+	sctx.Strict = e.Strict || flow.Strict
+	if r := newRedactor(sctx.Secrets); r != nil {
+		ctx = plugin.WithRedactor(ctx, r.String)
+	}
+	if flow.Timeout != "" {
+		timeout, err := time.ParseDuration(flow.Timeout)
+		if err != nil {
+			return nil, fmt.Errorf("invalid flow timeout %q: %w", flow.Timeout, err)
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if usesDependencies(flow.Steps) {
+		e.runGraph(ctx, flow.Steps, result, sctx, restored)
+	} else {
+		steps := flow.Steps
+		for len(steps) > 0 && restored[steps[0].Name] {
+			steps = steps[1:]
+		}
+		e.runSequential(ctx, steps, result, sctx)
+	}
+
+	// A run waiting for approval is continued later by ResolveApproval;
+	// output mapping and cleanup happen once it finishes.
+	if result.Status == "waiting_approval" {
+		return result, nil
+	}
+
+	if flow.Timeout != "" && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		result.Status = "failed"
+		result.Error = fmt.Sprintf("flow timed out after %s", flow.Timeout)
+	}
+
+	if result.Status == "failed" {
+		result.Compensations = e.compensate(ctx, flow.Steps, result, sctx)
+	} else if err := resolveOutput(flow, result, sctx); err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+	}
+
+	if result.Failed() && len(flow.OnFailure) > 0 {
+		result.OnFailure = e.runCleanup(ctx, flow.OnFailure, result, sctx)
+	}
+	if len(flow.Finally) > 0 {
+		result.Finally = e.runCleanup(ctx, flow.Finally, result, sctx)
+	}
+
+	result.CompletedAt = time.Now().UTC()
+	return result, nil
 }
 
-func (e *Engine) runWithContext(ctx context.Context, flow *types.FlowDef, result *types.FlowResult, sctx *StepContext) (*types.FlowResult, error) {
+// compensate runs the compensate step of every succeeded step in reverse
+// completion order after the flow aborted. All compensations are attempted
+// even if one fails; the flow becomes "compensated" only if all succeed.
+func (e *Engine) compensate(ctx context.Context, steps []types.StepDef, result *types.FlowResult, sctx *StepContext) []types.StepResult {
+	defs := make(map[string]types.StepDef)
+	for _, step := range steps {
+		defs[step.Name] = step
+		for _, ps := range step.Parallel {
+			defs[ps.Name] = ps
+		}
+	}
 
-	for _, step := range flow.Steps {
-		// Handle parallel step groups.
-		if len(step.Parallel) > 0 {
-			results := e.executeParallel(ctx, step.Parallel, sctx)
-			for _, sr := range results {
-				result.Steps = append(result.Steps, sr)
-				sctx.AddStepResult(sr.Name, &sr)
-				if failed := e.handleStepError(&sr, step.OnError, result); failed {
-					result.CompletedAt = time.Now().UTC()
-					return result, nil
-				}
+	ctx = context.WithoutCancel(ctx)
+	var results []types.StepResult
+	failed := false
+	for i := len(result.Steps) - 1; i >= 0; i-- {
+		sr := result.Steps[i]
+		def, ok := defs[sr.Name]
+		if !ok || def.Compensate == nil || sr.Status != "success" {
+			continue
+		}
+		comp := *def.Compensate
+		if comp.Name == "" {
+			comp.Name = "compensate-" + def.Name
+		}
+		for _, cr := range e.runStep(ctx, comp, sctx) {
+			results = append(results, cr)
+			if isFailure(cr.Status) {
+				failed = true
 			}
+		}
+	}
+
+	if len(results) > 0 && !failed {
+		result.Status = "compensated"
+	}
+	return results
+}
+
+// runCleanup executes an on_failure or finally block and returns its step
+// results. Cleanup runs even when the flow timed out, and sees the flow
+// outcome as ${{ flow.status }} and ${{ flow.error }}. A failing cleanup
+// step fails an otherwise successful flow but keeps the original error.
+func (e *Engine) runCleanup(ctx context.Context, steps []types.StepDef, result *types.FlowResult, sctx *StepContext) []types.StepResult {
+	block := &types.FlowResult{Status: "success"}
+	cctx := sctx.withVars(map[string]any{
+		"flow": map[string]any{
+			"name":   result.Flow,
+			"status": result.Status,
+			"error":  result.Error,
+		},
+	})
+	e.runSequential(context.WithoutCancel(ctx), steps, block, cctx)
+
+	switch block.Status {
+	case "failed":
+		if !result.Failed() {
+			result.Status = "failed"
+			result.Error = block.Error
+		}
+	case "partial":
+		if result.Status == "success" {
+			result.Status = "partial"
+		}
+	}
+	return block.Steps
+}
+
+// runSequential executes steps one after another in declaration order.
+func (e *Engine) runSequential(ctx context.Context, steps []types.StepDef, result *types.FlowResult, sctx *StepContext) {
+	for _, step := range steps {
+		aborted := false
+		for _, sr := range e.runStep(ctx, step, sctx) {
+			result.Steps = append(result.Steps, sr)
+			sctx.AddStepResult(sr.Name, &sr)
+			if failed := e.handleStepError(&sr, step.OnError, result); failed {
+				aborted = true
+			}
+		}
+		if aborted {
+			return
+		}
+	}
+}
+
+// runGraph executes steps as a dependency graph: each step starts as soon as
+// all of its upstream steps have finished. After an abort no new steps are
+// started, but steps already running are allowed to finish. Restored steps
+// count as finished from the start.
+func (e *Engine) runGraph(ctx context.Context, steps []types.StepDef, result *types.FlowResult, sctx *StepContext, restored map[string]bool) {
+	g, err := buildGraph(steps)
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+		return
+	}
+
+	type finished struct {
+		step    types.StepDef
+		results []types.StepResult
+	}
+	done := make(chan finished)
+	running := 0
+	launch := func(step types.StepDef) {
+		running++
+		go func() {
+			done <- finished{step: step, results: e.runStep(ctx, step, sctx)}
+		}()
+	}
+
+	pending := make(map[string]int, len(steps))
+	for _, name := range g.order {
+		if restored[name] {
+			continue
+		}
+		for _, dep := range g.deps[name] {
+			if !restored[dep] {
+				pending[name]++
+			}
+		}
+		if pending[name] == 0 {
+			launch(g.steps[name])
+		}
+	}
+
+	aborted := false
+	for running > 0 {
+		f := <-done
+		running--
+		for _, sr := range f.results {
+			result.Steps = append(result.Steps, sr)
+			sctx.AddStepResult(sr.Name, &sr)
+			if failed := e.handleStepError(&sr, f.step.OnError, result); failed {
+				aborted = true
+			}
+		}
+		if aborted {
 			continue
 		}
+		for _, next := range g.dependents[f.step.Name] {
+			pending[next]--
+			if pending[next] == 0 {
+				launch(g.steps[next])
+			}
+		}
+	}
+}
+
+// runStep executes a single flow step — a parallel group, a conditional step
+// or a plain connector call — and returns the resulting step results.
+func (e *Engine) runStep(ctx context.Context, step types.StepDef, sctx *StepContext) []types.StepResult {
+	if len(step.Parallel) > 0 {
+		return e.executeParallel(ctx, step.Parallel, sctx)
+	}
+
+	// Evaluate conditional.
+	if step.When != "" {
+		shouldRun, err := sctx.EvaluateCondition(step.When)
+		if err != nil {
+			return []types.StepResult{{
+				Name:      step.Name,
+				Connector: step.Connector,
+				Action:    step.Action,
+				Status:    "error",
+				Error:     fmt.Sprintf("evaluating condition: %v", err),
+			}}
+		}
+		if !shouldRun {
+			return []types.StepResult{{
+				Name:      step.Name,
+				Connector: step.Connector,
+				Action:    step.Action,
+				Status:    "skipped",
+			}}
+		}
+	}
+
+	if step.Loop != nil {
+		return []types.StepResult{e.executeLoop(ctx, step, sctx)}
+	}
 
-		// Evaluate conditional.
-		if step.When != "" {
-			shouldRun, err := sctx.EvaluateCondition(step.When)
+	if step.Foreach != "" {
+		return []types.StepResult{e.executeForeach(ctx, step, sctx)}
+	}
+
+	return []types.StepResult{e.executeStepWithRetry(ctx, step, sctx)}
+}
+
+// executeLoop repeats a step, or its nested loop.steps block, until the loop's
+// until condition becomes true or its while condition becomes false. A loop
+// that reaches max_iterations without meeting its condition is "exhausted".
+func (e *Engine) executeLoop(ctx context.Context, step types.StepDef, sctx *StepContext) (sr types.StepResult) {
+	sr = types.StepResult{
+		Name:      step.Name,
+		Connector: step.Connector,
+		Action:    step.Action,
+	}
+
+	start := time.Now()
+	defer func() {
+		sr.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	loop := step.Loop
+	maxIterations := loop.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = 10
+	}
+	var interval time.Duration
+	if loop.Interval != "" {
+		d, err := time.ParseDuration(loop.Interval)
+		if err != nil {
+			sr.Status = "error"
+			sr.Error = fmt.Sprintf("invalid loop interval %q: %v", loop.Interval, err)
+			return sr
+		}
+		interval = d
+	}
+
+	for i := 0; i < maxIterations; i++ {
+		if i > 0 && interval > 0 {
+			select {
+			case <-ctx.Done():
+				sr.Status = contextStatus(ctx)
+				sr.Error = "context cancelled during loop"
+				return sr
+			case <-time.After(interval):
+			}
+		}
+
+		ictx := sctx.withVars(map[string]any{"loop": map[string]any{"index": i}})
+
+		if loop.While != "" {
+			ok, err := ictx.EvaluateCondition(loop.While)
 			if err != nil {
-				sr := types.StepResult{
-					Name:      step.Name,
-					Connector: step.Connector,
-					Action:    step.Action,
-					Status:    "error",
-					Error:     fmt.Sprintf("evaluating condition: %v", err),
-				}
-				result.Steps = append(result.Steps, sr)
-				sctx.AddStepResult(step.Name, &sr)
-				if failed := e.handleStepError(&sr, step.OnError, result); failed {
-					result.CompletedAt = time.Now().UTC()
-					return result, nil
-				}
-				continue
+				sr.Status = "error"
+				sr.Error = fmt.Sprintf("evaluating loop while: %v", err)
+				return sr
 			}
-			if !shouldRun {
-				sr := types.StepResult{
-					Name:      step.Name,
-					Connector: step.Connector,
-					Action:    step.Action,
-					Status:    "skipped",
-				}
-				result.Steps = append(result.Steps, sr)
-				sctx.AddStepResult(step.Name, &sr)
-				continue
+			if !ok {
+				sr.Status = "success"
+				return sr
+			}
+		}
+
+		it := types.IterationResult{Index: i}
+		if len(loop.Steps) > 0 {
+			block := &types.FlowResult{Status: "success"}
+			iterStart := time.Now()
+			e.runSequential(ctx, loop.Steps, block, ictx)
+			it.Status = block.Status
+			if it.Status == "partial" {
+				it.Status = "success"
 			}
+			it.Error = block.Error
+			it.Steps = block.Steps
+			it.DurationMs = time.Since(iterStart).Milliseconds()
+			sr.Output = map[string]any{"iterations": i + 1}
+		} else {
+			r := e.executeStepWithRetry(ctx, step, ictx)
+			it.Status = r.Status
+			it.Output = r.Output
+			it.Error = r.Error
+			it.DurationMs = r.DurationMs
+			sr.Output = r.Output
+			// Expose this iteration to the until condition.
+			sctx.AddStepResult(step.Name, &r)
 		}
+		sr.Iterations = append(sr.Iterations, it)
 
-		sr := e.executeStepWithRetry(ctx, step, sctx)
-		result.Steps = append(result.Steps, sr)
-		sctx.AddStepResult(step.Name, &sr)
+		if ctx.Err() != nil {
+			sr.Status = contextStatus(ctx)
+			sr.Error = "context cancelled during loop"
+			return sr
+		}
 
-		if failed := e.handleStepError(&sr, step.OnError, result); failed {
-			result.CompletedAt = time.Now().UTC()
-			return result, nil
+		if loop.Until != "" {
+			done, err := ictx.EvaluateCondition(loop.Until)
+			if err != nil {
+				sr.Status = "error"
+				sr.Error = fmt.Sprintf("evaluating loop until: %v", err)
+				return sr
+			}
+			if done {
+				sr.Status = "success"
+				return sr
+			}
 		}
 	}
 
-	result.CompletedAt = time.Now().UTC()
-	return result, nil
+	sr.Status = "exhausted"
+	sr.Error = fmt.Sprintf("loop condition not met after %d iterations", maxIterations)
+	return sr
+}
+
+// executeForeach runs a step once per item of its foreach expression, at most
+// step.Concurrency items at a time (sequentially by default). The step output
+// holds the per-item outputs under "results".
+func (e *Engine) executeForeach(ctx context.Context, step types.StepDef, sctx *StepContext) (sr types.StepResult) {
+	sr = types.StepResult{
+		Name:      step.Name,
+		Connector: step.Connector,
+		Action:    step.Action,
+	}
+
+	start := time.Now()
+	defer func() {
+		sr.DurationMs = time.Since(start).Milliseconds()
+	}()
+
+	items, err := sctx.resolveItems(step.Foreach)
+	if err != nil {
+		sr.Status = "error"
+		sr.Error = fmt.Sprintf("evaluating foreach: %v", err)
+		return sr
+	}
+
+	as := step.As
+	if as == "" {
+		as = "item"
+	}
+	limit := step.Concurrency
+	if limit <= 0 {
+		limit = 1
+	}
+
+	iterations := make([]types.IterationResult, len(items))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	started := 0
+	for i, item := range items {
+		// Once the step or flow is cancelled, the remaining items are
+		// not started.
+		if !acquire(ctx, sem) {
+			iterations[i] = types.IterationResult{Index: i, Item: item, Status: "skipped"}
+			continue
+		}
+		started++
+		wg.Add(1)
+		go func(idx int, item any) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			ictx := sctx.withVars(map[string]any{
+				as:     item,
+				"loop": map[string]any{"index": idx},
+			})
+			r := e.executeStepWithRetry(ctx, step, ictx)
+			iterations[idx] = types.IterationResult{
+				Index:      idx,
+				Item:       item,
+				Status:     r.Status,
+				Output:     r.Output,
+				Error:      r.Error,
+				DurationMs: r.DurationMs,
+			}
+		}(i, item)
+	}
+	wg.Wait()
+
+	results := make([]any, len(iterations))
+	failed := 0
+	for i, it := range iterations {
+		if it.Output != nil {
+			results[i] = it.Output
+		}
+		if isFailure(it.Status) {
+			failed++
+		}
+	}
+
+	sr.Iterations = iterations
+	sr.Output = map[string]any{
+		"results": results,
+		"count":   len(items),
+	}
+	sr.Status = "success"
+	switch {
+	case started < len(items):
+		sr.Status = contextStatus(ctx)
+		sr.Error = fmt.Sprintf("foreach stopped after starting %d of %d iterations: %v", started, len(items), ctx.Err())
+	case failed > 0:
+		sr.Status = "failed"
+		sr.Error = fmt.Sprintf("%d of %d iterations failed", failed, len(items))
+	}
+	return sr
+}
+
+// acquire takes a slot of sem, unless ctx is done first.
+func acquire(ctx context.Context, sem chan struct{}) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	select {
+	case sem <- struct{}{}:
+		if ctx.Err() != nil {
+			<-sem
+			return false
+		}
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// resolveOutput evaluates the value expressions of the flow's output schema
+// into result.Output, converting and checking them against the declared types.
+// A value that cannot be converted or does not match its type is left out and
+// reported in result.OutputErrors without failing the run, since the step it
+// comes from may have failed with on_error: continue. Only a reference that
+// does not resolve in strict mode is an error.
+func resolveOutput(flow *types.FlowDef, result *types.FlowResult, sctx *StepContext) error {
+	if flow.Output == nil {
+		return nil
+	}
+
+	output := make(map[string]any)
+	var problems []string
+	for name, field := range flow.Output.Properties {
+		if field.Value == "" {
+			continue
+		}
+		val, err := sctx.resolveString(field.Value)
+		if err != nil {
+			return fmt.Errorf("resolving output %q: %w", name, err)
+		}
+		val, err = coerceScalar(val, field.Type)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("output %q: %v", name, err))
+			continue
+		}
+		if !matchesType(val, field.Type) {
+			problems = append(problems, fmt.Sprintf("output %q: expected %s, got %T", name, field.Type, val))
+			continue
+		}
+		ve := &ValidationError{}
+		validateValue("output", name, val, field, ve)
+		if ve.HasErrors() {
+			problems = append(problems, ve.Errors...)
+			continue
+		}
+		output[name] = val
+	}
+
+	if len(output) > 0 {
+		result.Output = output
+	}
+	sort.Strings(problems)
+	result.OutputErrors = problems
+	return nil
 }
 
 // DryRun validates and resolves variables without actually executing steps.
 func (e *Engine) DryRun(flow *types.FlowDef, input map[string]any) (*types.FlowResult, error) {
+	return e.DryRunWithSecrets(flow, input, nil)
+}
+
+// DryRunWithSecrets is DryRun with the secrets a run would get. References
+// to them resolve to "***", so a dry run shows which secrets are used, and
+// in strict mode fails on missing ones, without revealing their values.
+func (e *Engine) DryRunWithSecrets(flow *types.FlowDef, input map[string]any, secrets map[string]string) (*types.FlowResult, error) {
 	if err := ValidateFlow(flow, e.Registry); err != nil {
 		return nil, err
 	}
+	if input == nil {
+		input = make(map[string]any)
+	}
 	if err := ValidateInput(flow, input); err != nil {
 		return nil, err
 	}
+	if err := checkRequiredSecrets(flow, secrets); err != nil {
+		return nil, err
+	}
 
 	result := &types.FlowResult{
 		Flow:      flow.Name,
@@ -145,16 +677,47 @@ func (e *Engine) DryRun(flow *types.FlowDef, input map[string]any) (*types.FlowR
 	}
 
 	sctx := NewStepContext(input)
+	sctx.Strict = e.Strict || flow.Strict
+	for name := range secrets {
+		sctx.Secrets[name] = redactedValue
+	}
 
-	for _, step := range flow.Steps {
+	ordered := flow.Steps
+	if usesDependencies(flow.Steps) {
+		g, err := buildGraph(flow.Steps)
+		if err != nil {
+			return nil, err
+		}
+		ordered = g.topoOrder()
+	}
+
+	for _, step := range ordered {
 		// Flatten parallel groups for dry-run.
 		steps := []types.StepDef{step}
 		if len(step.Parallel) > 0 {
 			steps = step.Parallel
+		} else if step.Loop != nil && len(step.Loop.Steps) > 0 {
+			steps = step.Loop.Steps
 		}
 
 		for _, s := range steps {
-			resolvedInput, err := sctx.ResolveMap(s.Input)
+			rctx := sctx
+			if step.Loop != nil {
+				rctx = sctx.withVars(map[string]any{"loop": map[string]any{"index": 0}})
+			}
+			if s.Foreach != "" {
+				// Resolve against the first item so item references can be checked.
+				var first any
+				if items, err := sctx.resolveItems(s.Foreach); err == nil && len(items) > 0 {
+					first = items[0]
+				}
+				as := s.As
+				if as == "" {
+					as = "item"
+				}
+				rctx = sctx.withVars(map[string]any{as: first, "loop": map[string]any{"index": 0}})
+			}
+			resolvedInput, err := rctx.ResolveMap(s.Input)
 
 			sr := types.StepResult{
 				Name:      s.Name,
@@ -163,14 +726,27 @@ func (e *Engine) DryRun(flow *types.FlowDef, input map[string]any) (*types.FlowR
 				Status:    "dry_run",
 			}
 
+			if s.When != "" || s.Foreach != "" {
+				sr.Output = map[string]any{}
+			}
 			if s.When != "" {
-				sr.Output = map[string]any{"_when": s.When}
+				sr.Output["_when"] = s.When
+			}
+			if s.Foreach != "" {
+				sr.Output["_foreach"] = s.Foreach
 			}
 
+			action, known := lookupAction(e.Registry, s.Connector, s.Action)
 			if err != nil {
 				sr.Status = "resolve_error"
 				sr.Error = err.Error()
 			} else {
+				if known {
+					if err := checkDryRunInput(action, s.Input, resolvedInput); err != nil {
+						sr.Status = "invalid_input"
+						sr.Error = fmt.Sprintf("invalid input: %v", err)
+					}
+				}
 				if sr.Output == nil {
 					sr.Output = resolvedInput
 				} else {
@@ -192,10 +768,51 @@ func (e *Engine) DryRun(flow *types.FlowDef, input map[string]any) (*types.FlowR
 	return result, nil
 }
 
+// checkDryRunInput checks the input of a dry-run step like checkActionInput,
+// except for expressions that resolved to nothing: they stand for the step
+// outputs and foreach items a dry run does not have, so neither their type
+// nor whether they are set is known.
+func checkDryRunInput(action plugin.ActionDef, raw, resolved map[string]any) error {
+	fields := maps.Clone(action.Input)
+	input := maps.Clone(resolved)
+	for name, v := range resolved {
+		if (v == nil || v == "") && hasExpression(raw[name]) {
+			delete(fields, name)
+			delete(input, name)
+		}
+	}
+	return checkActionInput(plugin.ActionDef{Input: fields}, input)
+}
+
+// contextStatus returns the step status for work cut short by ctx.
+func contextStatus(ctx context.Context) string {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "timed_out"
+	}
+	return "error"
+}
+
+// isFailure reports whether a step status counts as a failure for on_error handling.
+func isFailure(status string) bool {
+	switch status {
+	case "failed", "error", "exhausted", "timed_out", "compensated", "rejected", "invalid_input":
+		return true
+	}
+	return false
+}
+
 // handleStepError processes a step failure based on its on_error policy.
-// Returns true if the flow should abort.
+// Returns true if the flow should stop, which is also the case when the
+// step is waiting for approval.
 func (e *Engine) handleStepError(sr *types.StepResult, onError string, result *types.FlowResult) bool {
-	if sr.Status != "failed" && sr.Status != "error" {
+	if sr.Status == "waiting_approval" {
+		if result.Status != "failed" {
+			result.Status = "waiting_approval"
+		}
+		return true
+	}
+
+	if !isFailure(sr.Status) {
 		return false
 	}
 
@@ -218,9 +835,29 @@ func (e *Engine) handleStepError(sr *types.StepResult, onError string, result *t
 
 // executeStepWithRetry executes a step, retrying on failure if configured.
 func (e *Engine) executeStepWithRetry(ctx context.Context, step types.StepDef, sctx *StepContext) types.StepResult {
+	retrying := step.Retry != nil && step.OnError == "retry"
+
+	// retry.timeout bounds all attempts and backoff together; step.timeout
+	// applies to each attempt.
+	if retrying && step.Retry.Timeout != "" {
+		budget, err := time.ParseDuration(step.Retry.Timeout)
+		if err != nil {
+			return types.StepResult{
+				Name:      step.Name,
+				Connector: step.Connector,
+				Action:    step.Action,
+				Status:    "error",
+				Error:     fmt.Sprintf("invalid retry timeout %q: %v", step.Retry.Timeout, err),
+			}
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, budget)
+		defer cancel()
+	}
+
 	sr := e.executeStep(ctx, step, sctx)
 
-	if step.Retry == nil || step.OnError != "retry" {
+	if !retrying {
 		return sr
 	}
 
@@ -234,7 +871,7 @@ func (e *Engine) executeStepWithRetry(ctx context.Context, step types.StepDef, s
 	}
 
 	for attempt := 1; attempt <= maxRetries; attempt++ {
-		if sr.Status != "failed" && sr.Status != "error" {
+		if !isFailure(sr.Status) {
 			break
 		}
 
@@ -242,8 +879,13 @@ func (e *Engine) executeStepWithRetry(ctx context.Context, step types.StepDef, s
 		sleepDuration := time.Duration(backoff*math.Pow(2, float64(attempt-1))) * time.Second
 		select {
 		case <-ctx.Done():
-			sr.Status = "error"
-			sr.Error = "context cancelled during retry"
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				sr.Status = "timed_out"
+				sr.Error = "deadline exceeded during retry"
+			} else {
+				sr.Status = "error"
+				sr.Error = "context cancelled during retry"
+			}
 			sr.Retries = attempt
 			return sr
 		case <-time.After(sleepDuration):
@@ -251,6 +893,10 @@ func (e *Engine) executeStepWithRetry(ctx context.Context, step types.StepDef, s
 
 		sr = e.executeStep(ctx, step, sctx)
 		sr.Retries = attempt
+		if ctx.Err() != nil {
+			// The overall budget is spent; further attempts cannot run.
+			break
+		}
 	}
 
 	return sr
@@ -258,48 +904,33 @@ func (e *Engine) executeStepWithRetry(ctx context.Context, step types.StepDef, s
 
 // executeParallel runs multiple steps concurrently and collects results.
 func (e *Engine) executeParallel(ctx context.Context, steps []types.StepDef, sctx *StepContext) []types.StepResult {
-	results := make([]types.StepResult, len(steps))
+	grouped := make([][]types.StepResult, len(steps))
 	var wg sync.WaitGroup
 
 	for i, step := range steps {
 		wg.Add(1)
 		go func(idx int, s types.StepDef) {
 			defer wg.Done()
-
-			// Evaluate conditional.
-			if s.When != "" {
-				shouldRun, err := sctx.EvaluateCondition(s.When)
-				if err != nil {
-					results[idx] = types.StepResult{
-						Name:      s.Name,
-						Connector: s.Connector,
-						Action:    s.Action,
-						Status:    "error",
-						Error:     fmt.Sprintf("evaluating condition: %v", err),
-					}
-					return
-				}
-				if !shouldRun {
-					results[idx] = types.StepResult{
-						Name:      s.Name,
-						Connector: s.Connector,
-						Action:    s.Action,
-						Status:    "skipped",
-					}
-					return
-				}
-			}
-
-			results[idx] = e.executeStepWithRetry(ctx, s, sctx)
+			grouped[idx] = e.runStep(ctx, s, sctx)
 		}(i, step)
 	}
 
 	wg.Wait()
+
+	results := make([]types.StepResult, 0, len(steps))
+	for _, rs := range grouped {
+		results = append(results, rs...)
+	}
 	return results
 }
 
-func (e *Engine) executeStep(ctx context.Context, step types.StepDef, sctx *StepContext) types.StepResult {
-	sr := types.StepResult{
+func (e *Engine) executeStep(ctx context.Context, step types.StepDef, sctx *StepContext) (sr types.StepResult) {
+	// Approval steps are handled by the engine and report their own duration.
+	if step.Connector == "approval" {
+		return e.executeApproval(step, sctx)
+	}
+
+	sr = types.StepResult{
 		Name:      step.Name,
 		Connector: step.Connector,
 		Action:    step.Action,
@@ -310,9 +941,26 @@ func (e *Engine) executeStep(ctx context.Context, step types.StepDef, sctx *Step
 		sr.DurationMs = time.Since(start).Milliseconds()
 	}()
 
-	// Handle flow composition — connector "flow" calls another flow.
+	if step.Timeout != "" {
+		timeout, err := time.ParseDuration(step.Timeout)
+		if err != nil {
+			sr.Status = "error"
+			sr.Error = fmt.Sprintf("invalid timeout %q: %v", step.Timeout, err)
+			return sr
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// Handle flow composition — connector "flow" calls another flow. A child
+	// run that failed because the deadline passed was cut short by it.
 	if step.Connector == "flow" {
-		return e.executeFlowStep(ctx, step, sctx)
+		sr = e.executeFlowStep(ctx, step, sctx)
+		if isFailure(sr.Status) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			markTimedOut(&sr, step)
+		}
+		return sr
 	}
 
 	conn, ok := e.Registry.Get(step.Connector)
@@ -329,7 +977,19 @@ func (e *Engine) executeStep(ctx context.Context, step types.StepDef, sctx *Step
 		return sr
 	}
 
+	if action, ok := lookupAction(e.Registry, step.Connector, step.Action); ok {
+		if err := checkActionInput(action, resolvedInput); err != nil {
+			sr.Status = "invalid_input"
+			sr.Error = fmt.Sprintf("invalid input: %v", err)
+			return sr
+		}
+	}
+
 	stepResult, err := conn.Execute(ctx, step.Action, resolvedInput)
+	if errors.Is(err, context.DeadlineExceeded) {
+		markTimedOut(&sr, step)
+		return sr
+	}
 	if err != nil {
 		sr.Status = "error"
 		sr.Error = err.Error()
@@ -342,9 +1002,20 @@ func (e *Engine) executeStep(ctx context.Context, step types.StepDef, sctx *Step
 	return sr
 }
 
+// markTimedOut reports a step cut short by a step or flow deadline as timed
+// out. A step that completed, even after its deadline, keeps its result.
+func markTimedOut(sr *types.StepResult, step types.StepDef) {
+	sr.Status = "timed_out"
+	if step.Timeout != "" {
+		sr.Error = fmt.Sprintf("step timed out after %s", step.Timeout)
+	} else {
+		sr.Error = "deadline exceeded"
+	}
+}
+
 // executeFlowStep runs another flow as a step (flow composition).
-func (e *Engine) executeFlowStep(ctx context.Context, step types.StepDef, sctx *StepContext) types.StepResult {
-	sr := types.StepResult{
+func (e *Engine) executeFlowStep(ctx context.Context, step types.StepDef, sctx *StepContext) (sr types.StepResult) {
+	sr = types.StepResult{
 		Name:      step.Name,
 		Connector: "flow",
 		Action:    "run",
@@ -390,29 +1061,51 @@ func (e *Engine) executeFlowStep(ctx context.Context, step types.StepDef, sctx *
 	// Remove the "flow" key from input — it's not an input field.
 	delete(childInput, "flow")
 
-	childResult, err := e.Run(ctx, childFlow, childInput)
+	childResult, err := e.execute(ctx, childFlow, childInput, childSecrets(step, sctx.Secrets), "")
 	if err != nil {
 		sr.Status = "error"
 		sr.Error = fmt.Sprintf("running flow %q: %v", flowName, err)
 		return sr
 	}
 
+	if childResult.Status == "waiting_approval" {
+		sr.Status = "error"
+		sr.Error = fmt.Sprintf("flow %q: approval steps are not supported in child flows", flowName)
+		return sr
+	}
+
 	sr.Status = childResult.Status
-	sr.Output = map[string]any{
-		"flow_status": childResult.Status,
-		"steps":       len(childResult.Steps),
-	}
-	// Merge child flow step outputs into parent output.
-	for _, childStep := range childResult.Steps {
-		if childStep.Output != nil {
-			for k, v := range childStep.Output {
-				sr.Output[k] = v
-			}
+	sr.Error = childResult.Error
+	sr.Output = childOutput(childResult)
+	sr.Child = childResult
+
+	return sr
+}
+
+// childOutput is the output of a flow step: the child flow's status and
+// error, its mapped output as result, and the status, output and error of
+// each of its steps under steps.<name>.
+func childOutput(child *types.FlowResult) map[string]any {
+	steps := make(map[string]any, len(child.Steps))
+	for _, cs := range child.Steps {
+		output := cs.Output
+		if output == nil {
+			output = make(map[string]any)
+		}
+		steps[cs.Name] = map[string]any{
+			"status": cs.Status,
+			"output": output,
+			"error":  cs.Error,
 		}
 	}
-	if childResult.Error != "" {
-		sr.Error = childResult.Error
+	result := child.Output
+	if result == nil {
+		result = make(map[string]any)
+	}
+	return map[string]any{
+		"status": child.Status,
+		"error":  child.Error,
+		"result": result,
+		"steps":  steps,
 	}
-
-	return sr
 }
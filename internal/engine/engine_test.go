@@ -3,10 +3,14 @@ package engine
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"piper/internal/plugin"
 	"piper/internal/plugin/builtin"
+	"piper/internal/store"
 	"piper/internal/types"
 )
 
@@ -377,13 +381,22 @@ func TestEngineFlowComposition(t *testing.T) {
 
 	childFlow := &types.FlowDef{
 		Name: "child",
+		Output: &types.SchemaDef{Properties: map[string]types.FieldDef{
+			"greeting": {Type: "string", Value: "${{ steps.greet.output.message }}"},
+		}},
 		Steps: []types.StepDef{
 			{
-				Name:      "child-step",
+				Name:      "greet",
 				Connector: "log",
 				Action:    "print",
 				Input:     map[string]any{"message": "hello from child: ${{ input.name }}"},
 			},
+			{
+				Name:      "bye",
+				Connector: "log",
+				Action:    "print",
+				Input:     map[string]any{"message": "bye"},
+			},
 		},
 	}
 
@@ -403,8 +416,17 @@ func TestEngineFlowComposition(t *testing.T) {
 				Flow:      "child",
 				Input:     map[string]any{"name": "${{ input.name }}"},
 			},
+			{
+				Name:      "report",
+				Connector: "log",
+				Action:    "print",
+				Input:     map[string]any{"message": "${{ steps.call-child.output.steps.bye.output.message }} / ${{ steps.call-child.output.result.greeting }}"},
+			},
 		},
 	}
+	if err := ValidateFlow(parentFlow, registry); err != nil {
+		t.Fatalf("ValidateFlow: %v", err)
+	}
 
 	result, err := eng.Run(context.Background(), parentFlow, map[string]any{"name": "World"})
 	if err != nil {
@@ -413,11 +435,57 @@ func TestEngineFlowComposition(t *testing.T) {
 	if result.Status != "success" {
 		t.Errorf("status = %q, want success", result.Status)
 	}
-	if result.Steps[0].Connector != "flow" {
-		t.Errorf("connector = %q, want flow", result.Steps[0].Connector)
+	sr := result.Steps[0]
+	if sr.Connector != "flow" {
+		t.Errorf("connector = %q, want flow", sr.Connector)
+	}
+	if sr.Output["status"] != "success" || sr.Output["error"] != "" {
+		t.Errorf("status = %v, error = %v", sr.Output["status"], sr.Output["error"])
+	}
+	steps, _ := sr.Output["steps"].(map[string]any)
+	greet, _ := steps["greet"].(map[string]any)
+	if out, _ := greet["output"].(map[string]any); out["message"] != "hello from child: World" || greet["status"] != "success" {
+		t.Errorf("steps.greet = %v", greet)
+	}
+	if bye, _ := steps["bye"].(map[string]any); bye["output"].(map[string]any)["message"] != "bye" {
+		t.Errorf("steps.bye = %v", bye)
+	}
+	if got := result.Steps[1].Output["message"]; got != "bye / hello from child: World" {
+		t.Errorf("report = %v", got)
+	}
+	if sr.Child == nil || sr.Child.Flow != "child" || len(sr.Child.Steps) != 2 || sr.Child.Output["greeting"] != "hello from child: World" {
+		t.Errorf("child result = %+v", sr.Child)
+	}
+}
+
+func TestEngineFlowCompositionFailure(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
+		return &types.FlowDef{Name: name, Steps: []types.StepDef{
+			{Name: "bad", Connector: "nonexistent", Action: "do"},
+		}}, nil
+	}
+	parent := &types.FlowDef{
+		Name: "parent",
+		Steps: []types.StepDef{
+			{Name: "call", Connector: "flow", Flow: "child", OnError: "continue"},
+			{Name: "report", Connector: "log", Action: "print", Input: map[string]any{"message": "${{ steps.call.output.status }}: ${{ steps.call.output.steps.bad.status }}"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), parent, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sr := result.Steps[0]
+	if sr.Status != "failed" || sr.Error == "" || sr.Output["error"] != sr.Error {
+		t.Errorf("status = %q, error = %q, output.error = %v", sr.Status, sr.Error, sr.Output["error"])
 	}
-	if result.Steps[0].Output["flow_status"] != "success" {
-		t.Errorf("flow_status = %v, want success", result.Steps[0].Output["flow_status"])
+	if got := result.Steps[1].Output["message"]; got != "failed: error" {
+		t.Errorf("report = %v", got)
 	}
 }
 
@@ -448,3 +516,932 @@ func TestEngineSecretsIntegration(t *testing.T) {
 		t.Errorf("status = %q, want success", result.Status)
 	}
 }
+
+func TestEngineChildFlowSecrets(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
+		// Strict, so that a secret the child cannot see fails the step.
+		return &types.FlowDef{
+			Name:   name,
+			Strict: true,
+			Steps: []types.StepDef{
+				{Name: "use", Connector: "log", Action: "print", Input: map[string]any{"message": "${{ secret." + name + " }}"}},
+			},
+		}, nil
+	}
+
+	tests := []struct {
+		name    string
+		child   string
+		secrets types.SecretMapping
+		want    string
+	}{
+		{"propagated by default", "API_KEY", nil, "success"},
+		{"allowlisted", "API_KEY", types.SecretMapping{"API_KEY": "API_KEY"}, "success"},
+		{"renamed", "DEPLOY_TOKEN", types.SecretMapping{"DEPLOY_TOKEN": "API_KEY"}, "success"},
+		{"not allowlisted", "API_KEY", types.SecretMapping{"DEPLOY_TOKEN": "API_KEY"}, "failed"},
+		{"none", "API_KEY", types.SecretMapping{}, "failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent := &types.FlowDef{
+				Name: "parent",
+				Steps: []types.StepDef{
+					{Name: "call", Connector: "flow", Flow: tt.child, Secrets: tt.secrets},
+				},
+			}
+			result, err := eng.RunWithSecrets(context.Background(), parent, nil, map[string]string{"API_KEY": "sk-test-123"})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if result.Status != tt.want {
+				t.Errorf("status = %q, want %q (error: %s)", result.Status, tt.want, result.Error)
+			}
+		})
+	}
+}
+
+func TestEngineRequiresSecrets(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+	child := &types.FlowDef{
+		Name:            "child",
+		RequiresSecrets: []string{"API_KEY"},
+		Steps:           []types.StepDef{{Name: "noop", Connector: "log", Action: "print", Input: map[string]any{"message": "hi"}}},
+	}
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) { return child, nil }
+
+	_, err := eng.RunWithSecrets(context.Background(), child, nil, map[string]string{"OTHER": "x"})
+	if err == nil || !strings.Contains(err.Error(), "API_KEY") {
+		t.Errorf("expected a missing secret error, got %v", err)
+	}
+	if _, err := eng.DryRunWithSecrets(child, nil, nil); err == nil {
+		t.Error("expected the dry run to check required secrets")
+	}
+
+	parent := &types.FlowDef{
+		Name: "parent",
+		Steps: []types.StepDef{
+			{Name: "call", Connector: "flow", Flow: "child", Secrets: types.SecretMapping{"API_KEY": "TOKEN"}},
+		},
+	}
+	result, err := eng.RunWithSecrets(context.Background(), parent, nil, map[string]string{"API_KEY": "sk-test-123"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "failed" || !strings.Contains(result.Steps[0].Error, `requires secrets that are not set: API_KEY`) {
+		t.Errorf("status = %q, step error = %q", result.Status, result.Steps[0].Error)
+	}
+
+	result, err = eng.RunWithSecrets(context.Background(), parent, nil, map[string]string{"TOKEN": "sk-test-123"})
+	if err != nil || result.Status != "success" {
+		t.Errorf("mapped secret: status = %v, err = %v", result, err)
+	}
+}
+
+func TestEngineDependsOn(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name:      "summary",
+				Connector: "log",
+				Action:    "print",
+				Input:     map[string]any{"message": "a=${{ steps.a.output.stdout }}"},
+				DependsOn: []string{"b"},
+			},
+			{
+				Name:      "a",
+				Connector: "shell",
+				Action:    "run",
+				Input:     map[string]any{"command": "sleep 0.2 && echo a"},
+			},
+			{
+				Name:      "b",
+				Connector: "shell",
+				Action:    "run",
+				Input:     map[string]any{"command": "sleep 0.2 && echo b"},
+			},
+		},
+	}
+
+	start := time.Now()
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "success" {
+		t.Fatalf("status = %q, want success (error: %s)", result.Status, result.Error)
+	}
+	if len(result.Steps) != 3 {
+		t.Fatalf("expected 3 steps, got %d", len(result.Steps))
+	}
+	// a and b have no upstream steps and run concurrently.
+	if elapsed := time.Since(start); elapsed > 350*time.Millisecond {
+		t.Errorf("independent steps did not run concurrently (took %v)", elapsed)
+	}
+	last := result.Steps[2]
+	if last.Name != "summary" {
+		t.Fatalf("last step = %q, want summary", last.Name)
+	}
+	if last.Output["message"] != "a=a" {
+		t.Errorf("message = %v, want a=a", last.Output["message"])
+	}
+}
+
+func TestEngineDependsOnAbort(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "fail", Connector: "shell", Action: "run", Input: map[string]any{"command": "exit 1"}},
+			{Name: "after", Connector: "log", Action: "print", Input: map[string]any{"message": "x"}, DependsOn: []string{"fail"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "failed" {
+		t.Errorf("status = %q, want failed", result.Status)
+	}
+	if len(result.Steps) != 1 {
+		t.Errorf("expected downstream step not to run, got %d steps", len(result.Steps))
+	}
+}
+
+func TestEngineForeach(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name:        "greet",
+				Connector:   "shell",
+				Action:      "run",
+				Input:       map[string]any{"command": "echo hello ${{ target.name }} ${{ loop.index }}"},
+				Foreach:     "${{ input.targets }}",
+				As:          "target",
+				Concurrency: 2,
+			},
+			{
+				Name:      "summary",
+				Connector: "log",
+				Action:    "print",
+				Input:     map[string]any{"message": "${{ steps.greet.output.count | json }}"},
+			},
+		},
+	}
+
+	input := map[string]any{"targets": []any{
+		map[string]any{"name": "a"},
+		map[string]any{"name": "b"},
+		map[string]any{"name": "c"},
+	}}
+	result, err := eng.Run(context.Background(), flow, input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "success" {
+		t.Fatalf("status = %q, want success (error: %s)", result.Status, result.Error)
+	}
+
+	sr := result.Steps[0]
+	if len(sr.Iterations) != 3 {
+		t.Fatalf("expected 3 iterations, got %d", len(sr.Iterations))
+	}
+	results, ok := sr.Output["results"].([]any)
+	if !ok || len(results) != 3 {
+		t.Fatalf("results = %v, want 3 per-item outputs", sr.Output["results"])
+	}
+	for i, want := range []string{"hello a 0", "hello b 1", "hello c 2"} {
+		out := results[i].(map[string]any)
+		if out["stdout"] != want {
+			t.Errorf("results[%d].stdout = %v, want %q", i, out["stdout"], want)
+		}
+	}
+	if result.Steps[1].Output["message"] != "3" {
+		t.Errorf("count message = %v, want 3", result.Steps[1].Output["message"])
+	}
+}
+
+func TestEngineForeachFailure(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name:      "check",
+				Connector: "shell",
+				Action:    "run",
+				Input:     map[string]any{"command": "exit ${{ item }}"},
+				Foreach:   "${{ input.codes }}",
+				OnError:   "continue",
+			},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{"codes": []any{0, 1, 0}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "partial" {
+		t.Errorf("status = %q, want partial", result.Status)
+	}
+	sr := result.Steps[0]
+	if sr.Status != "failed" {
+		t.Errorf("step status = %q, want failed", sr.Status)
+	}
+	if sr.Iterations[1].Status != "failed" || sr.Iterations[0].Status != "success" {
+		t.Errorf("unexpected iteration statuses: %+v", sr.Iterations)
+	}
+}
+
+func TestEngineLoopUntil(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	counter := filepath.Join(t.TempDir(), "count")
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name:      "poll",
+				Connector: "shell",
+				Action:    "run",
+				Input: map[string]any{
+					"command": fmt.Sprintf("n=$(cat %s 2>/dev/null || echo 0); n=$((n+1)); echo $n > %s; echo $n", counter, counter),
+				},
+				Loop: &types.LoopConfig{
+					Until:         `${{ steps.poll.output.stdout == "3" }}`,
+					MaxIterations: 5,
+					Interval:      "10ms",
+				},
+			},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "success" {
+		t.Fatalf("status = %q, want success (error: %s)", result.Status, result.Error)
+	}
+	sr := result.Steps[0]
+	if len(sr.Iterations) != 3 {
+		t.Errorf("iterations = %d, want 3", len(sr.Iterations))
+	}
+	if sr.Output["stdout"] != "3" {
+		t.Errorf("stdout = %v, want 3", sr.Output["stdout"])
+	}
+}
+
+func TestEngineLoopExhausted(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name: "wait",
+				Loop: &types.LoopConfig{
+					Until:         `${{ steps.check.output.message == "ready" }}`,
+					MaxIterations: 2,
+					Steps: []types.StepDef{
+						{Name: "check", Connector: "log", Action: "print", Input: map[string]any{"message": "pending ${{ loop.index }}"}},
+					},
+				},
+			},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "failed" {
+		t.Errorf("status = %q, want failed", result.Status)
+	}
+	sr := result.Steps[0]
+	if sr.Status != "exhausted" {
+		t.Errorf("step status = %q, want exhausted", sr.Status)
+	}
+	if len(sr.Iterations) != 2 || len(sr.Iterations[1].Steps) != 1 {
+		t.Fatalf("unexpected iterations: %+v", sr.Iterations)
+	}
+	if msg := sr.Iterations[1].Steps[0].Output["message"]; msg != "pending 1" {
+		t.Errorf("second iteration message = %v, want pending 1", msg)
+	}
+}
+
+func TestEngineOutputMapping(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Output: &types.SchemaDef{
+			Properties: map[string]types.FieldDef{
+				"count":    {Type: "integer", Value: "${{ steps.count.output.stdout }}"},
+				"greeting": {Type: "string", Value: "Hello ${{ input.name }}"},
+				"declared": {Type: "string"},
+			},
+		},
+		Steps: []types.StepDef{
+			{Name: "count", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo 42"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{"name": "World"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "success" {
+		t.Fatalf("status = %q, want success (error: %s)", result.Status, result.Error)
+	}
+	if result.Output["count"] != 42 {
+		t.Errorf("count = %v (%T), want 42", result.Output["count"], result.Output["count"])
+	}
+	if result.Output["greeting"] != "Hello World" {
+		t.Errorf("greeting = %v, want Hello World", result.Output["greeting"])
+	}
+	if _, ok := result.Output["declared"]; ok {
+		t.Error("fields without a value should not be mapped")
+	}
+}
+
+func TestEngineOutputMappingTypeMismatch(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Output: &types.SchemaDef{
+			Properties: map[string]types.FieldDef{
+				"count": {Type: "integer", Value: "${{ steps.count.output.stdout }}"},
+			},
+		},
+		Steps: []types.StepDef{
+			{Name: "count", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo many"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "success" {
+		t.Errorf("status = %q, want success: a bad output value must not fail the run", result.Status)
+	}
+	if _, ok := result.Output["count"]; ok {
+		t.Errorf("output = %v, want count left out", result.Output)
+	}
+	if len(result.OutputErrors) != 1 || !strings.Contains(result.OutputErrors[0], `output "count"`) {
+		t.Errorf("output errors = %q", result.OutputErrors)
+	}
+}
+
+func TestEngineStepTimeout(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name:      "hang",
+				Connector: "shell",
+				Action:    "run",
+				Input:     map[string]any{"command": "sleep 5"},
+				Timeout:   "100ms",
+			},
+		},
+	}
+
+	start := time.Now()
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("timeout did not stop the step (took %v)", elapsed)
+	}
+	if result.Steps[0].Status != "timed_out" {
+		t.Errorf("step status = %q, want timed_out", result.Steps[0].Status)
+	}
+	if result.Status != "failed" {
+		t.Errorf("status = %q, want failed", result.Status)
+	}
+}
+
+// slowConnector succeeds after a delay, ignoring cancellation.
+type slowConnector struct{ delay time.Duration }
+
+func (c slowConnector) Name() string                { return "slow" }
+func (c slowConnector) Actions() []plugin.ActionDef { return nil }
+func (c slowConnector) Validate() error             { return nil }
+func (c slowConnector) Execute(ctx context.Context, action string, input map[string]any) (*types.StepResult, error) {
+	time.Sleep(c.delay)
+	return &types.StepResult{Status: "success", Output: map[string]any{"done": true}}, nil
+}
+
+func TestEngineStepCompletedAfterTimeout(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(slowConnector{delay: 100 * time.Millisecond})
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "slow", Connector: "slow", Action: "run", Timeout: "10ms"},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sr := result.Steps[0]; sr.Status != "success" || sr.Output["done"] != true {
+		t.Errorf("step = %q %v, want the completed step to keep its result", sr.Status, sr.Output)
+	}
+}
+
+func TestEngineStepTimeoutRetryBudget(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name:      "hang",
+				Connector: "shell",
+				Action:    "run",
+				Input:     map[string]any{"command": "exec sleep 5"},
+				Timeout:   "50ms",
+				OnError:   "retry",
+				Retry:     &types.RetryConfig{MaxRetries: 10, BackoffSeconds: 0.01, Timeout: "300ms"},
+			},
+		},
+	}
+
+	start := time.Now()
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("retry budget not enforced (took %v)", elapsed)
+	}
+	sr := result.Steps[0]
+	if sr.Status != "timed_out" {
+		t.Errorf("step status = %q, want timed_out", sr.Status)
+	}
+	if sr.Retries == 0 || sr.Retries >= 10 {
+		t.Errorf("retries = %d, want some but not all attempts", sr.Retries)
+	}
+}
+
+func TestEngineFlowTimeout(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name:    "test",
+		Timeout: "100ms",
+		Steps: []types.StepDef{
+			{Name: "hang", Connector: "shell", Action: "run", Input: map[string]any{"command": "exec sleep 5"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "failed" || result.Error != "flow timed out after 100ms" {
+		t.Errorf("status = %q, error = %q; want failed flow timeout", result.Status, result.Error)
+	}
+	if result.Steps[0].Status != "timed_out" {
+		t.Errorf("step status = %q, want timed_out", result.Steps[0].Status)
+	}
+}
+
+func TestEngineForeachStopsOnTimeout(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name:    "test",
+		Timeout: "150ms",
+		Steps: []types.StepDef{
+			{Name: "each", Connector: "shell", Action: "run", Foreach: "${{ input.items }}",
+				Input: map[string]any{"command": "sleep 0.1"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{"items": []any{1, 2, 3, 4, 5, 6}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sr := result.Steps[0]
+	if sr.Status != "timed_out" || !strings.Contains(sr.Error, "foreach stopped after starting 2 of 6 iterations") {
+		t.Errorf("status = %q, error = %q", sr.Status, sr.Error)
+	}
+	for _, it := range sr.Iterations[2:] {
+		if it.Status != "skipped" {
+			t.Errorf("iteration %d status = %q, want skipped", it.Index, it.Status)
+		}
+	}
+}
+
+func TestEngineFinally(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "fail", Connector: "shell", Action: "run", Input: map[string]any{"command": "exit 1"}},
+			{Name: "never", Connector: "log", Action: "print", Input: map[string]any{"message": "x"}},
+		},
+		OnFailure: []types.StepDef{
+			{Name: "notify", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo ${{ steps.fail.status }}"}},
+		},
+		Finally: []types.StepDef{
+			{Name: "cleanup", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo ${{ flow.status }}"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "failed" || !strings.Contains(result.Error, `step "fail" failed`) {
+		t.Errorf("status = %q, error = %q; want original failure", result.Status, result.Error)
+	}
+	if len(result.Steps) != 1 {
+		t.Errorf("expected main steps to stop after abort, got %d", len(result.Steps))
+	}
+	if len(result.OnFailure) != 1 || result.OnFailure[0].Output["stdout"] != "failed" {
+		t.Errorf("on_failure = %+v, want notify with stdout failed", result.OnFailure)
+	}
+	if len(result.Finally) != 1 || result.Finally[0].Output["stdout"] != "failed" {
+		t.Errorf("finally = %+v, want cleanup with stdout failed", result.Finally)
+	}
+}
+
+func TestEngineFinallyOnSuccess(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "work", Connector: "log", Action: "print", Input: map[string]any{"message": "x"}},
+		},
+		OnFailure: []types.StepDef{
+			{Name: "notify", Connector: "log", Action: "print", Input: map[string]any{"message": "x"}},
+		},
+		Finally: []types.StepDef{
+			{Name: "cleanup", Connector: "shell", Action: "run", Input: map[string]any{"command": "exit 1"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.OnFailure) != 0 {
+		t.Errorf("expected on_failure not to run, got %d steps", len(result.OnFailure))
+	}
+	if result.Status != "failed" || !strings.Contains(result.Error, `step "cleanup" failed`) {
+		t.Errorf("status = %q, error = %q; want failing cleanup to fail the flow", result.Status, result.Error)
+	}
+}
+
+func TestEngineCompensate(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+
+	undo := func(name string) *types.StepDef {
+		return &types.StepDef{Connector: "shell", Action: "run", Input: map[string]any{"command": "echo undo ${{ steps." + name + ".output.stdout }}"}}
+	}
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "create-a", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo a"}, Compensate: undo("create-a")},
+			{Name: "create-b", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo b"}, Compensate: undo("create-b")},
+			{Name: "note", Connector: "log", Action: "print", Input: map[string]any{"message": "x"}},
+			{Name: "fail", Connector: "shell", Action: "run", Input: map[string]any{"command": "exit 1"}, Compensate: undo("fail")},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "compensated" {
+		t.Errorf("status = %q, want compensated", result.Status)
+	}
+	if !strings.Contains(result.Error, `step "fail" failed`) {
+		t.Errorf("error = %q, want original failure", result.Error)
+	}
+	if len(result.Compensations) != 2 {
+		t.Fatalf("expected 2 compensations, got %d", len(result.Compensations))
+	}
+	for i, want := range []string{"undo b", "undo a"} {
+		cr := result.Compensations[i]
+		if cr.Output["stdout"] != want {
+			t.Errorf("compensations[%d] (%s) stdout = %v, want %q", i, cr.Name, cr.Output["stdout"], want)
+		}
+	}
+	if result.Compensations[0].Name != "compensate-create-b" {
+		t.Errorf("compensation name = %q, want compensate-create-b", result.Compensations[0].Name)
+	}
+}
+
+func TestEngineCompensateForeachAndLoop(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	undo := func(what string) *types.StepDef {
+		return &types.StepDef{Connector: "shell", Action: "run", Input: map[string]any{"command": "echo undo " + what}}
+	}
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "each", Connector: "shell", Action: "run", Foreach: "${{ input.items }}",
+				Input: map[string]any{"command": "echo ${{ item }}"}, Compensate: undo("each")},
+			{Name: "poll", Loop: &types.LoopConfig{Until: "steps.check.status == 'success'", MaxIterations: 2,
+				Steps: []types.StepDef{{Name: "check", Connector: "shell", Action: "run", Input: map[string]any{"command": "true"}}}},
+				Compensate: undo("poll")},
+			{Name: "fail", Connector: "shell", Action: "run", Input: map[string]any{"command": "exit 1"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{"items": []any{1, 2}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "compensated" || len(result.Compensations) != 2 {
+		t.Fatalf("status = %q with %d compensations, want compensated with 2", result.Status, len(result.Compensations))
+	}
+	for i, want := range []string{"undo poll", "undo each"} {
+		if got := result.Compensations[i].Output["stdout"]; got != want {
+			t.Errorf("compensations[%d] stdout = %v, want %q", i, got, want)
+		}
+	}
+}
+
+func TestEngineCompensateFailure(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "create-a", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo a"},
+				Compensate: &types.StepDef{Name: "undo-a", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo undo a"}}},
+			{Name: "create-b", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo b"},
+				Compensate: &types.StepDef{Name: "undo-b", Connector: "shell", Action: "run", Input: map[string]any{"command": "exit 3"}}},
+			{Name: "fail", Connector: "shell", Action: "run", Input: map[string]any{"command": "exit 1"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "failed" {
+		t.Errorf("status = %q, want failed when a compensation fails", result.Status)
+	}
+	if len(result.Compensations) != 2 {
+		t.Errorf("expected all compensations to be attempted, got %d", len(result.Compensations))
+	}
+}
+
+func TestEngineStore(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+	runs := store.NewDirStore(t.TempDir())
+	eng.Store = runs
+
+	childFlow := &types.FlowDef{
+		Name:  "child",
+		Steps: []types.StepDef{{Name: "child-step", Connector: "log", Action: "print", Input: map[string]any{"message": "hi"}}},
+	}
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
+		return childFlow, nil
+	}
+
+	parentFlow := &types.FlowDef{
+		Name:  "parent",
+		Steps: []types.StepDef{{Name: "call-child", Connector: "flow", Flow: "child"}},
+	}
+
+	result, err := eng.Run(context.Background(), parentFlow, map[string]any{"name": "World"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.RunID == "" {
+		t.Fatal("expected run ID to be set")
+	}
+
+	saved, err := runs.Get(result.RunID)
+	if err != nil {
+		t.Fatalf("get run: %v", err)
+	}
+	if saved.Flow != "parent" || saved.Status != "success" || saved.Input["name"] != "World" || len(saved.Steps) != 1 {
+		t.Errorf("saved run = %+v, want parent run", saved)
+	}
+
+	all, err := runs.List(store.Filter{})
+	if err != nil {
+		t.Fatalf("list runs: %v", err)
+	}
+	if len(all) != 1 {
+		t.Errorf("expected only the top-level run to be stored, got %d runs", len(all))
+	}
+}
+
+func TestEngineStrictMode(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "notify", Connector: "log", Action: "print",
+				Input: map[string]any{"message": "posting to ${{ input.slack_webhook }}"}},
+		},
+	}
+
+	eng := NewEngine(registry)
+	result, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Status != "success" {
+		t.Fatalf("non-strict status = %q, want success", result.Status)
+	}
+
+	for _, setup := range []func(){
+		func() { flow.Strict = true },
+		func() { flow.Strict, eng.Strict = false, true },
+	} {
+		setup()
+		result, err = eng.Run(context.Background(), flow, map[string]any{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := `step "notify" failed: resolving input: resolving "message": unresolved reference "input.slack_webhook"`
+		if result.Status != "failed" || !strings.Contains(result.Error, want) {
+			t.Errorf("strict run = %q, %q; want failed with %q", result.Status, result.Error, want)
+		}
+	}
+}
+
+func TestEngineShellArgs(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "echo", Connector: "shell", Action: "run",
+				Input: map[string]any{"args": []any{"echo", "hi ${{ input.name }}", "${{ input.files }}"}}},
+			{Name: "both", Connector: "shell", Action: "run", OnError: "continue",
+				Input: map[string]any{"command": "echo", "args": []any{"echo"}}},
+		},
+	}
+
+	input := map[string]any{"name": "$(whoami); 'x'", "files": []any{"a", "b c"}}
+	result, err := eng.Run(context.Background(), flow, input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[0].Output["stdout"]; got != "hi $(whoami); 'x' a b c" {
+		t.Errorf("stdout = %q, want arguments passed without shell interpretation", got)
+	}
+	if result.Steps[1].Status != "error" || !strings.Contains(result.Steps[1].Error, "either 'command' or 'args'") {
+		t.Errorf("step both = %q (%s), want error for command and args together", result.Steps[1].Status, result.Steps[1].Error)
+	}
+}
+
+func TestEngineInvalidStepInput(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewHTTPConnector())
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "fetch", Connector: "http", Action: "request", OnError: "continue",
+				Input: map[string]any{"url": "${{ input.port }}", "headers": "${{ input.missing? }}"}},
+			{Name: "after", Connector: "log", Action: "print", Input: map[string]any{"message": "${{ steps.fetch.status }}"}},
+		},
+	}
+
+	result, err := eng.Run(context.Background(), flow, map[string]any{"port": 8080})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sr := result.Steps[0]
+	if sr.Status != "invalid_input" || sr.Error != `invalid input: input "url": expected string, got number` {
+		t.Errorf("fetch = %q (%s), want invalid_input for the url", sr.Status, sr.Error)
+	}
+	if result.Status != "partial" || result.Steps[1].Output["message"] != "invalid_input" {
+		t.Errorf("status = %q, steps = %+v; want invalid_input handled by on_error", result.Status, result.Steps)
+	}
+}
+
+func TestEngineDryRunSkipsPlaceholderInput(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	registry.Register(builtin.NewLogConnector())
+	registry.Register(builtin.NewHTTPConnector())
+
+	eng := NewEngine(registry)
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "list", Connector: "shell", Action: "run", Input: map[string]any{"command": "ls"}},
+			{Name: "each", Connector: "log", Action: "print", Foreach: "${{ steps.list.output.stdout | split(\"\\n\") }}",
+				Input: map[string]any{"message": "${{ item }}"}},
+			{Name: "fetch", Connector: "http", Action: "request", Input: map[string]any{"url": "${{ input.port }}"}},
+		},
+	}
+
+	result, err := eng.DryRun(flow, map[string]any{"port": 8080})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sr := result.Steps[1]; sr.Status != "dry_run" {
+		t.Errorf("each = %q (%s), want dry_run for an input that depends on a step output", sr.Status, sr.Error)
+	}
+	if sr := result.Steps[2]; sr.Status != "invalid_input" {
+		t.Errorf("fetch = %q (%s), want invalid_input for the resolved url", sr.Status, sr.Error)
+	}
+}
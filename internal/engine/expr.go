@@ -0,0 +1,835 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Expressions are the contents of ${{ ... }}. Grammar, loosest first:
+//
+//	or      = and { "||" and }
+//	and     = unary { "&&" unary }
+//	unary   = "!" unary | compare
+//	compare = pipe [ ( "==" | "!=" | "<" | "<=" | ">" | ">=" | "in" ) pipe ]
+//	pipe    = primary { "|" name [ "(" [ or { "," or } ] ")" ] }
+//	primary = number | string | "true" | "false" | "null" | path
+//	        | "(" or ")" | "[" [ or { "," or } ] "]"
+//	path    = ( name | "@" ) { "." ( name | integer ) | "[" selector "]" } [ "?" ]
+//	selector = integer | string | "*" | "?(" or ")"
+//
+// Names may contain letters, digits, "_" and "-" (step names often do).
+// Inside a filter selector, "@" is the element being tested. A trailing "?"
+// makes a path optional: it evaluates to null when it does not resolve.
+
+// ParseError reports a malformed expression. Col is the 1-based column
+// within the expression.
+type ParseError struct {
+	Expr string
+	Col  int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("invalid expression %q: %s at column %d", e.Expr, e.Msg, e.Col)
+}
+
+// unresolvedError reports a path that does not resolve to a value. The
+// default pipe and optional paths turn it into null.
+type unresolvedError struct {
+	ref string
+	err error
+}
+
+func (e *unresolvedError) Error() string {
+	return fmt.Sprintf("unresolved reference %q: %v", e.ref, e.err)
+}
+
+func (e *unresolvedError) Unwrap() error { return e.err }
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokName
+	tokNumber
+	tokString
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string // operator, name or raw number; unquoted string value
+	pos  int    // 0-based byte offset
+}
+
+// lex splits an expression into tokens.
+func lex(src string) ([]token, error) {
+	var toks []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"' || c == '\'':
+			start := i
+			var b strings.Builder
+			i++
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					switch src[i] {
+					case 'n':
+						b.WriteByte('\n')
+					case 't':
+						b.WriteByte('\t')
+					default:
+						b.WriteByte(src[i])
+					}
+				} else {
+					b.WriteByte(src[i])
+				}
+				i++
+			}
+			if i >= len(src) {
+				return nil, &ParseError{Expr: src, Col: start + 1, Msg: "unterminated string"}
+			}
+			i++
+			toks = append(toks, token{kind: tokString, text: b.String(), pos: start})
+
+		case isDigit(c) || (c == '-' && i+1 < len(src) && isDigit(src[i+1]) && !endsOperand(toks)):
+			start := i
+			i++
+			for i < len(src) && isDigit(src[i]) {
+				i++
+			}
+			if i+1 < len(src) && src[i] == '.' && isDigit(src[i+1]) && !afterDot(toks) {
+				i++
+				for i < len(src) && isDigit(src[i]) {
+					i++
+				}
+			}
+			toks = append(toks, token{kind: tokNumber, text: src[start:i], pos: start})
+
+		case isNameStart(c):
+			start := i
+			for i < len(src) && isNameChar(src[i]) {
+				i++
+			}
+			toks = append(toks, token{kind: tokName, text: src[start:i], pos: start})
+
+		default:
+			op := ""
+			for _, candidate := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "|", "(", ")", "[", "]", ",", ".", "*", "?", "@"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, &ParseError{Expr: src, Col: i + 1, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(src)}), nil
+}
+
+func isDigit(c byte) bool     { return c >= '0' && c <= '9' }
+func isNameStart(c byte) bool { return c == '_' || (c|0x20 >= 'a' && c|0x20 <= 'z') }
+func isNameChar(c byte) bool  { return isNameStart(c) || isDigit(c) || c == '-' }
+
+// endsOperand reports whether the last token completes an operand, in which
+// case a following "-" cannot start a negative number.
+func endsOperand(toks []token) bool {
+	if len(toks) == 0 {
+		return false
+	}
+	last := toks[len(toks)-1]
+	return last.kind == tokName || last.kind == tokNumber || last.kind == tokString ||
+		(last.kind == tokOp && (last.text == ")" || last.text == "]"))
+}
+
+// afterDot reports whether the number being lexed is a path segment, as in
+// items.0.name, where "0.name" must not be read as a decimal.
+func afterDot(toks []token) bool {
+	return len(toks) > 0 && toks[len(toks)-1].kind == tokOp && toks[len(toks)-1].text == "."
+}
+
+// Expression AST.
+type (
+	exprNode interface{}
+
+	literalNode struct{ value any }
+	pathNode    struct {
+		root     string // input, steps, env, secret, a variable name or "@"
+		segments []pathSegment
+		optional bool   // trailing "?"
+		raw      string // source text, for error messages
+		pos      int
+	}
+	listNode  struct{ items []exprNode }
+	notNode   struct{ operand exprNode }
+	logicNode struct {
+		op          string // "&&" or "||"
+		left, right exprNode
+	}
+	compareNode struct {
+		op          string
+		left, right exprNode
+		pos         int
+	}
+	pipeNode struct {
+		input exprNode
+		name  string
+		args  []exprNode
+		pos   int
+	}
+)
+
+type segmentKind int
+
+const (
+	segKey      segmentKind = iota // .name, .0 or ["name"]
+	segIndex                       // [0] or [-1]
+	segWildcard                    // [*]
+	segFilter                      // [?(expr)]
+)
+
+// pathSegment is one step of a path after its root.
+type pathSegment struct {
+	kind   segmentKind
+	key    string
+	index  int
+	filter exprNode
+}
+
+type parser struct {
+	src  string
+	toks []token
+	pos  int
+}
+
+// parseExpr parses a complete expression.
+func parseExpr(src string) (exprNode, error) {
+	toks, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{src: src, toks: toks}
+	if p.peek().kind == tokEOF {
+		return nil, p.errorf(p.peek(), "empty expression")
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "unexpected %s", describe(tok))
+	}
+	return node, nil
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	tok := p.toks[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) isOp(text string) bool {
+	tok := p.peek()
+	return tok.kind == tokOp && tok.text == text
+}
+
+func (p *parser) expect(text string) error {
+	if !p.isOp(text) {
+		return p.errorf(p.peek(), "expected %q, found %s", text, describe(p.peek()))
+	}
+	p.next()
+	return nil
+}
+
+func (p *parser) errorf(tok token, format string, args ...any) error {
+	return &ParseError{Expr: p.src, Col: tok.pos + 1, Msg: fmt.Sprintf(format, args...)}
+}
+
+func describe(tok token) string {
+	switch tok.kind {
+	case tokEOF:
+		return "end of expression"
+	case tokString:
+		return fmt.Sprintf("string %q", tok.text)
+	}
+	return fmt.Sprintf("%q", tok.text)
+}
+
+func (p *parser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (exprNode, error) {
+	if p.isOp("!") {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (exprNode, error) {
+	left, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	tok := p.peek()
+	op := ""
+	switch {
+	case tok.kind == tokOp && (tok.text == "==" || tok.text == "!=" || tok.text == "<" ||
+		tok.text == "<=" || tok.text == ">" || tok.text == ">="):
+		op = tok.text
+	case tok.kind == tokName && tok.text == "in":
+		op = "in"
+	default:
+		return left, nil
+	}
+	p.next()
+	right, err := p.parsePipe()
+	if err != nil {
+		return nil, err
+	}
+	return &compareNode{op: op, left: left, right: right, pos: tok.pos}, nil
+}
+
+func (p *parser) parsePipe() (exprNode, error) {
+	node, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("|") {
+		p.next()
+		tok := p.next()
+		if tok.kind != tokName {
+			return nil, p.errorf(tok, "expected pipe function name, found %s", describe(tok))
+		}
+		pipe := &pipeNode{input: node, name: tok.text, pos: tok.pos}
+		if p.isOp("(") {
+			p.next()
+			for !p.isOp(")") {
+				arg, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				pipe.args = append(pipe.args, arg)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+		}
+		node = pipe
+	}
+	return node, nil
+}
+
+func (p *parser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		if n, err := strconv.Atoi(tok.text); err == nil {
+			return &literalNode{value: n}, nil
+		}
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, p.errorf(tok, "invalid number %q", tok.text)
+		}
+		return &literalNode{value: f}, nil
+
+	case tokString:
+		return &literalNode{value: tok.text}, nil
+
+	case tokName:
+		switch tok.text {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		case "in":
+			return nil, p.errorf(tok, "unexpected %s", describe(tok))
+		}
+		return p.parsePath(tok)
+
+	case tokOp:
+		switch tok.text {
+		case "@":
+			return p.parsePath(tok)
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		case "[":
+			list := &listNode{}
+			for !p.isOp("]") {
+				item, err := p.parseOr()
+				if err != nil {
+					return nil, err
+				}
+				list.items = append(list.items, item)
+				if !p.isOp(",") {
+					break
+				}
+				p.next()
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			return list, nil
+		}
+	}
+	return nil, p.errorf(tok, "unexpected %s", describe(tok))
+}
+
+// parsePath parses the segments following a path's root token.
+func (p *parser) parsePath(root token) (exprNode, error) {
+	path := &pathNode{root: root.text, pos: root.pos}
+	for {
+		switch {
+		case p.isOp("."):
+			p.next()
+			seg := p.next()
+			if seg.kind != tokName && seg.kind != tokNumber {
+				return nil, p.errorf(seg, "expected field name after \".\", found %s", describe(seg))
+			}
+			path.segments = append(path.segments, pathSegment{kind: segKey, key: seg.text})
+
+		case p.isOp("["):
+			p.next()
+			seg, err := p.parseSelector()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			path.segments = append(path.segments, seg)
+
+		default:
+			path.raw = strings.TrimSpace(p.src[root.pos:p.peek().pos])
+			if p.isOp("?") {
+				p.next()
+				path.optional = true
+			}
+			return path, nil
+		}
+	}
+}
+
+// parseSelector parses the contents of a [...] path segment.
+func (p *parser) parseSelector() (pathSegment, error) {
+	tok := p.next()
+	switch {
+	case tok.kind == tokNumber:
+		n, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return pathSegment{}, p.errorf(tok, "array index must be an integer, found %q", tok.text)
+		}
+		return pathSegment{kind: segIndex, index: n}, nil
+	case tok.kind == tokString:
+		return pathSegment{kind: segKey, key: tok.text}, nil
+	case tok.kind == tokOp && tok.text == "*":
+		return pathSegment{kind: segWildcard}, nil
+	case tok.kind == tokOp && tok.text == "?":
+		if err := p.expect("("); err != nil {
+			return pathSegment{}, err
+		}
+		filter, err := p.parseOr()
+		if err != nil {
+			return pathSegment{}, err
+		}
+		if err := p.expect(")"); err != nil {
+			return pathSegment{}, err
+		}
+		return pathSegment{kind: segFilter, filter: filter}, nil
+	}
+	return pathSegment{}, p.errorf(tok, "expected index, key, \"*\" or \"?(...)\" in brackets, found %s", describe(tok))
+}
+
+// eval evaluates a parsed expression against the step context.
+func (sc *StepContext) eval(node exprNode) (any, error) {
+	switch n := node.(type) {
+	case *literalNode:
+		return n.value, nil
+
+	case *pathNode:
+		v, err := sc.resolvePath(n)
+		if err != nil {
+			if n.optional {
+				return nil, nil
+			}
+			return nil, &unresolvedError{ref: n.raw, err: err}
+		}
+		return v, nil
+
+	case *listNode:
+		items := make([]any, len(n.items))
+		for i, item := range n.items {
+			v, err := sc.eval(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = v
+		}
+		return items, nil
+
+	case *notNode:
+		v, err := sc.eval(n.operand)
+		if err != nil {
+			return nil, err
+		}
+		return !isTruthy(v), nil
+
+	case *logicNode:
+		left, err := sc.eval(n.left)
+		if err != nil {
+			return nil, err
+		}
+		// Short-circuit: the right side is only evaluated when needed.
+		if n.op == "&&" && !isTruthy(left) {
+			return false, nil
+		}
+		if n.op == "||" && isTruthy(left) {
+			return true, nil
+		}
+		right, err := sc.eval(n.right)
+		if err != nil {
+			return nil, err
+		}
+		return isTruthy(right), nil
+
+	case *compareNode:
+		left, err := sc.eval(n.left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := sc.eval(n.right)
+		if err != nil {
+			return nil, err
+		}
+		return compareValues(n.op, left, right, sc.Strict)
+
+	case *pipeNode:
+		v, err := sc.eval(n.input)
+		var unresolved *unresolvedError
+		if n.name == "default" && errors.As(err, &unresolved) {
+			v, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		args := make([]any, len(n.args))
+		for i, arg := range n.args {
+			if args[i], err = sc.eval(arg); err != nil {
+				return nil, err
+			}
+		}
+		return applyPipe(v, n.name, args)
+	}
+	return nil, fmt.Errorf("unsupported expression node %T", node)
+}
+
+// compareValues applies a comparison operator. Numbers compare numerically,
+// also against strings holding a number (e.g. a status code compared with
+// "200"), and booleans against "true"/"false". In strict mode these are not
+// converted: "200" == 200 is false, and "3" < 4 is an error. Other values of
+// different types are never equal and cannot be ordered.
+func compareValues(op string, left, right any, strict bool) (bool, error) {
+	switch op {
+	case "==":
+		return valuesEqual(left, right, strict), nil
+	case "!=":
+		return !valuesEqual(left, right, strict), nil
+	case "in":
+		return contains(right, left, strict)
+	}
+
+	if lf, rf, ok := numericPair(left, right, strict); ok {
+		switch op {
+		case "<":
+			return lf < rf, nil
+		case "<=":
+			return lf <= rf, nil
+		case ">":
+			return lf > rf, nil
+		case ">=":
+			return lf >= rf, nil
+		}
+	}
+	ls, lok := left.(string)
+	rs, rok := right.(string)
+	if lok && rok {
+		switch op {
+		case "<":
+			return ls < rs, nil
+		case "<=":
+			return ls <= rs, nil
+		case ">":
+			return ls > rs, nil
+		case ">=":
+			return ls >= rs, nil
+		}
+	}
+	return false, fmt.Errorf("cannot compare %s %s %s", typeName(left), op, typeName(right))
+}
+
+// valuesEqual reports whether two values are equal, converting numeric and
+// boolean strings unless strict is set.
+func valuesEqual(a, b any, strict bool) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	if af, bf, ok := numericPair(a, b, strict); ok {
+		return af == bf
+	}
+	if ab, bb, ok := boolPair(a, b, strict); ok {
+		return ab == bb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// numericPair converts both values to float64 if at least one is a number
+// and the other is a number or, unless strict is set, a numeric string.
+func numericPair(a, b any, strict bool) (float64, float64, bool) {
+	af, aNum := toFloat(a)
+	bf, bNum := toFloat(b)
+	if !aNum && !bNum || strict && !(aNum && bNum) {
+		return 0, 0, false
+	}
+	if !aNum {
+		s, ok := a.(string)
+		if !ok {
+			return 0, 0, false
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		af = f
+	}
+	if !bNum {
+		s, ok := b.(string)
+		if !ok {
+			return 0, 0, false
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		bf = f
+	}
+	return af, bf, true
+}
+
+// boolPair converts both values to bool if at least one is a bool and the
+// other is a bool or, unless strict is set, the string "true"/"false".
+func boolPair(a, b any, strict bool) (bool, bool, bool) {
+	ab, aBool := a.(bool)
+	bb, bBool := b.(bool)
+	if !aBool && !bBool || strict && !(aBool && bBool) {
+		return false, false, false
+	}
+	var err error
+	if !aBool {
+		s, ok := a.(string)
+		if !ok {
+			return false, false, false
+		}
+		if ab, err = strconv.ParseBool(s); err != nil {
+			return false, false, false
+		}
+	}
+	if !bBool {
+		s, ok := b.(string)
+		if !ok {
+			return false, false, false
+		}
+		if bb, err = strconv.ParseBool(s); err != nil {
+			return false, false, false
+		}
+	}
+	return ab, bb, true
+}
+
+// contains implements "needle in haystack" for arrays (element equality, as
+// for ==), strings (substring) and objects (key presence).
+func contains(haystack, needle any, strict bool) (bool, error) {
+	switch h := haystack.(type) {
+	case string:
+		s, ok := needle.(string)
+		if !ok {
+			return false, fmt.Errorf("cannot check %s in string", typeName(needle))
+		}
+		return strings.Contains(h, s), nil
+	case map[string]any:
+		s, ok := needle.(string)
+		if !ok {
+			return false, fmt.Errorf("cannot check %s in object", typeName(needle))
+		}
+		_, found := h[s]
+		return found, nil
+	}
+	if haystack != nil {
+		rv := reflect.ValueOf(haystack)
+		if rv.Kind() == reflect.Slice || rv.Kind() == reflect.Array {
+			for i := 0; i < rv.Len(); i++ {
+				if valuesEqual(rv.Index(i).Interface(), needle, strict) {
+					return true, nil
+				}
+			}
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("cannot check membership in %s", typeName(haystack))
+}
+
+// typeName names a value's type in expression terms for error messages.
+func typeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	}
+	if _, ok := toFloat(v); ok {
+		return "number"
+	}
+	if matchesType(v, "array") {
+		return "array"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// exprStepRefs returns the names of steps referenced by ${{ steps.x... }}
+// paths in an expression.
+func exprStepRefs(node exprNode) []string {
+	var refs []string
+	walkExpr(node, func(n exprNode) {
+		if p, ok := n.(*pathNode); ok && p.root == "steps" && len(p.segments) > 0 && p.segments[0].kind == segKey {
+			refs = append(refs, p.segments[0].key)
+		}
+	})
+	return refs
+}
+
+// checkPipes returns an error for the first unknown pipe function used in
+// an expression.
+func checkPipes(src string, node exprNode) error {
+	var err error
+	walkExpr(node, func(n exprNode) {
+		if p, ok := n.(*pipeNode); ok && err == nil {
+			if _, found := lookupPipe(p.name); !found {
+				err = &ParseError{Expr: src, Col: p.pos + 1, Msg: fmt.Sprintf("unknown pipe function %q", p.name)}
+			}
+		}
+	})
+	return err
+}
+
+// walkExpr calls fn for every node of an expression, parents first.
+func walkExpr(node exprNode, fn func(exprNode)) {
+	fn(node)
+	switch n := node.(type) {
+	case *pathNode:
+		for _, seg := range n.segments {
+			if seg.filter != nil {
+				walkExpr(seg.filter, fn)
+			}
+		}
+	case *listNode:
+		for _, item := range n.items {
+			walkExpr(item, fn)
+		}
+	case *notNode:
+		walkExpr(n.operand, fn)
+	case *logicNode:
+		walkExpr(n.left, fn)
+		walkExpr(n.right, fn)
+	case *compareNode:
+		walkExpr(n.left, fn)
+		walkExpr(n.right, fn)
+	case *pipeNode:
+		walkExpr(n.input, fn)
+		for _, arg := range n.args {
+			walkExpr(arg, fn)
+		}
+	}
+}
+
+// parseTemplate parses every ${{ }} expression embedded in s and checks
+// that the pipe functions they use exist.
+func parseTemplate(s string) ([]exprNode, error) {
+	var nodes []exprNode
+	for _, match := range exprRegex.FindAllStringSubmatch(s, -1) {
+		node, err := parseExpr(match[1])
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPipes(match[1], node); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
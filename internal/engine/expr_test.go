@@ -0,0 +1,180 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"piper/internal/types"
+)
+
+func TestEvaluateConditionLogic(t *testing.T) {
+	ctx := NewStepContext(map[string]any{
+		"env":     "production",
+		"deploy":  true,
+		"count":   3,
+		"regions": []any{"eu", "us"},
+		"labels":  map[string]any{"team": "core"},
+	})
+	ctx.AddStepResult("test", &types.StepResult{Status: "success"})
+
+	tests := []struct {
+		when     string
+		expected bool
+	}{
+		{`${{ steps.test.status == "success" && input.deploy }}`, true},
+		{`${{ input.env == "staging" || input.env == "production" }}`, true},
+		{`${{ !input.deploy }}`, false},
+		{`${{ !(input.env == "staging") && input.count > 2 }}`, true},
+		{`${{ input.env == "staging" || input.count >= 3 && !input.deploy }}`, false},
+		{`${{ (input.env == "staging" || input.count >= 3) && input.deploy }}`, true},
+		{`${{ "eu" in input.regions }}`, true},
+		{`${{ "ap" in input.regions }}`, false},
+		{`${{ input.env in ["staging", "production"] }}`, true},
+		{`${{ "team" in input.labels }}`, true},
+		{`${{ "prod" in input.env }}`, true},
+		{`${{ input.missing == null }}`, false},
+		{`${{ input.count == 3.0 }}`, true},
+		{`${{ input.count < -1 }}`, false},
+		{`${{ input.deploy == "true" }}`, true},
+		{`${{ input.deploy == 1 }}`, false},
+		{`input.env == 'production'`, true},
+	}
+
+	for _, tt := range tests {
+		result, err := ctx.EvaluateCondition(tt.when)
+		if err != nil {
+			t.Errorf("EvaluateCondition(%q) error: %v", tt.when, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("EvaluateCondition(%q) = %v, want %v", tt.when, result, tt.expected)
+		}
+	}
+}
+
+func TestEvaluateConditionShortCircuit(t *testing.T) {
+	ctx := NewStepContext(map[string]any{})
+
+	// The right side references an unknown step and would fail if evaluated.
+	ok, err := ctx.EvaluateCondition(`${{ false && steps.missing.status == "success" }}`)
+	if err != nil || ok {
+		t.Errorf("got %v, %v; want false, nil", ok, err)
+	}
+	ok, err = ctx.EvaluateCondition(`${{ true || steps.missing.status == "success" }}`)
+	if err != nil || !ok {
+		t.Errorf("got %v, %v; want true, nil", ok, err)
+	}
+}
+
+func TestEvaluateConditionTypeErrors(t *testing.T) {
+	ctx := NewStepContext(map[string]any{"name": "app", "flag": true})
+
+	for _, when := range []string{
+		`${{ input.name > 3 }}`,
+		`${{ input.flag < "x" }}`,
+		`${{ 1 in input.name }}`,
+		`${{ "a" in input.flag }}`,
+	} {
+		if _, err := ctx.EvaluateCondition(when); err == nil {
+			t.Errorf("EvaluateCondition(%q): expected error", when)
+		}
+	}
+}
+
+func TestEvaluateConditionStrictTypes(t *testing.T) {
+	input := map[string]any{"code": "200", "count": 3, "flag": true, "codes": []any{"200", "201"}}
+	tests := []struct {
+		when          string
+		lax, isStrict bool
+	}{
+		{`${{ input.code == 200 }}`, true, false},
+		{`${{ input.code != 200 }}`, false, true},
+		{`${{ input.count == "3" }}`, true, false},
+		{`${{ input.count == 3.0 }}`, true, true},
+		{`${{ input.flag == "true" }}`, true, false},
+		{`${{ 201 in input.codes }}`, true, false},
+		{`${{ input.code == "200" }}`, true, true},
+	}
+	for _, tt := range tests {
+		for _, strict := range []bool{false, true} {
+			ctx := NewStepContext(input)
+			ctx.Strict = strict
+			want := tt.lax
+			if strict {
+				want = tt.isStrict
+			}
+			got, err := ctx.EvaluateCondition(tt.when)
+			if err != nil || got != want {
+				t.Errorf("EvaluateCondition(%q) with strict=%v = %v, %v; want %v", tt.when, strict, got, err, want)
+			}
+		}
+	}
+
+	ctx := NewStepContext(input)
+	ctx.Strict = true
+	if _, err := ctx.EvaluateCondition(`${{ input.code > 100 }}`); err == nil {
+		t.Error("strict mode should not order a string against a number")
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		col  int
+	}{
+		{`input.a == `, 12},
+		{`input.a &&& input.b`, 11},
+		{`(input.a == "x"`, 16},
+		{`input.a == "x`, 12},
+		{`input.a # 1`, 9},
+		{`input.a input.b`, 9},
+		{``, 1},
+		{`input. == 1`, 8},
+	}
+
+	for _, tt := range tests {
+		_, err := parseExpr(tt.expr)
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("parseExpr(%q) error = %v, want ParseError", tt.expr, err)
+			continue
+		}
+		if pe.Col != tt.col {
+			t.Errorf("parseExpr(%q) column = %d, want %d (%v)", tt.expr, pe.Col, tt.col, err)
+		}
+	}
+}
+
+func TestResolveTypedLiterals(t *testing.T) {
+	ctx := NewStepContext(map[string]any{"count": 2})
+
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{"${{ 42 }}", 42},
+		{"${{ 1.5 }}", 1.5},
+		{"${{ 'hi' }}", "hi"},
+		{"${{ null }}", nil},
+		{"${{ input.count >= 2 }}", true},
+		{"n=${{ input.count > 5 }}", "n=false"},
+	}
+
+	for _, tt := range tests {
+		result, err := ctx.resolveString(tt.input)
+		if err != nil {
+			t.Errorf("resolveString(%q) error: %v", tt.input, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("resolveString(%q) = %#v, want %#v", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestStepRefsCompoundExpressions(t *testing.T) {
+	refs := stepRefs(`${{ steps.build.status == "success" && !(steps.lint-check.output.ok) }}`)
+	if len(refs) != 2 || refs[0] != "build" || refs[1] != "lint-check" {
+		t.Errorf("stepRefs = %v, want [build lint-check]", refs)
+	}
+}
@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"piper/internal/types"
+)
+
+// stepGraph is the dependency graph of a flow's top-level steps.
+// Parallel groups and loop blocks are a single node; references to their
+// sub-steps resolve to the group.
+type stepGraph struct {
+	steps      map[string]types.StepDef
+	order      []string            // declaration order
+	deps       map[string][]string // step -> upstream steps
+	dependents map[string][]string // step -> downstream steps
+}
+
+// usesDependencies reports whether any top-level step declares depends_on,
+// which switches the engine from sequential to graph scheduling.
+func usesDependencies(steps []types.StepDef) bool {
+	for _, step := range steps {
+		if len(step.DependsOn) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// buildGraph builds the dependency graph from explicit depends_on entries and
+// implicit ${{ steps.x... }} references. It fails on unknown steps and cycles.
+// A step depending on itself through depends_on is rejected by ValidateFlow.
+func buildGraph(steps []types.StepDef) (*stepGraph, error) {
+	g := &stepGraph{
+		steps:      make(map[string]types.StepDef, len(steps)),
+		deps:       make(map[string][]string, len(steps)),
+		dependents: make(map[string][]string, len(steps)),
+	}
+
+	nodeOf := stepNodes(steps)
+	for _, step := range steps {
+		g.steps[step.Name] = step
+		g.order = append(g.order, step.Name)
+	}
+
+	for _, step := range steps {
+		seen := make(map[string]bool)
+		for _, ref := range stepDependencies(step) {
+			node, ok := nodeOf[ref]
+			if !ok {
+				return nil, fmt.Errorf("step %q depends on unknown step %q", step.Name, ref)
+			}
+			if node == step.Name {
+				// References within a group or loop (including a loop's
+				// until condition reading its own result) are not edges.
+				continue
+			}
+			if seen[node] {
+				continue
+			}
+			seen[node] = true
+			g.deps[step.Name] = append(g.deps[step.Name], node)
+			g.dependents[node] = append(g.dependents[node], step.Name)
+		}
+	}
+
+	if cycle := g.findCycle(); cycle != nil {
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(cycle, " -> "))
+	}
+	return g, nil
+}
+
+// stepNodes maps every step name, including parallel and loop sub-steps, to
+// the top-level step that contains it.
+func stepNodes(steps []types.StepDef) map[string]string {
+	nodeOf := make(map[string]string)
+	for _, step := range steps {
+		nodeOf[step.Name] = step.Name
+		for _, ps := range step.Parallel {
+			nodeOf[ps.Name] = step.Name
+		}
+		if step.Loop != nil {
+			for _, ls := range step.Loop.Steps {
+				nodeOf[ls.Name] = step.Name
+			}
+		}
+	}
+	return nodeOf
+}
+
+// stepDependencies returns the names of all steps a step depends on, both
+// declared via depends_on and implied by step references in its input,
+// when condition, parallel sub-steps and loop block.
+func stepDependencies(step types.StepDef) []string {
+	refs := append([]string{}, step.DependsOn...)
+	refs = append(refs, stepRefs(step.Input)...)
+	refs = append(refs, conditionRefs(step.When)...)
+	refs = append(refs, stepRefs(step.Foreach)...)
+	for _, ps := range step.Parallel {
+		refs = append(refs, stepDependencies(ps)...)
+	}
+	if step.Loop != nil {
+		refs = append(refs, conditionRefs(step.Loop.Until)...)
+		refs = append(refs, conditionRefs(step.Loop.While)...)
+		for _, ls := range step.Loop.Steps {
+			refs = append(refs, stepDependencies(ls)...)
+		}
+	}
+	return refs
+}
+
+// conditionRefs extracts referenced step names from a condition, which may
+// omit the ${{ }} wrapper.
+func conditionRefs(cond string) []string {
+	var refs []string
+	for _, node := range conditionNodes(cond) {
+		refs = append(refs, exprStepRefs(node)...)
+	}
+	return refs
+}
+
+// stepRefs extracts referenced step names from any ${{ steps.x... }}
+// expressions found in v.
+func stepRefs(v any) []string {
+	var refs []string
+	switch val := v.(type) {
+	case string:
+		nodes, _ := parseTemplate(val)
+		for _, node := range nodes {
+			refs = append(refs, exprStepRefs(node)...)
+		}
+	case map[string]any:
+		for _, item := range val {
+			refs = append(refs, stepRefs(item)...)
+		}
+	case []any:
+		for _, item := range val {
+			refs = append(refs, stepRefs(item)...)
+		}
+	}
+	return refs
+}
+
+// findCycle returns the steps forming a dependency cycle, or nil.
+func (g *stepGraph) findCycle() []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(g.order))
+	var stack []string
+
+	var visit func(name string) []string
+	visit = func(name string) []string {
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, dep := range g.deps[name] {
+			switch state[dep] {
+			case visiting:
+				for i, s := range stack {
+					if s == dep {
+						return append(append([]string{}, stack[i:]...), dep)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	for _, name := range g.order {
+		if state[name] == unvisited {
+			if cycle := visit(name); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// topoOrder returns the steps in an order where every step follows its
+// dependencies. Ties keep declaration order.
+func (g *stepGraph) topoOrder() []types.StepDef {
+	position := make(map[string]int, len(g.order))
+	for i, name := range g.order {
+		position[name] = i
+	}
+	pending := make(map[string]int, len(g.order))
+	var ready []string
+	for _, name := range g.order {
+		pending[name] = len(g.deps[name])
+		if pending[name] == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	ordered := make([]types.StepDef, 0, len(g.order))
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool { return position[ready[i]] < position[ready[j]] })
+		name := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, g.steps[name])
+		for _, next := range g.dependents[name] {
+			pending[next]--
+			if pending[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+	return ordered
+}
@@ -0,0 +1,362 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PipeFunc implements a pipe function used as ${{ value | name }} or
+// ${{ value | name(arg, ...) }}. It receives the piped value and the
+// evaluated arguments.
+type PipeFunc func(val any, args []any) (any, error)
+
+var (
+	pipesMu sync.RWMutex
+	pipes   = map[string]PipeFunc{
+		"slugify":      stringPipe(slugify),
+		"upper":        stringPipe(strings.ToUpper),
+		"lower":        stringPipe(strings.ToLower),
+		"trim":         stringPipe(strings.TrimSpace),
+		"urlencode":    stringPipe(url.QueryEscape),
+		"base64encode": stringPipe(func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }),
+		"base64decode": pipeBase64Decode,
+		"shellquote":   pipeShellQuote,
+		"sha256":       stringPipe(func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) }),
+		"default":      pipeDefault,
+		"json":         pipeJSON,
+		"fromjson":     pipeFromJSON,
+		"join":         pipeJoin,
+		"split":        pipeSplit,
+		"replace":      pipeReplace,
+		"truncate":     pipeTruncate,
+		"length":       pipeLength,
+		"first":        pipeFirst,
+		"last":         pipeLast,
+		"keys":         pipeKeys,
+		"date":         pipeDate,
+	}
+)
+
+// RegisterPipe makes a pipe function available to all flows under name,
+// replacing any existing function with that name. Call it during program
+// initialization, before flows are validated or run:
+//
+//	engine.RegisterPipe("reverse", func(val any, args []any) (any, error) {
+//		s := fmt.Sprintf("%v", val)
+//		r := []rune(s)
+//		slices.Reverse(r)
+//		return string(r), nil
+//	})
+func RegisterPipe(name string, fn PipeFunc) {
+	pipesMu.Lock()
+	defer pipesMu.Unlock()
+	pipes[name] = fn
+}
+
+func lookupPipe(name string) (PipeFunc, bool) {
+	pipesMu.RLock()
+	defer pipesMu.RUnlock()
+	fn, ok := pipes[name]
+	return fn, ok
+}
+
+func applyPipe(val any, name string, args []any) (any, error) {
+	fn, ok := lookupPipe(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown pipe function %q", name)
+	}
+	out, err := fn(val, args)
+	if err != nil {
+		return nil, fmt.Errorf("pipe %s: %w", name, err)
+	}
+	return out, nil
+}
+
+// stringPipe adapts a string function without arguments to a PipeFunc.
+func stringPipe(fn func(string) string) PipeFunc {
+	return func(val any, args []any) (any, error) {
+		if err := wantArgs(args, 0, 0); err != nil {
+			return nil, err
+		}
+		return fn(pipeText(val)), nil
+	}
+}
+
+// pipeText formats a value for a pipe that works on text. A missing or null
+// value is the empty string rather than "<nil>".
+func pipeText(val any) string {
+	if val == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", val)
+}
+
+// wantArgs checks the number of pipe arguments.
+func wantArgs(args []any, min, max int) error {
+	if len(args) < min || len(args) > max {
+		if min == max {
+			return fmt.Errorf("expects %d argument(s), got %d", min, len(args))
+		}
+		return fmt.Errorf("expects %d to %d arguments, got %d", min, max, len(args))
+	}
+	return nil
+}
+
+// stringArg returns argument i as a string, or def when it is absent.
+func stringArg(args []any, i int, def string) string {
+	if i >= len(args) {
+		return def
+	}
+	return pipeText(args[i])
+}
+
+// asList converts any slice to []any.
+func asList(val any) ([]any, bool) {
+	if l, ok := val.([]any); ok {
+		return l, true
+	}
+	if val == nil {
+		return nil, false
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	l := make([]any, rv.Len())
+	for i := range l {
+		l[i] = rv.Index(i).Interface()
+	}
+	return l, true
+}
+
+// pipeDefault replaces null and empty strings with its argument.
+func pipeDefault(val any, args []any) (any, error) {
+	if err := wantArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	if val == nil || val == "" {
+		return args[0], nil
+	}
+	return val, nil
+}
+
+func pipeJSON(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func pipeFromJSON(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	s, ok := val.(string)
+	if !ok {
+		return nil, fmt.Errorf("expects a string, got %s", typeName(val))
+	}
+	var out any
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func pipeBase64Decode(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(pipeText(val))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// pipeShellQuote quotes a value as a single POSIX shell word, or an array
+// as space-separated words, so it can be interpolated into a shell command.
+func pipeShellQuote(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	if list, ok := asList(val); ok {
+		words := make([]string, len(list))
+		for i, item := range list {
+			words[i] = shellQuote(pipeText(item))
+		}
+		return strings.Join(words, " "), nil
+	}
+	return shellQuote(pipeText(val)), nil
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// pipeJoin joins array elements with a separator (default ",").
+func pipeJoin(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 1); err != nil {
+		return nil, err
+	}
+	list, ok := asList(val)
+	if !ok {
+		return nil, fmt.Errorf("expects an array, got %s", typeName(val))
+	}
+	parts := make([]string, len(list))
+	for i, item := range list {
+		parts[i] = pipeText(item)
+	}
+	return strings.Join(parts, stringArg(args, 0, ",")), nil
+}
+
+// pipeSplit splits a string on a separator (default ",").
+func pipeSplit(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 1); err != nil {
+		return nil, err
+	}
+	s := pipeText(val)
+	if s == "" {
+		return []any{}, nil
+	}
+	parts := strings.Split(s, stringArg(args, 0, ","))
+	out := make([]any, len(parts))
+	for i, p := range parts {
+		out[i] = p
+	}
+	return out, nil
+}
+
+func pipeReplace(val any, args []any) (any, error) {
+	if err := wantArgs(args, 2, 2); err != nil {
+		return nil, err
+	}
+	return strings.ReplaceAll(pipeText(val), stringArg(args, 0, ""), stringArg(args, 1, "")), nil
+}
+
+// pipeTruncate shortens a string to at most n characters.
+func pipeTruncate(val any, args []any) (any, error) {
+	if err := wantArgs(args, 1, 1); err != nil {
+		return nil, err
+	}
+	n, ok := toFloat(args[0])
+	if !ok || n < 0 {
+		return nil, fmt.Errorf("expects a non-negative length, got %v", args[0])
+	}
+	r := []rune(pipeText(val))
+	if len(r) > int(n) {
+		r = r[:int(n)]
+	}
+	return string(r), nil
+}
+
+// pipeLength returns the number of characters, elements or keys.
+func pipeLength(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case string:
+		return len([]rune(v)), nil
+	case map[string]any:
+		return len(v), nil
+	case nil:
+		return 0, nil
+	}
+	if list, ok := asList(val); ok {
+		return len(list), nil
+	}
+	return nil, fmt.Errorf("expects a string, array or object, got %s", typeName(val))
+}
+
+func pipeFirst(val any, args []any) (any, error) {
+	return pickElement(val, args, func(l []any) any { return l[0] })
+}
+
+func pipeLast(val any, args []any) (any, error) {
+	return pickElement(val, args, func(l []any) any { return l[len(l)-1] })
+}
+
+// pickElement returns an element of a non-empty array, or null for an empty one.
+func pickElement(val any, args []any, pick func([]any) any) (any, error) {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	list, ok := asList(val)
+	if !ok {
+		return nil, fmt.Errorf("expects an array, got %s", typeName(val))
+	}
+	if len(list) == 0 {
+		return nil, nil
+	}
+	return pick(list), nil
+}
+
+// pipeKeys returns the sorted keys of an object.
+func pipeKeys(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return nil, err
+	}
+	m, ok := val.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expects an object, got %s", typeName(val))
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	out := make([]any, len(keys))
+	for i, k := range keys {
+		out[i] = k
+	}
+	return out, nil
+}
+
+// pipeDate formats a time given as an RFC 3339 string, a YYYY-MM-DD date,
+// Unix seconds, or "now". The format is a Go time layout such as
+// "2006-01-02", or one of "rfc3339" (the default) and "unix".
+func pipeDate(val any, args []any) (any, error) {
+	if err := wantArgs(args, 0, 1); err != nil {
+		return nil, err
+	}
+	var t time.Time
+	if secs, ok := toFloat(val); ok {
+		t = time.Unix(int64(secs), 0).UTC()
+	} else {
+		s := pipeText(val)
+		var err error
+		switch {
+		case s == "now":
+			t = time.Now().UTC()
+		case len(s) == len("2006-01-02"):
+			t, err = time.Parse("2006-01-02", s)
+		default:
+			t, err = time.Parse(time.RFC3339, s)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q as a time", s)
+		}
+	}
+
+	switch format := stringArg(args, 0, "rfc3339"); format {
+	case "rfc3339":
+		return t.Format(time.RFC3339), nil
+	case "unix":
+		return int(t.Unix()), nil
+	default:
+		return t.Format(format), nil
+	}
+}
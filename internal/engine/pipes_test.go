@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"piper/internal/types"
+)
+
+func TestResolveChainedPipes(t *testing.T) {
+	ctx := NewStepContext(map[string]any{
+		"name":  "  Acme Corp  ",
+		"blank": "",
+		"tags":  []any{"b", "a", "c"},
+		"csv":   "x,y,z",
+		"meta":  map[string]any{"zone": "eu", "app": "web"},
+		"body":  `{"id": 7, "ok": true}`,
+		"when":  "2024-03-05T10:20:30Z",
+		"path":  "a b&c",
+		"none":  nil,
+	})
+	ctx.AddStepResult("fetch", &types.StepResult{
+		Status: "success",
+		Output: map[string]any{"items": []any{1, 2, 3}},
+	})
+
+	tests := []struct {
+		input    string
+		expected any
+	}{
+		{`${{ input.name | trim | slugify }}`, "acme-corp"},
+		{`${{ input.blank | trim | default("anon") | upper }}`, "ANON"},
+		{`${{ input.name | trim | truncate(4) }}`, "Acme"},
+		{`${{ input.tags | join }}`, "b,a,c"},
+		{`${{ input.tags | join(" / ") }}`, "b / a / c"},
+		{`${{ input.csv | split }}`, []any{"x", "y", "z"}},
+		{`${{ input.csv | split(",") | last }}`, "z"},
+		{`${{ input.csv | replace(",", ";") }}`, "x;y;z"},
+		{`${{ input.tags | length }}`, 3},
+		{`${{ input.csv | length }}`, 5},
+		{`${{ input.tags | first }}`, "b"},
+		{`${{ input.meta | keys }}`, []any{"app", "zone"}},
+		{`${{ input.meta | keys | json }}`, `["app","zone"]`},
+		{`${{ input.body | fromjson }}`, map[string]any{"id": float64(7), "ok": true}},
+		{`${{ "hello" | base64encode }}`, "aGVsbG8="},
+		{`${{ "hello" | base64encode | base64decode }}`, "hello"},
+		{`${{ input.path | urlencode }}`, "a+b%26c"},
+		{`${{ "abc" | sha256 }}`, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{`${{ input.when | date("2006-01-02") }}`, "2024-03-05"},
+		{`${{ input.when | date("unix") }}`, 1709634030},
+		{`${{ 0 | date }}`, "1970-01-01T00:00:00Z"},
+		{`${{ steps.fetch.output.items | length > 2 }}`, true},
+		{`id-${{ input.tags | first | upper }}`, "id-B"},
+		{`${{ input.none | upper }}`, ""},
+		{`${{ input.none | trim | default("anon") }}`, "anon"},
+		{`${{ input.none | replace("a", "b") }}`, ""},
+		{`${{ input.none | split }}`, []any{}},
+		{`${{ input.tags | join(input.none) }}`, "bac"},
+	}
+
+	for _, tt := range tests {
+		result, err := ctx.resolveString(tt.input)
+		if err != nil {
+			t.Errorf("resolveString(%q) error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual(result, tt.expected) {
+			t.Errorf("resolveString(%q) = %#v, want %#v", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestPipeErrors(t *testing.T) {
+	ctx := NewStepContext(map[string]any{"name": "acme", "n": 3})
+
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{`${{ input.name | nope }}`, `unknown pipe function "nope"`},
+		{`${{ input.name | default }}`, "pipe default: expects 1 argument(s), got 0"},
+		{`${{ input.name | upper("x") }}`, "pipe upper: expects 0 argument(s), got 1"},
+		{`${{ input.n | join }}`, "pipe join: expects an array, got number"},
+		{`${{ input.name | fromjson }}`, "pipe fromjson:"},
+		{`${{ input.name | date }}`, `cannot parse "acme" as a time`},
+	}
+
+	for _, tt := range tests {
+		_, err := ctx.resolveString(tt.input)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("resolveString(%q) error = %v, want %q", tt.input, err, tt.want)
+		}
+	}
+}
+
+func TestRegisterPipe(t *testing.T) {
+	RegisterPipe("repeat", func(val any, args []any) (any, error) {
+		return strings.Repeat(val.(string), int(args[0].(int))), nil
+	})
+	defer func() {
+		pipesMu.Lock()
+		delete(pipes, "repeat")
+		pipesMu.Unlock()
+	}()
+
+	ctx := NewStepContext(map[string]any{"s": "ab"})
+	result, err := ctx.resolveString(`${{ input.s | repeat(3) | upper }}`)
+	if err != nil || result != "ABABAB" {
+		t.Errorf("got %v, %v; want ABABAB", result, err)
+	}
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "a", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo ${{ input.s | repeat(2) }}"}},
+			{Name: "b", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo ${{ input.s | missing }}"},
+				When: "${{ input.s | nothere }}"},
+		},
+	}
+	err = ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected errors for unknown pipes")
+	}
+	for _, want := range []string{`unknown pipe function "missing"`, `when: invalid expression "input.s | nothere": unknown pipe function "nothere" at column 11`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "repeat") {
+		t.Errorf("registered pipe reported as unknown: %v", err)
+	}
+}
+
+func TestShellQuotePipe(t *testing.T) {
+	ctx := NewStepContext(map[string]any{
+		"name":  "it's $(rm -rf /)",
+		"files": []any{"a b", "c"},
+	})
+
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`echo ${{ input.name | shellquote }}`, `echo 'it'\''s $(rm -rf /)'`},
+		{`ls ${{ input.files | shellquote }}`, `ls 'a b' 'c'`},
+		{`cd ${{ input.missing | shellquote }}`, `cd ''`},
+	}
+	for _, tt := range tests {
+		result, err := ctx.resolveString(tt.input)
+		if err != nil || result != tt.expected {
+			t.Errorf("resolveString(%q) = %v, %v; want %q", tt.input, result, err, tt.expected)
+		}
+	}
+}
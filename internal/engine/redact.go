@@ -0,0 +1,238 @@
+package engine
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"piper/internal/types"
+)
+
+// redactedValue replaces secret values in results and logs.
+const redactedValue = "***"
+
+// MinSecretLength is the length below which secret values are not masked:
+// replacing every occurrence of a one- or two-character value would mangle
+// unrelated output.
+const MinSecretLength = 4
+
+// secretRefPrefix starts the references that stand in for secret values in
+// a run's stored state; see secretRef.
+const secretRefPrefix = "\x00secret."
+
+// redactor rewrites known secret values, and their common encodings, in text:
+// it masks them in results and logs, or swaps them with references for a
+// run's stored state and back.
+type redactor struct {
+	replace func(string) string
+}
+
+// newRedactor returns a redactor that masks the given secrets, or nil if
+// there is nothing to mask. A nil redactor leaves values unchanged.
+func newRedactor(secrets map[string]string) *redactor {
+	return newReplacer(secrets, func(string, int) string { return redactedValue })
+}
+
+// newReferencer returns a redactor that replaces the given secrets with
+// references to them, so a run's state can be stored without their values.
+func newReferencer(secrets map[string]string) *redactor {
+	return newReplacer(secrets, secretRef)
+}
+
+// newReplacer returns a redactor that replaces each form of each secret
+// with repl(name, form), where form indexes secretForms, or nil if there is
+// nothing to replace.
+func newReplacer(secrets map[string]string, repl func(name string, form int) string) *redactor {
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	seen := make(map[string]bool)
+	var pairs [][2]string
+	for _, name := range names {
+		value := secrets[name]
+		if len(value) < MinSecretLength {
+			continue
+		}
+		for i, form := range secretForms(value) {
+			if !seen[form] {
+				seen[form] = true
+				pairs = append(pairs, [2]string{form, repl(name, i)})
+			}
+		}
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	// Replace longer forms first, so a secret that contains another one is
+	// replaced as a whole.
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return len(pairs[i][0]) > len(pairs[j][0])
+	})
+	oldnew := make([]string, 0, 2*len(pairs))
+	for _, pair := range pairs {
+		oldnew = append(oldnew, pair[0], pair[1])
+	}
+	return &redactor{replace: strings.NewReplacer(oldnew...).Replace}
+}
+
+// secretRef returns the reference that stands in for the given form of a
+// secret in a run's stored state.
+func secretRef(name string, form int) string {
+	return secretRefPrefix + name + "." + strconv.Itoa(form) + "\x00"
+}
+
+// newRestorer returns a redactor that replaces secret references with the
+// current values of the secrets they name. References to secrets that are
+// no longer set are masked.
+func newRestorer(secrets map[string]string) *redactor {
+	return &redactor{replace: func(s string) string {
+		var b strings.Builder
+		for {
+			start := strings.Index(s, secretRefPrefix)
+			if start < 0 {
+				break
+			}
+			ref := s[start+len(secretRefPrefix):]
+			end := strings.IndexByte(ref, 0)
+			if end < 0 {
+				break
+			}
+			b.WriteString(s[:start])
+			b.WriteString(resolveSecretRef(ref[:end], secrets))
+			s = ref[end+1:]
+		}
+		if b.Len() == 0 {
+			return s
+		}
+		b.WriteString(s)
+		return b.String()
+	}}
+}
+
+// resolveSecretRef returns the secret form named by ref, "<name>.<form>".
+func resolveSecretRef(ref string, secrets map[string]string) string {
+	dot := strings.LastIndexByte(ref, '.')
+	if dot < 0 {
+		return redactedValue
+	}
+	value, ok := secrets[ref[:dot]]
+	form, err := strconv.Atoi(ref[dot+1:])
+	forms := secretForms(value)
+	if !ok || err != nil || form < 0 || form >= len(forms) {
+		return redactedValue
+	}
+	return forms[form]
+}
+
+// secretForms returns a secret value as it may appear in output: verbatim,
+// base64 encoded, URL encoded, hex encoded and escaped in JSON.
+func secretForms(value string) []string {
+	forms := []string{
+		value,
+		base64.StdEncoding.EncodeToString([]byte(value)),
+		base64.RawStdEncoding.EncodeToString([]byte(value)),
+		base64.URLEncoding.EncodeToString([]byte(value)),
+		base64.RawURLEncoding.EncodeToString([]byte(value)),
+		url.QueryEscape(value),
+		url.PathEscape(value),
+		hex.EncodeToString([]byte(value)),
+	}
+	if data, err := json.Marshal(value); err == nil {
+		forms = append(forms, string(data[1:len(data)-1]))
+	}
+	return forms
+}
+
+// String rewrites secrets in s.
+func (r *redactor) String(s string) string {
+	if r == nil {
+		return s
+	}
+	return r.replace(s)
+}
+
+// Value returns a copy of v with secrets rewritten in every string, including
+// map keys and the elements of nested maps and arrays.
+func (r *redactor) Value(v any) any {
+	if r == nil {
+		return v
+	}
+	switch val := v.(type) {
+	case string:
+		return r.String(val)
+	case map[string]any:
+		return r.Map(val)
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = r.Value(item)
+		}
+		return out
+	case []string:
+		out := make([]string, len(val))
+		for i, item := range val {
+			out[i] = r.String(item)
+		}
+		return out
+	case map[string]string:
+		out := make(map[string]string, len(val))
+		for k, item := range val {
+			out[r.String(k)] = r.String(item)
+		}
+		return out
+	}
+	return v
+}
+
+// Map returns a copy of m with secrets rewritten.
+func (r *redactor) Map(m map[string]any) map[string]any {
+	if r == nil || m == nil {
+		return m
+	}
+	out := make(map[string]any, len(m))
+	for k, v := range m {
+		out[r.String(k)] = r.Value(v)
+	}
+	return out
+}
+
+// Result rewrites secrets in a flow result before it is returned or stored:
+// in step outputs and errors, iteration items, the flow's input, output and
+// error, the results of compensation and cleanup steps, and child flows.
+func (r *redactor) Result(result *types.FlowResult) {
+	if r == nil || result == nil {
+		return
+	}
+	result.Input = r.Map(result.Input)
+	result.Output = r.Map(result.Output)
+	result.Error = r.String(result.Error)
+	result.OutputErrors = r.Value(result.OutputErrors).([]string)
+	for _, steps := range [][]types.StepResult{result.Steps, result.Compensations, result.OnFailure, result.Finally} {
+		for i := range steps {
+			r.step(&steps[i])
+		}
+	}
+}
+
+func (r *redactor) step(sr *types.StepResult) {
+	sr.Output = r.Map(sr.Output)
+	sr.Error = r.String(sr.Error)
+	for i := range sr.Iterations {
+		it := &sr.Iterations[i]
+		it.Item = r.Value(it.Item)
+		it.Output = r.Map(it.Output)
+		it.Error = r.String(it.Error)
+		for j := range it.Steps {
+			r.step(&it.Steps[j])
+		}
+	}
+	r.Result(sr.Child)
+}
@@ -0,0 +1,149 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"piper/internal/plugin"
+	"piper/internal/plugin/builtin"
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+func TestRedactor(t *testing.T) {
+	r := newRedactor(map[string]string{"API_KEY": "sk-test/123", "DB_PASSWORD": "pa\"ss word", "SHORT": "ab"})
+
+	tests := []struct {
+		in, want string
+	}{
+		{"key=sk-test/123", "key=***"},
+		{"Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("sk-test/123")), "Authorization: Basic ***"},
+		{"https://x.test/?key=sk-test%2F123", "https://x.test/?key=***"},
+		{`{"password":"pa\"ss word"}`, `{"password":"***"}`},
+		{"pa%22ss%20word", "***"},
+		{"ab stays", "ab stays"},
+	}
+	for _, tt := range tests {
+		if got := r.String(tt.in); got != tt.want {
+			t.Errorf("String(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if got := newRedactor(nil).String("sk-test/123"); got != "sk-test/123" {
+		t.Errorf("nil redactor changed the value: %q", got)
+	}
+
+	in := map[string]any{"list": []any{"sk-test/123", 42}, "nested": map[string]any{"sk-test/123": true}}
+	out := r.Map(in)
+	data, _ := json.Marshal(out)
+	if strings.Contains(string(data), "sk-test") {
+		t.Errorf("Map left a secret: %s", data)
+	}
+	if in["list"].([]any)[0] != "sk-test/123" {
+		t.Error("Map must not modify its argument")
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	secrets := map[string]string{"API_KEY": "sk-test/123"}
+	in := "key=sk-test/123 basic=" + base64.StdEncoding.EncodeToString([]byte("sk-test/123"))
+
+	stored := newReferencer(secrets).String(in)
+	if strings.Contains(stored, "sk-test") || strings.Contains(stored, "***") {
+		t.Fatalf("referenced = %q, want references in place of the secret", stored)
+	}
+	if got := newRestorer(secrets).String(stored); got != in {
+		t.Errorf("restored = %q, want %q", got, in)
+	}
+	if got := newRestorer(nil).String(stored); got != "key=*** basic=***" {
+		t.Errorf("restored without secrets = %q, want the references masked", got)
+	}
+}
+
+func TestEngineRedactsSecrets(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+	registry.Register(builtin.NewShellConnector())
+
+	eng := NewEngine(registry)
+	eng.Store = store.NewDirStore(t.TempDir())
+	eng.FlowLoader = func(name string) (*types.FlowDef, error) {
+		return &types.FlowDef{Name: name, Steps: []types.StepDef{
+			{Name: "log", Connector: "log", Action: "print", Input: map[string]any{"message": "${{ secret.API_KEY }}"}},
+		}}, nil
+	}
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "log", Connector: "log", Action: "print",
+				Input: map[string]any{"message": "key=${{ secret.API_KEY }}"}},
+			{Name: "child", Connector: "flow", Flow: "child"},
+			{Name: "each", Connector: "log", Action: "print", Foreach: `${{ secret.API_KEY | split(",") }}`,
+				Input: map[string]any{"message": "${{ item }}"}},
+			{Name: "fail", Connector: "shell", Action: "run", OnError: "continue",
+				Input: map[string]any{"command": "echo ${{ secret.API_KEY | base64encode }}; echo $0 >&2; exit 1"}},
+		},
+		Output: &types.SchemaDef{Properties: map[string]types.FieldDef{
+			"key": {Type: "string", Value: "${{ secret.API_KEY }}"},
+		}},
+	}
+
+	secrets := map[string]string{"API_KEY": "sk-test-123"}
+	result, err := eng.RunWithSecrets(context.Background(), flow, map[string]any{}, secrets)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	saved, err := eng.Store.Get(result.RunID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	for name, r := range map[string]*types.FlowResult{"returned": result, "stored": saved} {
+		data, _ := json.Marshal(r)
+		if strings.Contains(string(data), "sk-test-123") || strings.Contains(string(data), base64.StdEncoding.EncodeToString([]byte("sk-test-123"))) {
+			t.Errorf("%s result contains the secret: %s", name, data)
+		}
+	}
+	if got := result.Steps[0].Output["message"]; got != "key=***" {
+		t.Errorf("log message = %v, want key=***", got)
+	}
+	if got := result.Output["key"]; got != "***" {
+		t.Errorf("output key = %v, want ***", got)
+	}
+}
+
+func TestEngineDryRunMasksSecrets(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+
+	eng := NewEngine(registry)
+	eng.Strict = true
+
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "log", Connector: "log", Action: "print",
+				Input: map[string]any{"message": "key=${{ secret.API_KEY }}"}},
+		},
+	}
+
+	result, err := eng.DryRunWithSecrets(flow, nil, map[string]string{"API_KEY": "sk-test-123"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := result.Steps[0].Output["message"]; got != "key=***" {
+		t.Errorf("message = %v, want key=***", got)
+	}
+
+	result, err = eng.DryRun(flow, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if result.Steps[0].Status != "resolve_error" {
+		t.Errorf("status = %q, want resolve_error for a missing secret in strict mode", result.Steps[0].Status)
+	}
+}
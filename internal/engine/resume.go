@@ -0,0 +1,147 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+// Resume starts a new run of flow that continues a previous run. Steps that
+// succeeded in prev are restored from their stored results instead of being
+// executed again; execution starts at the first failed or unexecuted step,
+// or at the step named from (which, with everything after it, is re-run).
+func (e *Engine) Resume(ctx context.Context, flow *types.FlowDef, prev *types.FlowResult, from string, secrets map[string]string) (*types.FlowResult, error) {
+	if prev.Flow != flow.Name {
+		return nil, fmt.Errorf("run %s is of flow %q, not %q", prev.RunID, prev.Flow, flow.Name)
+	}
+	prev, err := e.unmasked(prev, secrets)
+	if err != nil {
+		return nil, err
+	}
+	if prev.Input == nil {
+		prev.Input = make(map[string]any)
+	}
+	if err := ValidateInput(flow, prev.Input); err != nil {
+		return nil, err
+	}
+	if err := checkRequiredSecrets(flow, secrets); err != nil {
+		return nil, err
+	}
+
+	restored, err := restoredSteps(flow, prev, from)
+	if err != nil {
+		return nil, err
+	}
+	if len(restored) == len(flow.Steps) {
+		return nil, fmt.Errorf("run %s has no failed or unexecuted steps; use --from to re-run a step", prev.RunID)
+	}
+
+	result := &types.FlowResult{
+		RunID:       store.NewRunID(),
+		Flow:        flow.Name,
+		Status:      "success",
+		StartedAt:   time.Now().UTC(),
+		Input:       prev.Input,
+		Steps:       make([]types.StepResult, 0, len(flow.Steps)),
+		ResumedFrom: prev.RunID,
+	}
+	sctx := NewStepContext(prev.Input)
+	if secrets != nil {
+		sctx.Secrets = secrets
+	}
+
+	restoreResults(flow, prev, restored, result, sctx, true)
+
+	result, err = e.runWithContext(ctx, flow, result, sctx, restored)
+	if err != nil {
+		return nil, err
+	}
+	return e.persist(result, secrets)
+}
+
+// restoredSteps returns the top-level steps of flow whose results in prev can
+// be reused: steps that succeeded (or were skipped) and whose upstream steps
+// are all restored too. Steps waiting for approval are not restored, and
+// neither is the step named from.
+func restoredSteps(flow *types.FlowDef, prev *types.FlowResult, from string) (map[string]bool, error) {
+	nodeOf := stepNodes(flow.Steps)
+	if from != "" {
+		node, ok := nodeOf[from]
+		if !ok {
+			return nil, fmt.Errorf("step %q not found in flow %q", from, flow.Name)
+		}
+		from = node
+	}
+
+	completed := make(map[string]bool)
+	failed := make(map[string]bool)
+	for _, sr := range prev.Steps {
+		node, ok := nodeOf[sr.Name]
+		if !ok {
+			continue
+		}
+		if isFailure(sr.Status) || sr.Status == "waiting_approval" {
+			failed[node] = true
+		} else {
+			completed[node] = true
+		}
+	}
+
+	order := flow.Steps
+	deps := make(map[string][]string)
+	if usesDependencies(flow.Steps) {
+		g, err := buildGraph(flow.Steps)
+		if err != nil {
+			return nil, err
+		}
+		order = g.topoOrder()
+		deps = g.deps
+	} else {
+		for i := 1; i < len(flow.Steps); i++ {
+			deps[flow.Steps[i].Name] = []string{flow.Steps[i-1].Name}
+		}
+	}
+
+	restored := make(map[string]bool)
+	for _, step := range order {
+		name := step.Name
+		if name == from || !completed[name] || failed[name] {
+			continue
+		}
+		ok := true
+		for _, dep := range deps[name] {
+			if !restored[dep] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			restored[name] = true
+		}
+	}
+	return restored, nil
+}
+
+// restoreResults copies the results of restored steps from prev into result
+// and sctx, optionally marking them as restored.
+func restoreResults(flow *types.FlowDef, prev *types.FlowResult, restored map[string]bool, result *types.FlowResult, sctx *StepContext, mark bool) {
+	nodeOf := stepNodes(flow.Steps)
+	for _, sr := range prev.Steps {
+		if !restored[nodeOf[sr.Name]] {
+			continue
+		}
+		sr.Restored = mark
+		result.Steps = append(result.Steps, sr)
+		sctx.AddStepResult(sr.Name, &sr)
+		// Loop blocks record their nested steps per iteration; the last
+		// iteration holds the values later steps saw.
+		if n := len(sr.Iterations); n > 0 {
+			for _, nested := range sr.Iterations[n-1].Steps {
+				sctx.AddStepResult(nested.Name, &nested)
+			}
+		}
+	}
+}
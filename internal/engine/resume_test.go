@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"piper/internal/plugin"
+	"piper/internal/plugin/builtin"
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+func resumeFlow(dir string, dependsOn bool) *types.FlowDef {
+	marker := filepath.Join(dir, "ok")
+	calls := filepath.Join(dir, "calls")
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "one", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo one >> " + calls + " && echo first"}},
+			{Name: "two", Connector: "shell", Action: "run", Input: map[string]any{"command": "test -f " + marker + " && echo ${{ steps.one.output.stdout }}-two"}},
+			{Name: "three", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo ${{ steps.two.output.stdout }}-three"}},
+		},
+	}
+	if dependsOn {
+		flow.Steps[1].DependsOn = []string{"one"}
+	}
+	return flow
+}
+
+func TestEngineResume(t *testing.T) {
+	for _, dag := range []bool{false, true} {
+		registry := plugin.NewRegistry()
+		registry.Register(builtin.NewShellConnector())
+		eng := NewEngine(registry)
+
+		dir := t.TempDir()
+		flow := resumeFlow(dir, dag)
+
+		first, err := eng.Run(context.Background(), flow, map[string]any{})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if first.Status != "failed" {
+			t.Fatalf("first run status = %q, want failed", first.Status)
+		}
+
+		os.WriteFile(filepath.Join(dir, "ok"), nil, 0o644)
+		result, err := eng.Resume(context.Background(), flow, first, "", nil)
+		if err != nil {
+			t.Fatalf("resume: %v", err)
+		}
+		if result.Status != "success" || result.ResumedFrom != first.RunID {
+			t.Errorf("status = %q, resumed_from = %q; want success from %q", result.Status, result.ResumedFrom, first.RunID)
+		}
+		if len(result.Steps) != 3 || !result.Steps[0].Restored || result.Steps[1].Restored {
+			t.Fatalf("steps = %+v, want one restored and two, three executed", result.Steps)
+		}
+		if got := result.Steps[2].Output["stdout"]; got != "first-two-three" {
+			t.Errorf("three stdout = %v, want first-two-three", got)
+		}
+		calls, _ := os.ReadFile(filepath.Join(dir, "calls"))
+		if n := strings.Count(string(calls), "one"); n != 1 {
+			t.Errorf("step one ran %d times, want 1 (dag=%v)", n, dag)
+		}
+	}
+}
+
+func TestEngineResumeFrom(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	eng := NewEngine(registry)
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ok"), nil, 0o644)
+	flow := resumeFlow(dir, false)
+
+	first, err := eng.Run(context.Background(), flow, map[string]any{})
+	if err != nil || first.Status != "success" {
+		t.Fatalf("first run: %v, status %q", err, first.Status)
+	}
+
+	if _, err := eng.Resume(context.Background(), flow, first, "", nil); err == nil {
+		t.Error("expected error resuming a run without failed steps")
+	}
+	if _, err := eng.Resume(context.Background(), flow, first, "missing", nil); err == nil {
+		t.Error("expected error for unknown --from step")
+	}
+
+	result, err := eng.Resume(context.Background(), flow, first, "two", nil)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	restored := 0
+	for _, sr := range result.Steps {
+		if sr.Restored {
+			restored++
+		}
+	}
+	if restored != 1 || len(result.Steps) != 3 {
+		t.Errorf("got %d steps with %d restored, want 3 with 1 restored", len(result.Steps), restored)
+	}
+}
+
+func TestEngineResumeRestoresSecretOutputs(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewShellConnector())
+	eng := NewEngine(registry)
+	runsDir := t.TempDir()
+	eng.Store = store.NewDirStore(runsDir)
+
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "ok")
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "token", Connector: "shell", Action: "run", Input: map[string]any{"command": "echo token=${{ secret.API_KEY }}"}},
+			{Name: "use", Connector: "shell", Action: "run", Input: map[string]any{"command": "test -f " + marker + " && echo ${{ steps.token.output.stdout }} > " + filepath.Join(dir, "used")}},
+		},
+	}
+	secrets := map[string]string{"API_KEY": "sk-test-123"}
+
+	first, err := eng.RunWithSecrets(context.Background(), flow, map[string]any{}, secrets)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if first.Status != "failed" || first.Steps[0].Output["stdout"] != "token=***" {
+		t.Fatalf("first run: status %q, token stdout %v; want failed with masked stdout", first.Status, first.Steps[0].Output["stdout"])
+	}
+
+	state, err := os.ReadFile(filepath.Join(runsDir, ".state", first.RunID+".json"))
+	if err != nil {
+		t.Fatalf("reading run state: %v", err)
+	}
+	if strings.Contains(string(state), "sk-test-123") {
+		t.Errorf("run state contains the secret value: %s", state)
+	}
+
+	os.WriteFile(marker, nil, 0o644)
+	prev, err := eng.Store.Get(first.RunID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	result, err := eng.Resume(context.Background(), flow, prev, "", secrets)
+	if err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if result.Status != "success" || !result.Steps[0].Restored {
+		t.Fatalf("status = %q, steps = %+v; want success with token restored", result.Status, result.Steps)
+	}
+	used, _ := os.ReadFile(filepath.Join(dir, "used"))
+	if got := strings.TrimSpace(string(used)); got != "token=sk-test-123" {
+		t.Errorf("resumed step read %q, want the unmasked output", got)
+	}
+	if got := result.Steps[0].Output["stdout"]; got != "token=***" {
+		t.Errorf("restored stdout = %v, want it masked in the result", got)
+	}
+}
@@ -0,0 +1,402 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"piper/internal/types"
+)
+
+// matchesType reports whether v is a valid value for a schema type.
+// An empty type or "any" accepts every value.
+func matchesType(v any, typ string) bool {
+	switch typ {
+	case "", "any":
+		return true
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "integer":
+		f, ok := toFloat(v)
+		return ok && f == float64(int64(f))
+	case "number":
+		_, ok := toFloat(v)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		if v == nil {
+			return false
+		}
+		kind := reflect.TypeOf(v).Kind()
+		return kind == reflect.Slice || kind == reflect.Array
+	}
+	return false
+}
+
+// toFloat converts any Go numeric value to float64.
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int8:
+		return float64(n), true
+	case int16:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint:
+		return float64(n), true
+	case uint8:
+		return float64(n), true
+	case uint16:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// coerceScalar converts a string to an integer, number or boolean when the
+// declared type asks for one, e.g. a shell step's stdout mapped to an
+// integer output. Other values are returned unchanged.
+func coerceScalar(v any, typ string) (any, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+	s = strings.TrimSpace(s)
+	switch typ {
+	case "integer":
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to integer", s)
+		}
+		return int(n), nil
+	case "number":
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to number", s)
+		}
+		return f, nil
+	case "boolean":
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert %q to boolean", s)
+		}
+		return b, nil
+	}
+	return v, nil
+}
+
+// coerceValue converts string values to the declared types of a field, so
+// input from form bodies or hand-written JSON ("42", "true", "a,b,c") reaches
+// steps correctly typed. Arrays are read from JSON or comma-separated
+// strings, objects from JSON strings, and nested properties and array items
+// are coerced recursively. Values that cannot be converted are returned
+// unchanged and reported by validateValue.
+func coerceValue(v any, field types.FieldDef) any {
+	if s, ok := v.(string); ok {
+		switch field.Type {
+		case "integer", "number", "boolean":
+			if c, err := coerceScalar(s, field.Type); err == nil {
+				v = c
+			}
+		case "array":
+			v = coerceArray(s)
+		case "object":
+			var m map[string]any
+			if err := json.Unmarshal([]byte(s), &m); err == nil && m != nil {
+				v = m
+			}
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		coerceObject(val, field.Properties)
+	case []any:
+		if field.Items != nil {
+			out := make([]any, len(val))
+			for i, item := range val {
+				out[i] = coerceValue(item, *field.Items)
+			}
+			v = out
+		}
+	}
+	return v
+}
+
+// coerceObject coerces the fields of m in place.
+func coerceObject(m map[string]any, fields map[string]types.FieldDef) {
+	for name, field := range fields {
+		if v, ok := m[name]; ok && v != nil {
+			m[name] = coerceValue(v, field)
+		}
+	}
+}
+
+// coerceArray reads an array from a JSON array string or a comma-separated
+// list. An empty string is an empty array.
+func coerceArray(s string) any {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return []any{}
+	}
+	if strings.HasPrefix(s, "[") {
+		var list []any
+		if err := json.Unmarshal([]byte(s), &list); err == nil {
+			return list
+		}
+	}
+	parts := strings.Split(s, ",")
+	list := make([]any, len(parts))
+	for i, p := range parts {
+		list[i] = strings.TrimSpace(p)
+	}
+	return list
+}
+
+// validateValue checks v against a field's type and constraints, recording
+// every violation in ve. kind and path name the value in messages, e.g.
+// input "user.email". Missing fields of nested objects are filled from their
+// defaults.
+func validateValue(kind, path string, v any, field types.FieldDef, ve *ValidationError) {
+	fail := func(format string, args ...any) {
+		ve.errorf("invalid-value", "", "", "%s %q: %s", kind, path, fmt.Sprintf(format, args...))
+	}
+
+	if !matchesType(v, field.Type) {
+		if str, ok := v.(string); ok && field.Type != "string" {
+			fail("cannot convert %q to %s", str, field.Type)
+		} else {
+			fail("expected %s, got %s", field.Type, typeName(v))
+		}
+		return
+	}
+
+	if len(field.Enum) > 0 {
+		// Untyped fields accept "200" for an enum value of 200.
+		found := false
+		for _, allowed := range field.Enum {
+			if valuesEqual(v, allowed, false) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("%s is not one of %s", formatValue(v), formatEnum(field.Enum))
+		}
+	}
+
+	if s, ok := v.(string); ok {
+		n := utf8.RuneCountInString(s)
+		if field.MinLength != nil && n < *field.MinLength {
+			fail("must be at least %d characters", *field.MinLength)
+		}
+		if field.MaxLength != nil && n > *field.MaxLength {
+			fail("must be at most %d characters", *field.MaxLength)
+		}
+		if field.Pattern != "" {
+			re, err := regexp.Compile(field.Pattern)
+			if err != nil {
+				fail("invalid pattern %q: %v", field.Pattern, err)
+			} else if !re.MatchString(s) {
+				fail("%q does not match pattern %q", s, field.Pattern)
+			}
+		}
+		if field.Format != "" && !matchesFormat(s, field.Format) {
+			fail("%q is not a valid %s", s, field.Format)
+		}
+	}
+
+	if f, ok := toFloat(v); ok {
+		if field.Minimum != nil && f < *field.Minimum {
+			fail("must be >= %v", *field.Minimum)
+		}
+		if field.Maximum != nil && f > *field.Maximum {
+			fail("must be <= %v", *field.Maximum)
+		}
+	}
+
+	if m, ok := v.(map[string]any); ok && len(field.Properties) > 0 {
+		validateObject(kind, path+".", m, field.Properties, ve)
+	}
+
+	if field.Items != nil {
+		if list, ok := asList(v); ok {
+			for i, item := range list {
+				validateValue(kind, fmt.Sprintf("%s[%d]", path, i), item, *field.Items, ve)
+			}
+		}
+	}
+}
+
+// validateObject applies defaults to the missing fields of m, reports
+// missing required fields and validates the present ones. prefix is
+// prepended to field names in messages.
+func validateObject(kind, prefix string, m map[string]any, fields map[string]types.FieldDef, ve *ValidationError) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		field := fields[name]
+		// A null value counts as missing, as optional arguments are often
+		// sent as null.
+		v := m[name]
+		if v == nil && field.Default != nil {
+			v = cloneValue(field.Default)
+			m[name] = v
+		}
+		if v == nil {
+			if field.Required {
+				ve.errorf("missing-field", "", "", "required %s field %q is missing", kind, prefix+name)
+			}
+			continue
+		}
+		validateValue(kind, prefix+name, v, field, ve)
+	}
+}
+
+// matchesFormat checks a string against a JSON Schema format. Unknown
+// formats are accepted.
+func matchesFormat(s, format string) bool {
+	switch format {
+	case "email":
+		addr, err := mail.ParseAddress(s)
+		return err == nil && addr.Address == s
+	case "uri", "url":
+		u, err := url.Parse(s)
+		return err == nil && u.Scheme != "" && (u.Host != "" || u.Opaque != "")
+	case "date":
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	case "date-time":
+		_, err := time.Parse(time.RFC3339, s)
+		return err == nil
+	case "time":
+		_, err := time.Parse("15:04:05", s)
+		return err == nil
+	case "duration":
+		_, err := time.ParseDuration(s)
+		return err == nil
+	case "ipv4":
+		ip, err := netip.ParseAddr(s)
+		return err == nil && ip.Is4()
+	case "ipv6":
+		ip, err := netip.ParseAddr(s)
+		return err == nil && ip.Is6()
+	case "hostname":
+		return hostnameRegex.MatchString(s) && len(s) <= 253
+	case "uuid":
+		return uuidRegex.MatchString(s)
+	}
+	return true
+}
+
+var (
+	hostnameRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?(\.[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?)*$`)
+	uuidRegex     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+// checkSchema reports schema definitions that can never validate: unknown
+// types, invalid patterns and defaults that violate their own field.
+func checkSchema(kind, prefix string, fields map[string]types.FieldDef, ve *ValidationError) {
+	for name, field := range fields {
+		path := prefix + name
+		// Locate problems at the top-level property they belong to, or at
+		// the properties when the path has no usable name.
+		top := kind + ".properties"
+		if parts := strings.FieldsFunc(path, func(r rune) bool { return r == '.' || r == '[' }); len(parts) > 0 {
+			top += "." + parts[0]
+		}
+		// Array items are checked under an empty name.
+		if name == "" && !strings.HasSuffix(prefix, "[]") {
+			ve.errorf("invalid-schema", "", top, "%s schema: field %q: property names must not be empty", kind, path)
+			continue
+		}
+		switch field.Type {
+		case "", "any", "string", "integer", "number", "boolean", "object", "array":
+		default:
+			ve.errorf("invalid-schema", "", top, "%s schema: field %q: unknown type %q", kind, path, field.Type)
+			continue
+		}
+		if field.Pattern != "" {
+			if _, err := regexp.Compile(field.Pattern); err != nil {
+				ve.errorf("invalid-schema", "", top, "%s schema: field %q: invalid pattern %q: %v", kind, path, field.Pattern, err)
+				continue
+			}
+		}
+		if field.Default != nil {
+			dve := &ValidationError{}
+			validateValue("default for", path, cloneValue(field.Default), field, dve)
+			for _, msg := range dve.Errors {
+				ve.errorf("invalid-schema", "", top, "%s schema: %s", kind, msg)
+			}
+		}
+		checkSchema(kind, path+".", field.Properties, ve)
+		if field.Items != nil {
+			checkSchema(kind, path+"[]", map[string]types.FieldDef{"": *field.Items}, ve)
+		}
+	}
+}
+
+// cloneValue deep-copies maps and slices so defaults from a flow definition
+// are never modified by a run.
+func cloneValue(v any) any {
+	switch val := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, item := range val {
+			out[k] = cloneValue(item)
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, item := range val {
+			out[i] = cloneValue(item)
+		}
+		return out
+	}
+	return v
+}
+
+func formatValue(v any) string {
+	if s, ok := v.(string); ok {
+		return strconv.Quote(s)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func formatEnum(values []any) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		parts[i] = formatValue(v)
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
@@ -1,50 +1,127 @@
 package engine
 
 import (
-	"bufio"
 	"fmt"
-	"os"
+	"sort"
 	"strings"
+
+	"piper/internal/secrets"
+	"piper/internal/types"
 )
 
 // LoadSecrets reads a .env-style secrets file (KEY=VALUE per line).
 // Lines starting with # are comments. Empty lines are skipped.
 func LoadSecrets(path string) (map[string]string, error) {
-	secrets := make(map[string]string)
+	return (&secrets.EnvFile{Path: path}).Load()
+}
 
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, fmt.Errorf("opening secrets file: %w", err)
+// SecretRefs returns the names of the secrets the flows reference with
+// ${{ secret.KEY }}, declare in requires_secrets or pass to a child flow,
+// sorted, so that only those need to be loaded or decrypted for a run.
+func SecretRefs(flows ...*types.FlowDef) []string {
+	seen := make(map[string]bool)
+	collect := func(nodes []exprNode) {
+		for _, node := range nodes {
+			walkExpr(node, func(n exprNode) {
+				if p, ok := n.(*pathNode); ok && p.root == "secret" && len(p.segments) == 1 && p.segments[0].kind == segKey {
+					seen[p.segments[0].key] = true
+				}
+			})
+		}
 	}
-	defer f.Close()
 
-	scanner := bufio.NewScanner(f)
-	lineNum := 0
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	for _, flow := range flows {
+		for _, name := range flow.RequiresSecrets {
+			seen[name] = true
 		}
-
-		key, value, ok := strings.Cut(line, "=")
-		if !ok {
-			return nil, fmt.Errorf("secrets file line %d: invalid format (expected KEY=VALUE)", lineNum)
+		visitSteps(flow, func(step types.StepDef) {
+			for _, name := range step.Secrets {
+				seen[name] = true
+			}
+			collect(templateNodes(step.Input))
+			collect(templateNodes(step.Foreach))
+			collect(conditionNodes(step.When))
+			if step.Loop != nil {
+				collect(conditionNodes(step.Loop.Until))
+				collect(conditionNodes(step.Loop.While))
+			}
+		})
+		if flow.Output != nil {
+			for _, field := range flow.Output.Properties {
+				collect(templateNodes(field.Value))
+			}
 		}
+	}
 
-		key = strings.TrimSpace(key)
-		value = strings.TrimSpace(value)
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
 
-		// Strip surrounding quotes.
-		if len(value) >= 2 {
-			if (value[0] == '"' && value[len(value)-1] == '"') ||
-				(value[0] == '\'' && value[len(value)-1] == '\'') {
-				value = value[1 : len(value)-1]
+// ReachableFlows returns flow followed by the flows it runs through flow
+// steps, directly or through other child flows, so that a run only needs the
+// secrets of those. Children that are not in flows are left out, since the
+// run cannot start them either. ok is false if a flow step names its child
+// with an expression, which is only resolved during the run.
+func ReachableFlows(flow *types.FlowDef, flows map[string]*types.FlowDef) (reached []*types.FlowDef, ok bool) {
+	ok = true
+	seen := map[string]bool{flow.Name: true}
+	queue := []*types.FlowDef{flow}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		reached = append(reached, current)
+		visitSteps(current, func(step types.StepDef) {
+			if step.Connector != "flow" {
+				return
 			}
-		}
+			name := step.Flow
+			if name == "" {
+				name, _ = step.Input["flow"].(string)
+			}
+			if strings.Contains(name, "${{") {
+				ok = false
+				return
+			}
+			if child, found := flows[name]; found && !seen[name] {
+				seen[name] = true
+				queue = append(queue, child)
+			}
+		})
+	}
+	return reached, ok
+}
 
-		secrets[key] = value
+// checkRequiredSecrets fails if one of the secrets a flow declares in
+// requires_secrets is missing or empty.
+func checkRequiredSecrets(flow *types.FlowDef, secrets map[string]string) error {
+	var missing []string
+	for _, name := range flow.RequiresSecrets {
+		if secrets[name] == "" {
+			missing = append(missing, name)
+		}
 	}
+	if len(missing) > 0 {
+		return fmt.Errorf("flow %q requires secrets that are not set: %s", flow.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
 
-	return secrets, scanner.Err()
+// childSecrets returns the secrets of a child flow run by a flow step: all
+// of the parent's, or, if the step has a secrets mapping, only the mapped
+// ones under their child names.
+func childSecrets(step types.StepDef, parent map[string]string) map[string]string {
+	if step.Secrets == nil {
+		return parent
+	}
+	secrets := make(map[string]string, len(step.Secrets))
+	for child, name := range step.Secrets {
+		if value, ok := parent[name]; ok {
+			secrets[child] = value
+		}
+	}
+	return secrets
 }
@@ -3,7 +3,10 @@ package engine
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+
+	"piper/internal/types"
 )
 
 func TestLoadSecrets(t *testing.T) {
@@ -54,3 +57,62 @@ func TestLoadSecretsInvalidFormat(t *testing.T) {
 		t.Fatal("expected error for invalid format")
 	}
 }
+
+func TestSecretRefs(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "deploy",
+		Steps: []types.StepDef{
+			{Name: "call", Connector: "http", Action: "request", Input: map[string]any{
+				"headers": map[string]any{"Authorization": "Bearer ${{ secret.API_KEY }}"},
+			}},
+			{Name: "check", Connector: "log", Action: "info", When: "secret.FEATURE == 'on'"},
+		},
+		Finally: []types.StepDef{
+			{Name: "notify", Connector: "log", Action: "info", Input: map[string]any{"message": "${{ secret.SLACK_TOKEN | base64encode }}"}},
+		},
+	}
+	other := &types.FlowDef{Name: "other", Steps: []types.StepDef{
+		{Name: "echo", Connector: "log", Action: "info", Input: map[string]any{"message": "${{ secret.API_KEY }} ${{ input.x }}"}},
+	}}
+
+	got := SecretRefs(flow, other)
+	want := []string{"API_KEY", "FEATURE", "SLACK_TOKEN"}
+	if len(got) != len(want) {
+		t.Fatalf("SecretRefs = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("SecretRefs = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestReachableFlows(t *testing.T) {
+	flows := map[string]*types.FlowDef{
+		"deploy": {Name: "deploy", Steps: []types.StepDef{
+			{Name: "build", Connector: "flow", Flow: "build"},
+			{Name: "again", Connector: "flow", Input: map[string]any{"flow": "build"}},
+		}},
+		"build": {Name: "build", Finally: []types.StepDef{
+			{Name: "notify", Connector: "flow", Flow: "notify"},
+		}},
+		"notify": {Name: "notify"},
+		"unused": {Name: "unused"},
+		"dynamic": {Name: "dynamic", Steps: []types.StepDef{
+			{Name: "child", Connector: "flow", Input: map[string]any{"flow": "${{ input.flow }}"}},
+		}},
+	}
+
+	reached, ok := ReachableFlows(flows["deploy"], flows)
+	var got []string
+	for _, f := range reached {
+		got = append(got, f.Name)
+	}
+	if !ok || strings.Join(got, ",") != "deploy,build,notify" {
+		t.Errorf("ReachableFlows(deploy) = %v, %v; want [deploy build notify], true", got, ok)
+	}
+
+	if _, ok := ReachableFlows(flows["dynamic"], flows); ok {
+		t.Error("ReachableFlows(dynamic) = ok, want false for a child named by an expression")
+	}
+}
@@ -0,0 +1,360 @@
+package engine
+
+import (
+	"sort"
+	"strings"
+
+	"piper/internal/plugin"
+	"piper/internal/types"
+)
+
+// typeScope infers the static types of expressions in one step. Types are
+// described by schema fields, so paths can descend into declared properties
+// and array items; an empty Type means the type is unknown.
+type typeScope struct {
+	flow    *types.FlowDef
+	outputs map[string]stepOutput
+	vars    map[string]types.FieldDef
+}
+
+// checkTypes propagates types from the input schema and the connector output
+// schemas through the flow's expressions and pipes, and warns about
+// expressions that are likely to misbehave at runtime: strings compared
+// numerically, objects and arrays interpolated into strings, foreach targets
+// that are not arrays and expressions whose type does not match the action
+// input they are passed to. Unknown types are never reported.
+func checkTypes(flow *types.FlowDef, registry *plugin.Registry, ve *ValidationError) {
+	outputs := make(map[string]stepOutput)
+	visitSteps(flow, func(step types.StepDef) {
+		if out, ok := knownStepOutput(step, registry); ok && step.Name != "" {
+			outputs[step.Name] = out
+		}
+	})
+
+	visitSteps(flow, func(step types.StepDef) {
+		ts := &typeScope{flow: flow, outputs: outputs, vars: map[string]types.FieldDef{}}
+		if step.Loop != nil || step.Foreach != "" {
+			ts.vars["loop"] = types.FieldDef{Type: "object", Properties: map[string]types.FieldDef{"index": {Type: "integer"}}}
+		}
+		if step.Foreach != "" {
+			ts.checkForeach(step, ve)
+		}
+
+		var action plugin.ActionDef
+		if a, ok := lookupAction(registry, step.Connector, step.Action); ok {
+			action = a
+		}
+		names := make([]string, 0, len(step.Input))
+		for name := range step.Input {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ts.checkValue(step.Name, "input."+name, step.Input[name], ve)
+			if field, ok := action.Input[name]; ok {
+				ts.checkActionInputType(step, name, field, ve)
+			}
+		}
+
+		ts.checkCondition(step.Name, "when", step.When, ve)
+		if step.Loop != nil {
+			ts.checkCondition(step.Name, "loop.until", step.Loop.Until, ve)
+			ts.checkCondition(step.Name, "loop.while", step.Loop.While, ve)
+		}
+	})
+}
+
+// checkForeach warns when a foreach target is known not to be an array (or
+// a string, which may hold a JSON array), and binds the loop variable to the
+// element type.
+func (ts *typeScope) checkForeach(step types.StepDef, ve *ValidationError) {
+	as := step.As
+	if as == "" {
+		as = "item"
+	}
+	ts.vars[as] = types.FieldDef{}
+
+	node, whole := wholeExpression(step.Foreach)
+	if !whole {
+		return
+	}
+	ts.checkComparisons(step.Name, "foreach", node, ve)
+	t := ts.infer(node)
+	switch t.Type {
+	case "", "array", "string":
+	default:
+		ve.stepWarnf("foreach-type", step.Name, "foreach", "foreach: %s is %s, not an array", exprText(node), withArticle(t.Type))
+	}
+	if t.Type == "array" && t.Items != nil {
+		ts.vars[as] = *t.Items
+	}
+}
+
+// checkValue checks the expressions in an input value, warning about
+// objects and arrays that are interpolated into a longer string.
+func (ts *typeScope) checkValue(step, field string, v any, ve *ValidationError) {
+	switch val := v.(type) {
+	case string:
+		nodes, err := parseTemplate(val)
+		if err != nil {
+			return // reported with the step's references
+		}
+		_, whole := wholeExpression(val)
+		for _, node := range nodes {
+			ts.checkComparisons(step, field, node, ve)
+			if whole {
+				continue
+			}
+			if t := ts.infer(node).Type; t == "object" || t == "array" {
+				ve.stepWarnf("object-interpolation", step, field, "%s: %s %s is interpolated into a string; select a field or use | json", field, t, exprText(node))
+			}
+		}
+	case map[string]any:
+		for k, item := range val {
+			ts.checkValue(step, field+"."+k, item, ve)
+		}
+	case []any:
+		for _, item := range val {
+			ts.checkValue(step, field, item, ve)
+		}
+	}
+}
+
+// checkActionInputType warns when a whole-value expression passed to an
+// action input has a type the action does not accept.
+func (ts *typeScope) checkActionInputType(step types.StepDef, name string, field types.FieldDef, ve *ValidationError) {
+	s, ok := step.Input[name].(string)
+	if !ok {
+		return
+	}
+	node, whole := wholeExpression(s)
+	if !whole {
+		return
+	}
+	if t := ts.infer(node).Type; !typeCompatible(t, field.Type) {
+		ve.stepWarnf("input-type", step.Name, "input."+name, "input %q: %s is %s, but %s.%s expects %s",
+			name, exprText(node), withArticle(t), step.Connector, step.Action, withArticle(field.Type))
+	}
+}
+
+func (ts *typeScope) checkCondition(step, field, cond string, ve *ValidationError) {
+	for _, node := range conditionNodes(cond) {
+		ts.checkComparisons(step, field, node, ve)
+	}
+}
+
+// checkComparisons warns about ordering comparisons between a string and a
+// number, which only work when the string holds a number.
+func (ts *typeScope) checkComparisons(step, field string, node exprNode, ve *ValidationError) {
+	walkExpr(node, func(n exprNode) {
+		c, ok := n.(*compareNode)
+		if !ok || (c.op != "<" && c.op != "<=" && c.op != ">" && c.op != ">=") {
+			return
+		}
+		left, right := ts.infer(c.left).Type, ts.infer(c.right).Type
+		str, num := c.left, c.right
+		if right == "string" {
+			str, num = c.right, c.left
+			left, right = right, left
+		}
+		if left == "string" && (right == "integer" || right == "number") {
+			ve.stepWarnf("string-comparison", step, field, "%s: string %s is compared numerically with %s; this fails unless it holds a number",
+				field, exprText(str), exprText(num))
+		}
+	})
+}
+
+// infer returns the static type of an expression.
+func (ts *typeScope) infer(node exprNode) types.FieldDef {
+	switch n := node.(type) {
+	case *literalNode:
+		return types.FieldDef{Type: valueType(n.value)}
+	case *pathNode:
+		return ts.pathType(n)
+	case *listNode:
+		return types.FieldDef{Type: "array"}
+	case *notNode, *logicNode, *compareNode:
+		return types.FieldDef{Type: "boolean"}
+	case *pipeNode:
+		return ts.pipeType(n)
+	}
+	return types.FieldDef{}
+}
+
+func (ts *typeScope) pathType(p *pathNode) types.FieldDef {
+	switch p.root {
+	case "input":
+		if ts.flow.Input == nil {
+			return types.FieldDef{}
+		}
+		return descendType(types.FieldDef{Type: "object", Properties: ts.flow.Input.Properties}, p.segments)
+	case "env", "secret":
+		return types.FieldDef{Type: "string"}
+	case "steps":
+		if len(p.segments) < 2 || p.segments[0].kind != segKey || p.segments[1].kind != segKey {
+			return types.FieldDef{}
+		}
+		switch p.segments[1].key {
+		case "status":
+			return types.FieldDef{Type: "string"}
+		case "output":
+			out, ok := ts.outputs[p.segments[0].key]
+			if !ok {
+				return types.FieldDef{}
+			}
+			return descendType(types.FieldDef{Type: "object", Properties: out.fields}, p.segments[2:])
+		}
+		return types.FieldDef{}
+	}
+	if v, ok := ts.vars[p.root]; ok {
+		return descendType(v, p.segments)
+	}
+	return types.FieldDef{}
+}
+
+// descendType follows path segments through declared properties and array
+// items. Wildcards and filters yield arrays.
+func descendType(t types.FieldDef, segments []pathSegment) types.FieldDef {
+	for i, seg := range segments {
+		switch seg.kind {
+		case segKey:
+			if t.Type == "array" && t.Items != nil && isIndexKey(seg.key) {
+				t = *t.Items
+				continue
+			}
+			field, ok := t.Properties[seg.key]
+			if t.Type != "object" || !ok {
+				return types.FieldDef{}
+			}
+			t = field
+		case segIndex:
+			if t.Type != "array" || t.Items == nil {
+				return types.FieldDef{}
+			}
+			t = *t.Items
+		case segWildcard, segFilter:
+			var items types.FieldDef
+			if t.Type == "array" && t.Items != nil {
+				items = descendType(*t.Items, segments[i+1:])
+			}
+			return types.FieldDef{Type: "array", Items: &items}
+		}
+	}
+	if t.Type == "any" {
+		t.Type = ""
+	}
+	return t
+}
+
+func isIndexKey(key string) bool {
+	for _, c := range key {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// pipeType returns the result type of a built-in pipe. Pipes registered by
+// the program have unknown result types.
+func (ts *typeScope) pipeType(p *pipeNode) types.FieldDef {
+	switch p.name {
+	case "slugify", "upper", "lower", "trim", "urlencode", "base64encode", "base64decode",
+		"shellquote", "sha256", "json", "join", "replace", "truncate":
+		return types.FieldDef{Type: "string"}
+	case "length":
+		return types.FieldDef{Type: "integer"}
+	case "split":
+		return types.FieldDef{Type: "array", Items: &types.FieldDef{Type: "string"}}
+	case "keys":
+		return types.FieldDef{Type: "array", Items: &types.FieldDef{Type: "string"}}
+	case "first", "last":
+		if in := ts.infer(p.input); in.Type == "array" && in.Items != nil {
+			return *in.Items
+		}
+	case "default":
+		in := ts.infer(p.input)
+		if len(p.args) == 1 && in.Type == ts.infer(p.args[0]).Type {
+			return in
+		}
+	case "date":
+		if len(p.args) == 1 {
+			if lit, ok := p.args[0].(*literalNode); ok && lit.value == "unix" {
+				return types.FieldDef{Type: "integer"}
+			}
+		}
+		return types.FieldDef{Type: "string"}
+	}
+	return types.FieldDef{}
+}
+
+// valueType returns the schema type of a literal value.
+func valueType(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int, int64:
+		return "integer"
+	case float64:
+		if val == float64(int64(val)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return ""
+}
+
+// typeCompatible reports whether a value of type actual is accepted where
+// expected is declared. Unknown types are always compatible.
+func typeCompatible(actual, expected string) bool {
+	switch {
+	case actual == "" || expected == "" || expected == "any" || actual == expected:
+		return true
+	case actual == "integer" && expected == "number":
+		return true
+	case actual == "null":
+		return true
+	}
+	return false
+}
+
+// wholeExpression returns the expression of a string that consists of a
+// single ${{ }}, whose value keeps its type when resolved.
+func wholeExpression(s string) (exprNode, bool) {
+	match := exprRegex.FindStringSubmatch(s)
+	if match == nil || match[0] != s {
+		return nil, false
+	}
+	node, err := parseExpr(match[1])
+	if err != nil {
+		return nil, false
+	}
+	return node, true
+}
+
+// exprText renders an expression for messages.
+func exprText(node exprNode) string {
+	switch n := node.(type) {
+	case *literalNode:
+		return formatValue(n.value)
+	case *pathNode:
+		return n.raw
+	case *pipeNode:
+		return exprText(n.input) + " | " + n.name
+	}
+	return "expression"
+}
+
+func withArticle(typ string) string {
+	if typ == "" {
+		return "unknown"
+	}
+	if strings.ContainsRune("aeiou", rune(typ[0])) {
+		return "an " + typ
+	}
+	return "a " + typ
+}
@@ -0,0 +1,99 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+
+	"piper/internal/types"
+)
+
+func TestCheckFlowTypeWarnings(t *testing.T) {
+	user := types.FieldDef{Type: "object", Properties: map[string]types.FieldDef{
+		"name": {Type: "string"},
+		"age":  {Type: "integer"},
+	}}
+	flow := &types.FlowDef{
+		Name: "test",
+		Input: &types.SchemaDef{Properties: map[string]types.FieldDef{
+			"count": {Type: "integer"},
+			"tags":  {Type: "array", Items: &types.FieldDef{Type: "string"}},
+			"users": {Type: "array", Items: &user},
+		}},
+		Steps: []types.StepDef{
+			{Name: "list", Connector: "shell", Action: "run", Input: map[string]any{"command": "ls"}},
+			{Name: "compare", Connector: "log", Action: "print", When: "${{ steps.list.output.stdout > 3 }}",
+				Input: map[string]any{"message": "${{ steps.list.output.exit_code >= input.count }}"}},
+			{Name: "each", Connector: "log", Action: "print", Foreach: "${{ input.count }}",
+				Input: map[string]any{"message": "tags: ${{ input.tags }}"}},
+			{Name: "users", Connector: "log", Action: "print", Foreach: "${{ input.users }}", As: "user",
+				Input: map[string]any{"message": "${{ user.name }} is ${{ user.age }}, in ${{ user | json }}: ${{ user }}"}},
+			{Name: "headers", Connector: "http", Action: "request", Input: map[string]any{
+				"url":     "https://example.com/${{ input.tags | join }}",
+				"headers": "${{ input.tags }}",
+			}},
+			{Name: "fine", Connector: "log", Action: "print", When: "${{ steps.list.output.stdout | length > 3 }}",
+				Input: map[string]any{"message": "${{ input.users[0].name }} ${{ input.users[*].age | first }}"}},
+		},
+	}
+
+	diags, err := CheckFlow(flow, testRegistry())
+	if err != nil {
+		t.Fatalf("type warnings must not fail validation: %v", err)
+	}
+	var got []string
+	for _, d := range diags {
+		if d.Severity == SeverityWarning {
+			got = append(got, d.Code+" "+d.Step+" "+d.Field+": "+d.Message)
+		}
+	}
+	want := []string{
+		`input-type compare input.message: step "compare": input "message": expression is a boolean, but log.print expects a string`,
+		`string-comparison compare when: step "compare": when: string steps.list.output.stdout is compared numerically with 3`,
+		`foreach-type each foreach: step "each": foreach: input.count is an integer, not an array`,
+		`object-interpolation each input.message: step "each": input.message: array input.tags is interpolated into a string`,
+		`object-interpolation users input.message: step "users": input.message: object user is interpolated into a string`,
+		`input-type headers input.headers: step "headers": input "headers": input.tags is an array, but http.request expects an object`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d warnings, want %d:\n%s", len(got), len(want), strings.Join(got, "\n"))
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("warning %d = %q, want prefix %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCheckFlowDiagnosticPositions(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		File: "flow.yaml",
+		Positions: map[string]types.Position{
+			"steps.fetch":           {Line: 3, Column: 5},
+			"steps.fetch.connector": {Line: 4, Column: 5},
+			"steps.late":            {Line: 9, Column: 5},
+			"steps.late.input":      {Line: 11, Column: 5},
+		},
+		Steps: []types.StepDef{
+			{Name: "late", Connector: "log", Action: "print", Input: map[string]any{"message": "${{ steps.nope.output }}"}},
+			{Name: "fetch", Connector: "nope", Action: "request"},
+		},
+	}
+
+	diags, err := CheckFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	if len(diags) != 2 {
+		t.Fatalf("expected 2 diagnostics, got %v", diags)
+	}
+	if d := diags[0]; d.Code != "unknown-connector" || d.Line != 4 || d.Column != 5 {
+		t.Errorf("diags[0] = %+v, want unknown-connector at 4:5", d)
+	}
+	if d := diags[1]; d.Code != "unknown-step" || d.Line != 11 || d.Field != "input.message" {
+		t.Errorf("diags[1] = %+v, want unknown-step at line 11", d)
+	}
+	if s := diags[0].String(); s != `flow.yaml:4:5: error: step "fetch": connector "nope" not found in registry [unknown-connector]` {
+		t.Errorf("String() = %q", s)
+	}
+}
@@ -1,24 +1,114 @@
 package engine
 
 import (
+	"errors"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"piper/internal/plugin"
 	"piper/internal/types"
 )
 
+// Diagnostic severities.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Diagnostic is a single validation finding. Step and Field locate it in the
+// flow definition (e.g. step "fetch", field "input.url"); File, Line and
+// Column are filled in from the positions recorded by the loader, when known.
+// Code identifies the kind of problem, e.g. "unknown-step".
+type Diagnostic struct {
+	File     string `json:"file,omitempty"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Message  string `json:"message"`
+	Step     string `json:"step,omitempty"`
+	Field    string `json:"field,omitempty"`
+}
+
+// String formats the diagnostic as "file:line:column: severity: message [code]",
+// leaving out the parts of the location that are not known.
+func (d Diagnostic) String() string {
+	var loc string
+	if d.File != "" {
+		loc = d.File + ":"
+	}
+	if d.Line > 0 {
+		loc += fmt.Sprintf("%d:%d:", d.Line, d.Column)
+	}
+	if loc != "" {
+		loc += " "
+	}
+	return fmt.Sprintf("%s%s: %s [%s]", loc, d.Severity, d.Message, d.Code)
+}
+
 // ValidationError collects multiple validation issues.
 type ValidationError struct {
 	Errors []string
+	// Warnings describe risky but valid constructs; they do not make the
+	// flow invalid.
+	Warnings []string
+	// Diagnostics holds the errors and warnings in the order they were found,
+	// with their codes and locations.
+	Diagnostics []Diagnostic
 }
 
 func (ve *ValidationError) Error() string {
 	return fmt.Sprintf("validation failed:\n  - %s", strings.Join(ve.Errors, "\n  - "))
 }
 
+// Add records an error without a code or location.
 func (ve *ValidationError) Add(msg string) {
-	ve.Errors = append(ve.Errors, msg)
+	ve.report(Diagnostic{Severity: SeverityError, Code: "invalid", Message: msg})
+}
+
+// Warn records a warning without a code or location.
+func (ve *ValidationError) Warn(msg string) {
+	ve.report(Diagnostic{Severity: SeverityWarning, Code: "warning", Message: msg})
+}
+
+func (ve *ValidationError) report(d Diagnostic) {
+	if d.Severity == SeverityError {
+		ve.Errors = append(ve.Errors, d.Message)
+	} else {
+		ve.Warnings = append(ve.Warnings, d.Message)
+	}
+	ve.Diagnostics = append(ve.Diagnostics, d)
+}
+
+// locateSince sets the location of the diagnostics recorded since index from
+// that have none, such as those from validateValue.
+func (ve *ValidationError) locateSince(from int, step, field string) {
+	for i := from; i < len(ve.Diagnostics); i++ {
+		if ve.Diagnostics[i].Step == "" && ve.Diagnostics[i].Field == "" {
+			ve.Diagnostics[i].Step, ve.Diagnostics[i].Field = step, field
+		}
+	}
+}
+
+// errorf records an error about a field of a step, or of the flow when step
+// is empty.
+func (ve *ValidationError) errorf(code, step, field, format string, args ...any) {
+	ve.report(Diagnostic{Severity: SeverityError, Code: code, Step: step, Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// stepErrorf records an error about a step, prefixing the message with the
+// step's name.
+func (ve *ValidationError) stepErrorf(code, step, field, format string, args ...any) {
+	ve.errorf(code, step, field, "step %q: %s", step, fmt.Sprintf(format, args...))
+}
+
+// stepWarnf records a warning about a step, prefixing the message with the
+// step's name.
+func (ve *ValidationError) stepWarnf(code, step, field, format string, args ...any) {
+	ve.report(Diagnostic{Severity: SeverityWarning, Code: code, Step: step, Field: field,
+		Message: fmt.Sprintf("step %q: %s", step, fmt.Sprintf(format, args...))})
 }
 
 func (ve *ValidationError) HasErrors() bool {
@@ -27,109 +117,586 @@ func (ve *ValidationError) HasErrors() bool {
 
 // ValidateFlow validates a flow definition against the registry and internal consistency.
 func ValidateFlow(flow *types.FlowDef, registry *plugin.Registry) error {
+	_, err := CheckFlow(flow, registry)
+	return err
+}
+
+// CheckFlow validates a flow like ValidateFlow and returns all diagnostics,
+// including warnings, which are reported even when the flow is valid. They
+// are located in the flow's file and sorted by position.
+func CheckFlow(flow *types.FlowDef, registry *plugin.Registry) ([]Diagnostic, error) {
 	ve := &ValidationError{}
 
 	if flow.Name == "" {
-		ve.Add("flow 'name' is required")
+		ve.errorf("missing-name", "", "name", "flow 'name' is required")
 	}
 	if len(flow.Steps) == 0 {
-		ve.Add("flow must have at least one step")
+		ve.errorf("no-steps", "", "steps", "flow must have at least one step")
+	}
+
+	if flow.Timeout != "" {
+		if _, err := time.ParseDuration(flow.Timeout); err != nil {
+			ve.errorf("invalid-duration", "", "timeout", "invalid flow timeout %q", flow.Timeout)
+		}
+	}
+
+	for i, name := range flow.RequiresSecrets {
+		if name == "" || strings.ContainsAny(name, " \t\r\n") {
+			ve.errorf("invalid-secret", "", fmt.Sprintf("requires_secrets.%d", i), "requires_secrets: invalid secret name %q", name)
+		}
+	}
+
+	if flow.Input != nil {
+		checkSchema("input", "", flow.Input.Properties, ve)
+	}
+	if flow.Output != nil {
+		checkSchema("output", "", flow.Output.Properties, ve)
 	}
 
 	stepNames := make(map[string]int)
 	for i, step := range flow.Steps {
 		if step.Name == "" {
-			ve.Add(fmt.Sprintf("step %d: 'name' is required", i+1))
+			ve.errorf("missing-name", "", fmt.Sprintf("steps.%d", i), "step %d: 'name' is required", i+1)
 			continue
 		}
 		if prev, exists := stepNames[step.Name]; exists {
-			ve.Add(fmt.Sprintf("step %d: duplicate step name %q (first at step %d)", i+1, step.Name, prev+1))
+			ve.errorf("duplicate-step", "", "steps."+step.Name, "step %d: duplicate step name %q (first at step %d)", i+1, step.Name, prev+1)
 		}
 		stepNames[step.Name] = i
 
-		if step.Connector == "" && len(step.Parallel) == 0 {
-			ve.Add(fmt.Sprintf("step %q: 'connector' is required", step.Name))
-		} else if step.Connector == "flow" {
-			// Flow connector is handled by the engine, not the registry.
-		} else if step.Connector != "" && !registry.Has(step.Connector) {
-			ve.Add(fmt.Sprintf("step %q: connector %q not found in registry", step.Name, step.Connector))
-		} else {
-			conn, _ := registry.Get(step.Connector)
-			if step.Action != "" {
-				found := false
-				for _, a := range conn.Actions() {
-					if a.Name == step.Action {
-						found = true
-						break
-					}
+		validateStep(step, registry, ve)
+
+		if step.Loop != nil {
+			for j, ls := range step.Loop.Steps {
+				if ls.Name == "" {
+					ve.errorf("missing-name", step.Name, "loop.steps", "step %d loop.steps[%d]: 'name' is required", i+1, j)
+					continue
 				}
-				if !found {
-					ve.Add(fmt.Sprintf("step %q: connector %q does not support action %q", step.Name, step.Connector, step.Action))
+				if prev, exists := stepNames[ls.Name]; exists {
+					ve.errorf("duplicate-step", ls.Name, "", "step %d loop.steps[%d]: duplicate step name %q (first at step %d)", i+1, j, ls.Name, prev+1)
+				}
+				stepNames[ls.Name] = i
+				validateStep(ls, registry, ve)
+				if ls.Connector == "approval" {
+					ve.errorf("unsupported", ls.Name, "connector", "loop step %q: approval steps are not supported inside loops", ls.Name)
+				}
+				if ls.Compensate != nil {
+					ve.errorf("unsupported", ls.Name, "compensate", "loop step %q: 'compensate' is not supported inside loops; set it on the loop step %q", ls.Name, step.Name)
 				}
 			}
 		}
 
-		switch step.OnError {
-		case "", "abort", "continue", "skip", "retry":
-			// valid
-		default:
-			ve.Add(fmt.Sprintf("step %q: invalid on_error value %q (must be abort, continue, skip, or retry)", step.Name, step.OnError))
-		}
-
-		if step.OnError == "retry" && step.Retry == nil {
-			ve.Add(fmt.Sprintf("step %q: on_error is 'retry' but no retry config provided", step.Name))
-		}
-
 		// Validate parallel sub-steps.
 		for j, ps := range step.Parallel {
 			if ps.Name == "" {
-				ve.Add(fmt.Sprintf("step %d parallel[%d]: 'name' is required", i+1, j))
+				ve.errorf("missing-name", step.Name, "parallel", "step %d parallel[%d]: 'name' is required", i+1, j)
 				continue
 			}
 			if prev, exists := stepNames[ps.Name]; exists {
-				ve.Add(fmt.Sprintf("step %d parallel[%d]: duplicate step name %q (first at step %d)", i+1, j, ps.Name, prev+1))
+				ve.errorf("duplicate-step", ps.Name, "", "step %d parallel[%d]: duplicate step name %q (first at step %d)", i+1, j, ps.Name, prev+1)
 			}
 			stepNames[ps.Name] = i
 			if ps.Connector == "" && len(ps.Parallel) == 0 {
-				ve.Add(fmt.Sprintf("parallel step %q: 'connector' is required", ps.Name))
+				ve.errorf("missing-connector", ps.Name, "", "parallel step %q: 'connector' is required", ps.Name)
 			}
+			if ps.Connector == "approval" {
+				ve.errorf("unsupported", ps.Name, "connector", "parallel step %q: approval steps are not supported in parallel groups", ps.Name)
+			}
+			validateActionInput(ps, registry, ve)
 		}
+	}
 
-		// Validate flow composition.
-		if step.Connector == "flow" && step.Flow == "" {
-			if step.Input == nil {
-				ve.Add(fmt.Sprintf("step %q: flow connector requires 'flow' field or input.flow", step.Name))
-			} else if _, ok := step.Input["flow"]; !ok {
-				ve.Add(fmt.Sprintf("step %q: flow connector requires 'flow' field or input.flow", step.Name))
+	// Validate step references. Sequential flows may only reference previous
+	// steps; flows using depends_on are ordered by their dependency graph.
+	dagMode := usesDependencies(flow.Steps)
+	for i, step := range flow.Steps {
+		if step.Name == "" {
+			continue
+		}
+		refIndex := i
+		if dagMode {
+			refIndex = len(flow.Steps)
+		}
+		if step.Input != nil {
+			validateStepRefs(step.Input, "input", stepNames, step.Name, refIndex, ve)
+		}
+		if step.Foreach != "" {
+			checkStringRefs(step.Foreach, "foreach", stepNames, step.Name, refIndex, ve)
+		}
+		checkConditionRefs(step.When, "when", stepNames, step.Name, refIndex, ve)
+		if step.Loop != nil {
+			// Loop conditions run after the step has started and may
+			// reference it and its loop block.
+			checkConditionRefs(step.Loop.Until, "loop.until", stepNames, step.Name, refIndex+1, ve)
+			checkConditionRefs(step.Loop.While, "loop.while", stepNames, step.Name, refIndex+1, ve)
+			// Loop steps may reference each other, also across iterations.
+			for _, ls := range step.Loop.Steps {
+				if ls.Name == "" {
+					continue
+				}
+				if ls.Input != nil {
+					validateStepRefs(ls.Input, "input", stepNames, ls.Name, refIndex+1, ve)
+				}
+				if ls.Foreach != "" {
+					checkStringRefs(ls.Foreach, "foreach", stepNames, ls.Name, refIndex+1, ve)
+				}
+				checkConditionRefs(ls.When, "when", stepNames, ls.Name, refIndex+1, ve)
+			}
+		}
+		for _, dep := range step.DependsOn {
+			if _, exists := stepNames[dep]; !exists {
+				ve.stepErrorf("unknown-step", step.Name, "depends_on", "depends_on references unknown step %q", dep)
+			} else if dep == step.Name {
+				ve.stepErrorf("invalid-dependency", step.Name, "depends_on", "cannot depend on itself")
 			}
 		}
+		validateCompensate(step, registry, stepNames, len(flow.Steps), ve)
+		for _, ps := range step.Parallel {
+			validateCompensate(ps, registry, stepNames, len(flow.Steps), ve)
+		}
+	}
 
-		// Validate step references point to previous steps.
-		if step.Input != nil {
-			validateStepRefs(step.Input, stepNames, step.Name, i, ve)
+	// Cleanup blocks run after all steps and may reference any of them.
+	validateBlock("on_failure", flow.OnFailure, registry, stepNames, len(flow.Steps), ve)
+	validateBlock("finally", flow.Finally, registry, stepNames, len(flow.Steps)+len(flow.OnFailure), ve)
+
+	// Output mappings are resolved after all steps have run.
+	if flow.Output != nil {
+		for name, field := range flow.Output.Properties {
+			for _, ref := range stepRefs(field.Value) {
+				if _, exists := stepNames[ref]; !exists {
+					ve.errorf("unknown-step", "", "output.properties."+name, "output %q: references unknown step %q", name, ref)
+				}
+			}
+		}
+	}
+
+	checkOutputRefs(flow, registry, ve)
+
+	if dagMode && !ve.HasErrors() {
+		if _, err := buildGraph(flow.Steps); err != nil {
+			ve.errorf("invalid-dependency", "", "steps", "%v", err)
 		}
 	}
 
+	checkTypes(flow, registry, ve)
+
+	locate(flow, ve.Diagnostics)
 	if ve.HasErrors() {
-		return ve
+		return ve.Diagnostics, ve
+	}
+	return ve.Diagnostics, nil
+}
+
+// CheckChildFlows validates the child flows that the flow steps of flow run,
+// directly or through other child flows, as far as flows holds them: they
+// must not contain approval steps, which only top-level runs support. Flow
+// steps naming their child with an expression are not checked.
+func CheckChildFlows(flow *types.FlowDef, flows map[string]*types.FlowDef) ([]Diagnostic, error) {
+	ve := &ValidationError{}
+	visitSteps(flow, func(step types.StepDef) {
+		if step.Connector != "flow" {
+			return
+		}
+		field, name := "flow", step.Flow
+		if name == "" {
+			field = "input.flow"
+			name, _ = step.Input["flow"].(string)
+		}
+		child, ok := flows[name]
+		if !ok {
+			return
+		}
+		reached, _ := ReachableFlows(child, flows)
+		for _, f := range reached {
+			visitSteps(f, func(cs types.StepDef) {
+				if cs.Connector == "approval" {
+					ve.stepErrorf("unsupported", step.Name, field, "child flow %q has approval step %q; approval steps are not supported in child flows", f.Name, cs.Name)
+				}
+			})
+		}
+	})
+
+	locate(flow, ve.Diagnostics)
+	if ve.HasErrors() {
+		return ve.Diagnostics, ve
+	}
+	return ve.Diagnostics, nil
+}
+
+// locate fills in the file positions of diagnostics and sorts them by
+// position. Diagnostics without a recorded position keep their order after
+// the located ones.
+func locate(flow *types.FlowDef, diags []Diagnostic) {
+	for i := range diags {
+		d := &diags[i]
+		d.File = flow.File
+		path := d.Field
+		if d.Step != "" {
+			path = "steps." + d.Step
+			if d.Field != "" {
+				path += "." + d.Field
+			}
+		}
+		if pos, ok := flow.Position(path); ok {
+			d.Line, d.Column = pos.Line, pos.Column
+		}
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		a, b := diags[i], diags[j]
+		if (a.Line == 0) != (b.Line == 0) {
+			return b.Line == 0
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+}
+
+// validateStep checks a single step's connector, action and execution settings.
+func validateStep(step types.StepDef, registry *plugin.Registry, ve *ValidationError) {
+	loopBlock := step.Loop != nil && len(step.Loop.Steps) > 0
+	if step.Connector == "" && len(step.Parallel) == 0 && !loopBlock {
+		ve.stepErrorf("missing-connector", step.Name, "", "'connector' is required")
+	} else if step.Connector == "flow" || step.Connector == "approval" {
+		// Flow and approval connectors are handled by the engine, not the registry.
+	} else if step.Connector != "" && !registry.Has(step.Connector) {
+		ve.stepErrorf("unknown-connector", step.Name, "connector", "connector %q not found in registry", step.Connector)
+	} else if step.Connector != "" && step.Action != "" {
+		if _, ok := lookupAction(registry, step.Connector, step.Action); !ok {
+			ve.stepErrorf("unknown-action", step.Name, "action", "connector %q does not support action %q", step.Connector, step.Action)
+		}
+	}
+	validateActionInput(step, registry, ve)
+
+	if step.Connector == "shell" {
+		checkShellQuoting(step, ve)
+	}
+
+	if step.Secrets != nil && step.Connector != "flow" {
+		ve.stepErrorf("unsupported", step.Name, "secrets", "'secrets' is only supported on flow steps")
+	}
+	for child, parent := range step.Secrets {
+		if child == "" || parent == "" {
+			ve.stepErrorf("invalid-secret", step.Name, "secrets", "secrets: empty secret name in mapping %q: %q", child, parent)
+		}
+	}
+
+	switch step.OnError {
+	case "", "abort", "continue", "skip", "retry":
+		// valid
+	default:
+		ve.stepErrorf("invalid-on-error", step.Name, "on_error", "invalid on_error value %q (must be abort, continue, skip, or retry)", step.OnError)
+	}
+
+	if step.OnError == "retry" && step.Retry == nil {
+		ve.stepErrorf("missing-retry", step.Name, "on_error", "on_error is 'retry' but no retry config provided")
+	}
+
+	if step.Timeout != "" {
+		if _, err := time.ParseDuration(step.Timeout); err != nil {
+			ve.stepErrorf("invalid-duration", step.Name, "timeout", "invalid timeout %q", step.Timeout)
+		}
+	}
+	if step.Retry != nil && step.Retry.Timeout != "" {
+		if _, err := time.ParseDuration(step.Retry.Timeout); err != nil {
+			ve.stepErrorf("invalid-duration", step.Name, "retry.timeout", "invalid retry timeout %q", step.Retry.Timeout)
+		}
+	}
+
+	checkCondition(step.Name, "when", step.When, ve)
+
+	if step.Foreach != "" {
+		if len(step.Parallel) > 0 {
+			ve.stepErrorf("invalid-foreach", step.Name, "foreach", "'foreach' cannot be combined with 'parallel'")
+		}
+		switch step.As {
+		case "input", "steps", "env", "secret", "loop", "flow":
+			ve.stepErrorf("invalid-foreach", step.Name, "as", "'as' cannot shadow the reserved name %q", step.As)
+		}
+	} else if step.As != "" || step.Concurrency != 0 {
+		ve.stepErrorf("invalid-foreach", step.Name, "as", "'as' and 'concurrency' require 'foreach'")
+	}
+	if step.Concurrency < 0 {
+		ve.stepErrorf("invalid-foreach", step.Name, "concurrency", "'concurrency' must not be negative")
+	}
+
+	if step.Loop != nil {
+		validateLoop(step, ve)
+	}
+
+	if step.Connector == "approval" {
+		validateApproval(step, ve)
+	}
+
+	// Validate flow composition.
+	if step.Connector == "flow" && step.Flow == "" {
+		if step.Input == nil {
+			ve.stepErrorf("missing-flow", step.Name, "", "flow connector requires 'flow' field or input.flow")
+		} else if _, ok := step.Input["flow"]; !ok {
+			ve.stepErrorf("missing-flow", step.Name, "", "flow connector requires 'flow' field or input.flow")
+		}
+	}
+}
+
+// lookupAction returns the definition of a connector action.
+func lookupAction(registry *plugin.Registry, connector, action string) (plugin.ActionDef, bool) {
+	conn, ok := registry.Get(connector)
+	if !ok {
+		return plugin.ActionDef{}, false
+	}
+	for _, a := range conn.Actions() {
+		if a.Name == action {
+			return a, true
+		}
+	}
+	return plugin.ActionDef{}, false
+}
+
+// validateActionInput checks a step's input against the schema its connector
+// publishes for the action: required inputs must be set and literal values
+// must match their declared types. Values containing expressions are checked
+// at runtime. Inputs the action does not declare are reported as warnings.
+// Actions without an input schema are not checked.
+func validateActionInput(step types.StepDef, registry *plugin.Registry, ve *ValidationError) {
+	action, ok := lookupAction(registry, step.Connector, step.Action)
+	if !ok || len(action.Input) == 0 {
+		return
+	}
+	ref := step.Connector + "." + step.Action
+
+	names := make([]string, 0, len(action.Input))
+	for name := range action.Input {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field := action.Input[name]
+		v := step.Input[name]
+		if v == nil {
+			if field.Required {
+				ve.stepErrorf("missing-input", step.Name, "input", "action %s requires input %q", ref, name)
+			}
+			continue
+		}
+		if hasExpression(v) {
+			continue
+		}
+		from := len(ve.Diagnostics)
+		validateValue(fmt.Sprintf("step %q: input", step.Name), name, v, field, ve)
+		ve.locateSince(from, step.Name, "input."+name)
+	}
+
+	var unknown []string
+	for name := range step.Input {
+		if _, ok := action.Input[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	for _, name := range unknown {
+		ve.stepWarnf("unknown-input", step.Name, "input."+name, "action %s has no input %q", ref, name)
+	}
+}
+
+// checkActionInput checks a step's resolved input against the action's
+// input schema before the connector is called. Empty strings, which missing
+// references resolve to outside strict mode, count as unset for inputs that
+// are not strings.
+func checkActionInput(action plugin.ActionDef, input map[string]any) error {
+	if len(action.Input) == 0 {
+		return nil
+	}
+	values := make(map[string]any, len(input))
+	for name, v := range input {
+		if field, ok := action.Input[name]; ok && v == "" && field.Type != "string" {
+			continue
+		}
+		values[name] = v
+	}
+	ve := &ValidationError{}
+	validateObject("input", "", values, action.Input, ve)
+	if ve.HasErrors() {
+		return errors.New(strings.Join(ve.Errors, "; "))
 	}
 	return nil
 }
 
-// ValidateInput checks that required input fields are present.
+// hasExpression reports whether v, or any value nested in it, contains a
+// ${{ }} expression.
+func hasExpression(v any) bool {
+	switch val := v.(type) {
+	case string:
+		return strings.Contains(val, "${{")
+	case map[string]any:
+		for _, item := range val {
+			if hasExpression(item) {
+				return true
+			}
+		}
+	case []any:
+		for _, item := range val {
+			if hasExpression(item) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkShellQuoting warns when flow input is interpolated into a shell
+// command without the shellquote pipe, which lets the input inject commands.
+func checkShellQuoting(step types.StepDef, ve *ValidationError) {
+	command, ok := step.Input["command"].(string)
+	if !ok {
+		return
+	}
+	nodes, err := parseTemplate(command)
+	if err != nil {
+		return // reported with the step's other references
+	}
+	warned := make(map[string]bool)
+	for _, node := range nodes {
+		if pipe, ok := node.(*pipeNode); ok && pipe.name == "shellquote" {
+			continue
+		}
+		walkExpr(node, func(n exprNode) {
+			p, ok := n.(*pathNode)
+			if !ok || p.root != "input" || warned[p.raw] {
+				return
+			}
+			warned[p.raw] = true
+			ve.stepWarnf("unquoted-input", step.Name, "input.command", "%s is interpolated into 'command' without quoting; use ${{ %s | shellquote }} or 'args'", p.raw, p.raw)
+		})
+	}
+}
+
+// validateLoop checks a step's loop configuration.
+func validateLoop(step types.StepDef, ve *ValidationError) {
+	loop := step.Loop
+	if loop.Until == "" && loop.While == "" {
+		ve.stepErrorf("invalid-loop", step.Name, "loop", "loop requires 'until' or 'while'")
+	}
+	checkCondition(step.Name, "until", loop.Until, ve)
+	checkCondition(step.Name, "while", loop.While, ve)
+	if loop.MaxIterations < 0 {
+		ve.stepErrorf("invalid-loop", step.Name, "loop.max_iterations", "loop 'max_iterations' must not be negative")
+	}
+	if loop.Interval != "" {
+		if _, err := time.ParseDuration(loop.Interval); err != nil {
+			ve.stepErrorf("invalid-duration", step.Name, "loop.interval", "invalid loop interval %q", loop.Interval)
+		}
+	}
+	if step.Foreach != "" || len(step.Parallel) > 0 {
+		ve.stepErrorf("invalid-loop", step.Name, "loop", "'loop' cannot be combined with 'foreach' or 'parallel'")
+	}
+	if len(loop.Steps) > 0 && step.Connector != "" {
+		ve.stepErrorf("invalid-loop", step.Name, "loop.steps", "a loop with nested 'steps' cannot also set 'connector'")
+	}
+}
+
+// conditionField returns the path of a step's when, until or while field.
+func conditionField(name string) string {
+	if name == "when" {
+		return name
+	}
+	return "loop." + name
+}
+
+// checkCondition reports a when, until or while condition that does not parse.
+func checkCondition(stepName, field, cond string, ve *ValidationError) {
+	if cond == "" {
+		return
+	}
+	src := conditionExpr(cond)
+	node, err := parseExpr(src)
+	if err == nil {
+		err = checkPipes(src, node)
+	}
+	if err != nil {
+		ve.stepErrorf("invalid-expression", stepName, conditionField(field), "%s: %v", field, err)
+	}
+}
+
+// validateApproval checks an approval step's literal timeout and default.
+func validateApproval(step types.StepDef, ve *ValidationError) {
+	if step.Foreach != "" || step.Loop != nil {
+		ve.stepErrorf("invalid-approval", step.Name, "", "approval steps cannot use 'foreach' or 'loop'")
+	}
+	if t, ok := step.Input["timeout"].(string); ok && !exprRegex.MatchString(t) {
+		if _, err := time.ParseDuration(t); err != nil {
+			ve.stepErrorf("invalid-approval", step.Name, "input.timeout", "invalid approval timeout %q", t)
+		}
+	}
+	if d, ok := step.Input["default"].(string); ok && !exprRegex.MatchString(d) {
+		if d != "approve" && d != "reject" {
+			ve.stepErrorf("invalid-approval", step.Name, "input.default", "invalid approval default %q (must be approve or reject)", d)
+		}
+	}
+}
+
+// validateCompensate checks a step's compensate step. Compensations run
+// after the main steps and may reference any of them.
+func validateCompensate(step types.StepDef, registry *plugin.Registry, stepNames map[string]int, refIndex int, ve *ValidationError) {
+	if step.Compensate == nil {
+		return
+	}
+	comp := *step.Compensate
+	if comp.Name == "" {
+		comp.Name = "compensate-" + step.Name
+	}
+	validateStep(comp, registry, ve)
+	if comp.Connector == "approval" {
+		ve.stepErrorf("unsupported", comp.Name, "connector", "approval steps are not supported in compensate")
+	}
+	if len(comp.DependsOn) > 0 || comp.Compensate != nil {
+		ve.stepErrorf("unsupported", comp.Name, "", "'depends_on' and 'compensate' are not supported in a compensate step")
+	}
+	if comp.Input != nil {
+		validateStepRefs(comp.Input, "input", stepNames, comp.Name, refIndex, ve)
+	}
+}
+
+// validateBlock checks the steps of an on_failure or finally block. Block
+// steps run sequentially after the main steps, starting at index offset.
+func validateBlock(block string, steps []types.StepDef, registry *plugin.Registry, stepNames map[string]int, offset int, ve *ValidationError) {
+	for j, step := range steps {
+		if step.Name == "" {
+			ve.errorf("missing-name", "", fmt.Sprintf("%s.%d", block, j), "%s[%d]: 'name' is required", block, j)
+			continue
+		}
+		if _, exists := stepNames[step.Name]; exists {
+			ve.errorf("duplicate-step", step.Name, "", "%s[%d]: duplicate step name %q", block, j, step.Name)
+		}
+		stepNames[step.Name] = offset + j
+
+		validateStep(step, registry, ve)
+		if step.Connector == "approval" {
+			ve.stepErrorf("unsupported", step.Name, "connector", "approval steps are not supported in %s", block)
+		}
+		if len(step.DependsOn) > 0 {
+			ve.stepErrorf("unsupported", step.Name, "depends_on", "'depends_on' is not supported in %s", block)
+		}
+		if step.Input != nil {
+			validateStepRefs(step.Input, "input", stepNames, step.Name, offset+j, ve)
+		}
+	}
+}
+
+// ValidateInput checks input against the flow's input schema: required
+// fields, types and constraints, including those of nested objects and
+// array elements. String values are first converted to their declared
+// types and missing fields that declare a default are set, both in place.
+// All problems are returned in a ValidationError.
 func ValidateInput(flow *types.FlowDef, input map[string]any) error {
 	if flow.Input == nil {
 		return nil
 	}
 
+	coerceObject(input, flow.Input.Properties)
 	ve := &ValidationError{}
-	for name, field := range flow.Input.Properties {
-		if field.Required {
-			if _, ok := input[name]; !ok {
-				ve.Add(fmt.Sprintf("required input field %q is missing", name))
-			}
-		}
-	}
+	validateObject("input", "", input, flow.Input.Properties, ve)
 
 	if ve.HasErrors() {
 		return ve
@@ -137,44 +704,221 @@ func ValidateInput(flow *types.FlowDef, input map[string]any) error {
 	return nil
 }
 
-func validateStepRefs(input map[string]any, stepNames map[string]int, currentStep string, currentIndex int, ve *ValidationError) {
-	for _, v := range input {
+// validateStepRefs checks the step references in the values of a step's
+// input map. field is the map's path in the step, e.g. "input".
+func validateStepRefs(input map[string]any, field string, stepNames map[string]int, currentStep string, currentIndex int, ve *ValidationError) {
+	for k, v := range input {
 		switch val := v.(type) {
 		case string:
-			checkStringRefs(val, stepNames, currentStep, currentIndex, ve)
+			checkStringRefs(val, field+"."+k, stepNames, currentStep, currentIndex, ve)
 		case map[string]any:
-			validateStepRefs(val, stepNames, currentStep, currentIndex, ve)
+			validateStepRefs(val, field+"."+k, stepNames, currentStep, currentIndex, ve)
 		case []any:
 			for _, item := range val {
 				if s, ok := item.(string); ok {
-					checkStringRefs(s, stepNames, currentStep, currentIndex, ve)
+					checkStringRefs(s, field+"."+k, stepNames, currentStep, currentIndex, ve)
 				}
 			}
 		}
 	}
 }
 
-func checkStringRefs(s string, stepNames map[string]int, currentStep string, currentIndex int, ve *ValidationError) {
-	matches := exprRegex.FindAllStringSubmatch(s, -1)
-	for _, match := range matches {
-		expr := strings.TrimSpace(match[1])
-		path := strings.SplitN(expr, "|", 2)[0]
-		path = strings.TrimSpace(path)
+func checkStringRefs(s, field string, stepNames map[string]int, currentStep string, currentIndex int, ve *ValidationError) {
+	nodes, err := parseTemplate(s)
+	if err != nil {
+		ve.stepErrorf("invalid-expression", currentStep, field, "%v", err)
+		return
+	}
+	checkNodeRefs(nodes, field, stepNames, currentStep, currentIndex, ve)
+}
 
-		if !strings.HasPrefix(path, "steps.") {
-			continue
+// checkConditionRefs checks the step references of a when, until or while
+// condition. Conditions that do not parse are reported by checkCondition.
+func checkConditionRefs(cond, field string, stepNames map[string]int, currentStep string, currentIndex int, ve *ValidationError) {
+	checkNodeRefs(conditionNodes(cond), field, stepNames, currentStep, currentIndex, ve)
+}
+
+func checkNodeRefs(nodes []exprNode, field string, stepNames map[string]int, currentStep string, currentIndex int, ve *ValidationError) {
+	for _, node := range nodes {
+		for _, refName := range exprStepRefs(node) {
+			idx, exists := stepNames[refName]
+			if !exists {
+				ve.stepErrorf("unknown-step", currentStep, field, "references unknown step %q", refName)
+			} else if idx >= currentIndex {
+				ve.stepErrorf("step-order", currentStep, field, "references step %q which has not executed yet", refName)
+			}
+		}
+	}
+}
+
+// conditionNodes parses a when, until or while condition, which may omit
+// the ${{ }} wrapper. It returns nothing for an empty or invalid condition.
+func conditionNodes(cond string) []exprNode {
+	if cond == "" {
+		return nil
+	}
+	node, err := parseExpr(conditionExpr(cond))
+	if err != nil {
+		return nil
+	}
+	return []exprNode{node}
+}
+
+// stepOutput describes the output fields a step is known to produce.
+type stepOutput struct {
+	source string // e.g. "http.request" or "foreach"
+	fields map[string]types.FieldDef
+}
+
+// knownStepOutput returns the output fields of a step: those the engine sets
+// for foreach steps, loop blocks and flow steps, or those its connector
+// declares for the action. Approval steps, and actions without an output
+// schema, are not known.
+func knownStepOutput(step types.StepDef, registry *plugin.Registry) (stepOutput, bool) {
+	switch {
+	case step.Foreach != "":
+		return stepOutput{source: "foreach", fields: map[string]types.FieldDef{
+			"results": {Type: "array"},
+			"count":   {Type: "integer"},
+		}}, true
+	case step.Loop != nil && len(step.Loop.Steps) > 0:
+		return stepOutput{source: "loop", fields: map[string]types.FieldDef{
+			"iterations": {Type: "integer"},
+		}}, true
+	case step.Connector == "flow" && len(step.Parallel) == 0:
+		return stepOutput{source: "flow", fields: map[string]types.FieldDef{
+			"status": {Type: "string"},
+			"error":  {Type: "string"},
+			"result": {Type: "object"},
+			"steps":  {Type: "object"},
+		}}, true
+	case len(step.Parallel) > 0, step.Connector == "approval":
+		return stepOutput{}, false
+	}
+	action, ok := lookupAction(registry, step.Connector, step.Action)
+	if !ok || len(action.Output) == 0 {
+		return stepOutput{}, false
+	}
+	return stepOutput{source: step.Connector + "." + step.Action, fields: action.Output}, true
+}
+
+// checkOutputRefs reports step references that can never resolve: ones that
+// name neither a step's output nor its status, and ones that read an output
+// field the step does not produce. Optional references (ending in "?") may
+// name any output field.
+func checkOutputRefs(flow *types.FlowDef, registry *plugin.Registry, ve *ValidationError) {
+	outputs := make(map[string]stepOutput)
+	visitSteps(flow, func(step types.StepDef) {
+		if out, ok := knownStepOutput(step, registry); ok && step.Name != "" {
+			outputs[step.Name] = out
+		}
+	})
+
+	check := func(step, field string, nodes []exprNode) {
+		for _, node := range nodes {
+			walkExpr(node, func(n exprNode) {
+				p, ok := n.(*pathNode)
+				if !ok || p.root != "steps" {
+					return
+				}
+				if code, msg := checkOutputRef(p, outputs); msg != "" {
+					if step != "" {
+						ve.stepErrorf(code, step, field, "%s", msg)
+					} else {
+						ve.errorf(code, "", field, "output %q: %s", strings.TrimPrefix(field, "output.properties."), msg)
+					}
+				}
+			})
+		}
+	}
+
+	visitSteps(flow, func(step types.StepDef) {
+		for k, v := range step.Input {
+			check(step.Name, "input."+k, templateNodes(v))
+		}
+		check(step.Name, "foreach", templateNodes(step.Foreach))
+		check(step.Name, "when", conditionNodes(step.When))
+		if step.Loop != nil {
+			check(step.Name, "loop.until", conditionNodes(step.Loop.Until))
+			check(step.Name, "loop.while", conditionNodes(step.Loop.While))
+		}
+	})
+	if flow.Output != nil {
+		for name, field := range flow.Output.Properties {
+			check("", "output.properties."+name, templateNodes(field.Value))
 		}
+	}
+}
+
+// checkOutputRef checks a single steps.* reference and returns the code and
+// description of its problem, if any.
+func checkOutputRef(p *pathNode, outputs map[string]stepOutput) (string, string) {
+	if len(p.segments) == 0 || p.segments[0].kind != segKey {
+		return "invalid-reference", fmt.Sprintf("incomplete step reference %q", p.raw)
+	}
+	stepName := p.segments[0].key
+	if len(p.segments) < 2 || p.segments[1].kind != segKey ||
+		(p.segments[1].key != "output" && p.segments[1].key != "status") ||
+		(p.segments[1].key == "status" && len(p.segments) > 2) {
+		return "invalid-reference", fmt.Sprintf("invalid step reference %q (use steps.%s.output or steps.%s.status)", p.raw, stepName, stepName)
+	}
+	out, known := outputs[stepName]
+	if !known || p.optional || p.segments[1].key != "output" || len(p.segments) < 3 || p.segments[2].kind != segKey {
+		return "", ""
+	}
+	field := p.segments[2].key
+	if _, ok := out.fields[field]; ok {
+		return "", ""
+	}
+	names := make([]string, 0, len(out.fields))
+	for name := range out.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "unknown-output", fmt.Sprintf("step %q has no output %q (%s produces %s)", stepName, field, out.source, strings.Join(names, ", "))
+}
 
-		// Extract step name from "steps.step-name.output.field"
-		rest := strings.TrimPrefix(path, "steps.")
-		parts := strings.SplitN(rest, ".", 2)
-		refName := parts[0]
+// templateNodes parses the ${{ }} expressions in v and in the values nested
+// in it. Strings that do not parse are skipped; checkStringRefs reports them.
+func templateNodes(v any) []exprNode {
+	var nodes []exprNode
+	switch val := v.(type) {
+	case string:
+		parsed, _ := parseTemplate(val)
+		nodes = append(nodes, parsed...)
+	case map[string]any:
+		for _, item := range val {
+			nodes = append(nodes, templateNodes(item)...)
+		}
+	case []any:
+		for _, item := range val {
+			nodes = append(nodes, templateNodes(item)...)
+		}
+	}
+	return nodes
+}
 
-		idx, exists := stepNames[refName]
-		if !exists {
-			ve.Add(fmt.Sprintf("step %q: references unknown step %q", currentStep, refName))
-		} else if idx >= currentIndex {
-			ve.Add(fmt.Sprintf("step %q: references step %q which has not executed yet", currentStep, refName))
+// visitSteps calls fn for every step of a flow, including parallel and loop
+// sub-steps, compensations and cleanup steps.
+func visitSteps(flow *types.FlowDef, fn func(types.StepDef)) {
+	var visit func(steps []types.StepDef)
+	visit = func(steps []types.StepDef) {
+		for _, step := range steps {
+			fn(step)
+			visit(step.Parallel)
+			if step.Loop != nil {
+				visit(step.Loop.Steps)
+			}
+			if step.Compensate != nil {
+				comp := *step.Compensate
+				if comp.Name == "" {
+					comp.Name = "compensate-" + step.Name
+				}
+				visit([]types.StepDef{comp})
+			}
 		}
 	}
+	visit(flow.Steps)
+	visit(flow.OnFailure)
+	visit(flow.Finally)
 }
@@ -1,6 +1,7 @@
 package engine
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 
@@ -121,3 +122,581 @@ func TestValidateInputRequired(t *testing.T) {
 		t.Errorf("expected no error, got: %v", err)
 	}
 }
+
+func TestValidateFlowDependsOnForwardReference(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "step1", Connector: "log", Action: "print", Input: map[string]any{
+				"message": "${{ steps.step2.output.body }}",
+			}, DependsOn: []string{"step2"}},
+			{Name: "step2", Connector: "http", Action: "request", Input: map[string]any{"url": "http://example.com"}},
+		},
+	}
+	if err := ValidateFlow(flow, testRegistry()); err != nil {
+		t.Errorf("expected valid flow, got: %v", err)
+	}
+}
+
+func TestValidateFlowDependsOnUnknownStep(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "step1", Connector: "log", Action: "print", DependsOn: []string{"missing"}},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected error for unknown dependency")
+	}
+	if !strings.Contains(err.Error(), `unknown step "missing"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateInputSchema(t *testing.T) {
+	minAge, maxAge := 18.0, 130.0
+	minLen, maxLen := 2, 5
+	maxPort := 65535.0
+	flow := &types.FlowDef{
+		Name: "test",
+		Input: &types.SchemaDef{
+			Properties: map[string]types.FieldDef{
+				"env":   {Type: "string", Enum: []any{"staging", "production"}, Default: "staging"},
+				"code":  {Type: "string", Pattern: `^[A-Z]+$`, MinLength: &minLen, MaxLength: &maxLen},
+				"age":   {Type: "integer", Minimum: &minAge, Maximum: &maxAge},
+				"email": {Type: "string", Format: "email"},
+				"owner": {Type: "object", Required: true, Properties: map[string]types.FieldDef{
+					"name": {Type: "string", Required: true},
+					"team": {Type: "string", Default: "core"},
+				}},
+				"ports": {Type: "array", Items: &types.FieldDef{Type: "integer", Maximum: &maxPort}},
+				"tags":  {Type: "array", Default: []any{"a"}},
+			},
+		},
+		Steps: []types.StepDef{{Name: "s", Connector: "log", Action: "print"}},
+	}
+
+	input := map[string]any{
+		"owner": map[string]any{"name": "ops"},
+		"ports": []any{float64(80), float64(443)},
+	}
+	if err := ValidateInput(flow, input); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if input["env"] != "staging" || input["owner"].(map[string]any)["team"] != "core" {
+		t.Errorf("defaults not applied: %v", input)
+	}
+	input["tags"].([]any)[0] = "changed"
+	if flow.Input.Properties["tags"].Default.([]any)[0] != "a" {
+		t.Error("applying a default must not share it with the flow definition")
+	}
+
+	err := ValidateInput(flow, map[string]any{
+		"env":   "prod",
+		"code":  "abcdef",
+		"age":   12.5,
+		"email": "not-an-email",
+		"owner": map[string]any{"team": 3},
+		"ports": []any{80, "x", 70000},
+	})
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{
+		`input "env": "prod" is not one of ["staging", "production"]`,
+		`input "code": must be at most 5 characters`,
+		`input "code": "abcdef" does not match pattern "^[A-Z]+$"`,
+		`input "age": expected integer, got number`,
+		`input "email": "not-an-email" is not a valid email`,
+		`required input field "owner.name" is missing`,
+		`input "owner.team": expected string, got number`,
+		`input "ports[1]": cannot convert "x" to integer`,
+		`input "ports[2]": must be <= 65535`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	if ve, ok := err.(*ValidationError); !ok || len(ve.Errors) != 9 {
+		t.Errorf("expected all 9 problems in one ValidationError, got: %v", err)
+	}
+}
+
+func TestValidateInputCoercion(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Input: &types.SchemaDef{
+			Properties: map[string]types.FieldDef{
+				"count":   {Type: "integer"},
+				"ratio":   {Type: "number"},
+				"dry_run": {Type: "boolean"},
+				"name":    {Type: "string"},
+				"tags":    {Type: "array"},
+				"ports":   {Type: "array", Items: &types.FieldDef{Type: "integer"}},
+				"config":  {Type: "object", Properties: map[string]types.FieldDef{"replicas": {Type: "integer"}}},
+			},
+		},
+		Steps: []types.StepDef{{Name: "s", Connector: "log", Action: "print"}},
+	}
+
+	input := map[string]any{
+		"count":   " 42 ",
+		"ratio":   "0.5",
+		"dry_run": "true",
+		"name":    "007",
+		"tags":    "a, b,c",
+		"ports":   `[80, "443"]`,
+		"config":  `{"replicas": "3"}`,
+	}
+	if err := ValidateInput(flow, input); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]any{
+		"count":   42,
+		"ratio":   0.5,
+		"dry_run": true,
+		"name":    "007",
+		"tags":    []any{"a", "b", "c"},
+		"ports":   []any{float64(80), 443},
+		"config":  map[string]any{"replicas": 3},
+	}
+	if !reflect.DeepEqual(input, want) {
+		t.Errorf("coerced input = %#v, want %#v", input, want)
+	}
+
+	err := ValidateInput(flow, map[string]any{
+		"count":   "forty-two",
+		"dry_run": "maybe",
+		"ports":   "80,http",
+		"config":  "{broken",
+	})
+	if err == nil {
+		t.Fatal("expected coercion errors")
+	}
+	for _, want := range []string{
+		`input "count": cannot convert "forty-two" to integer`,
+		`input "dry_run": cannot convert "maybe" to boolean`,
+		`input "ports[1]": cannot convert "http" to integer`,
+		`input "config": cannot convert "{broken" to object`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestValidateFlowSchemaDefinition(t *testing.T) {
+	min := 10.0
+	flow := &types.FlowDef{
+		Name: "test",
+		Input: &types.SchemaDef{
+			Properties: map[string]types.FieldDef{
+				"a":  {Type: "strng"},
+				"b":  {Type: "string", Pattern: "("},
+				"c":  {Type: "integer", Minimum: &min, Default: 3},
+				"d":  {Type: "object", Properties: map[string]types.FieldDef{"e": {Type: "string", Enum: []any{"x"}, Default: "y"}}},
+				"":   {Type: "string"},
+				".[": {Type: "strng"},
+			},
+		},
+		Steps: []types.StepDef{{Name: "s", Connector: "log", Action: "print"}},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected errors for invalid schema")
+	}
+	for _, want := range []string{
+		`input schema: field "a": unknown type "strng"`,
+		`input schema: field "b": invalid pattern "("`,
+		`input schema: default for "c": must be >= 10`,
+		`input schema: default for "d.e": "y" is not one of ["x"]`,
+		`input schema: field "": property names must not be empty`,
+		`input schema: field ".[": unknown type "strng"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestCheckFlowActionInput(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "fetch", Connector: "http", Action: "request", Input: map[string]any{
+				"method":  "GET",
+				"headers": []any{"Accept: */*"},
+				"timout":  "5s",
+			}},
+			{Name: "dynamic", Connector: "http", Action: "request", Input: map[string]any{
+				"url":     "${{ input.url }}",
+				"headers": "${{ input.headers }}",
+			}},
+			{Name: "block", Loop: &types.LoopConfig{Until: "true", MaxIterations: 2, Steps: []types.StepDef{
+				{Name: "inner", Connector: "shell", Action: "run", Input: map[string]any{"command": 42}},
+			}}},
+		},
+	}
+
+	diags, err := CheckFlow(flow, testRegistry())
+	warnings := warningMessages(diags)
+	if err == nil {
+		t.Fatal("expected action input errors")
+	}
+	for _, want := range []string{
+		`step "fetch": action http.request requires input "url"`,
+		`step "fetch": input "headers": expected object, got array`,
+		`step "inner": input "command": expected string, got number`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `"dynamic"`) {
+		t.Errorf("expressions must be checked at runtime, got: %v", err)
+	}
+	if len(warnings) != 1 || warnings[0] != `step "fetch": action http.request has no input "timout"` {
+		t.Errorf("warnings = %q, want the unknown input", warnings)
+	}
+}
+
+func TestValidateFlowOutputRefs(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "check", Connector: "http", Action: "request", Input: map[string]any{"url": "http://example.com"}},
+			{Name: "each", Connector: "log", Action: "print", Foreach: "${{ input.items }}", Input: map[string]any{"message": "x"}},
+			{Name: "report", Connector: "log", Action: "print",
+				When: `steps.check.output.exit_code == 0 && steps.later.status == "success"`,
+				Input: map[string]any{
+					"message": "${{ steps.check.output.stdout }} ${{ steps.check.output.body.items[0] }} ${{ steps.each.output.count }}",
+					"extra":   map[string]any{"opt": "${{ steps.check.output.missing? }}", "bad": "${{ steps.check.outputs }}"},
+				}},
+			{Name: "later", Connector: "shell", Action: "run", Input: map[string]any{"command": "true"},
+				Loop: &types.LoopConfig{Until: "steps.later.output.stdout == 'ok'", MaxIterations: 3}},
+		},
+		Output: &types.SchemaDef{Properties: map[string]types.FieldDef{
+			"code": {Type: "integer", Value: "${{ steps.check.output.code }}"},
+		}},
+	}
+
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected errors for invalid output references")
+	}
+	for _, want := range []string{
+		`step "report": step "check" has no output "stdout" (http.request produces body, headers, status_code)`,
+		`step "report": step "check" has no output "exit_code"`,
+		`step "report": references step "later" which has not executed yet`,
+		`step "report": invalid step reference "steps.check.outputs" (use steps.check.output or steps.check.status)`,
+		`output "code": step "check" has no output "code"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	for _, unexpected := range []string{`"body"`, `"count"`, `"missing"`, `step "later": references`} {
+		if strings.Contains(err.Error(), unexpected) {
+			t.Errorf("unexpected error mentioning %s: %v", unexpected, err)
+		}
+	}
+}
+
+func TestValidateFlowDependencyCycle(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "a", Connector: "log", Action: "print", DependsOn: []string{"b"}, Input: map[string]any{"message": "a"}},
+			{Name: "b", Connector: "log", Action: "print", Input: map[string]any{
+				"message": "${{ steps.a.output.message }}",
+			}},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected error for dependency cycle")
+	}
+	if !strings.Contains(err.Error(), "dependency cycle") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateFlowLoop(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name: "wait",
+				Loop: &types.LoopConfig{
+					Interval: "soon",
+					Steps:    []types.StepDef{{Name: "check", Connector: "http", Action: "request"}},
+				},
+			},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected error for invalid loop")
+	}
+	for _, want := range []string{"'until' or 'while'", "invalid loop interval"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestValidateFlowLoopSteps(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name: "poll",
+				Loop: &types.LoopConfig{
+					Until:         "steps.check.status == 'success'",
+					MaxIterations: 3,
+					Steps: []types.StepDef{
+						{Name: "check", Connector: "nonexistent", Action: "do"},
+						{Name: "report", Connector: "log", Action: "print", OnError: "explode",
+							Input:      map[string]any{"message": "${{ steps.check.status }} ${{ steps.later.output.message }} ${{ steps.ghost.status }}"},
+							Compensate: &types.StepDef{Connector: "log", Action: "print"}},
+					},
+				},
+			},
+			{Name: "later", Connector: "log", Action: "print", Input: map[string]any{"message": "done"}},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected errors for invalid loop steps")
+	}
+	for _, want := range []string{
+		`step "check": connector "nonexistent" not found in registry`,
+		`step "report": invalid on_error value "explode"`,
+		`step "report": references step "later" which has not executed yet`,
+		`step "report": references unknown step "ghost"`,
+		`loop step "report": 'compensate' is not supported inside loops`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `references step "check"`) {
+		t.Errorf("loop steps may reference each other: %v", err)
+	}
+}
+
+func TestValidateFlowFinally(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "fetch", Connector: "http", Action: "request"},
+		},
+		Finally: []types.StepDef{
+			{Name: "cleanup", Connector: "http", Action: "request", Input: map[string]any{"url": "${{ steps.fetch.output.url }}"}},
+			{Name: "fetch", Connector: "nope", DependsOn: []string{"cleanup"}},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected error for invalid finally block")
+	}
+	for _, want := range []string{`finally[1]: duplicate step name "fetch"`, `connector "nope" not found`, "'depends_on' is not supported in finally"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), `step "cleanup": references`) {
+		t.Errorf("cleanup should be allowed to reference main steps, got: %v", err)
+	}
+}
+
+func TestValidateFlowCompensate(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{
+				Name:      "create",
+				Connector: "http",
+				Action:    "request",
+				Compensate: &types.StepDef{
+					Connector: "http",
+					Action:    "request",
+					Input:     map[string]any{"url": "${{ steps.missing.output.url }}"},
+					DependsOn: []string{"create"},
+				},
+			},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected error for invalid compensate step")
+	}
+	for _, want := range []string{`step "compensate-create": references unknown step "missing"`, "not supported in a compensate step"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestValidateFlowApproval(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "gate", Connector: "approval", Input: map[string]any{"timeout": "soon", "default": "maybe"}},
+			{Name: "group", Parallel: []types.StepDef{
+				{Name: "check", Connector: "shell", Action: "run", Input: map[string]any{"command": "true"}},
+				{Name: "parallel-gate", Connector: "approval"},
+			}},
+		},
+		Finally: []types.StepDef{
+			{Name: "late-gate", Connector: "approval"},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected error for invalid approval steps")
+	}
+	for _, want := range []string{
+		`invalid approval timeout "soon"`,
+		`invalid approval default "maybe"`,
+		"approval steps are not supported in finally",
+		`parallel step "parallel-gate": approval steps are not supported in parallel groups`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+	if strings.Contains(err.Error(), "not found in registry") {
+		t.Errorf("approval connector should not be looked up in the registry: %v", err)
+	}
+}
+
+func TestCheckChildFlowsApproval(t *testing.T) {
+	flows := map[string]*types.FlowDef{
+		"parent": {Name: "parent", Steps: []types.StepDef{
+			{Name: "setup", Connector: "flow", Flow: "setup"},
+			{Name: "notify", Connector: "flow", Input: map[string]any{"flow": "notify"}},
+		}},
+		"setup": {Name: "setup", Steps: []types.StepDef{
+			{Name: "nested", Connector: "flow", Flow: "gated"},
+		}},
+		"gated": {Name: "gated", Steps: []types.StepDef{
+			{Name: "gate", Connector: "approval"},
+		}},
+		"notify": {Name: "notify", Steps: []types.StepDef{
+			{Name: "log", Connector: "log", Action: "print", Input: map[string]any{"message": "done"}},
+		}},
+	}
+
+	_, err := CheckChildFlows(flows["parent"], flows)
+	if err == nil {
+		t.Fatal("expected error for an approval step in a child flow")
+	}
+	want := `step "setup": child flow "gated" has approval step "gate"; approval steps are not supported in child flows`
+	if !strings.Contains(err.Error(), want) || strings.Contains(err.Error(), `step "notify"`) {
+		t.Errorf("expected only error containing %q, got: %v", want, err)
+	}
+	if _, err := CheckChildFlows(flows["notify"], flows); err != nil {
+		t.Errorf("unexpected error for a flow without approval children: %v", err)
+	}
+}
+
+func TestValidateFlowExpressions(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "build", Connector: "shell", Action: "run"},
+			{Name: "deploy", Connector: "shell", Action: "run",
+				When:  `${{ steps.build.status == "success" && (input.env == "prod" }}`,
+				Input: map[string]any{"command": `echo ${{ input.env == }}`}},
+			{Name: "notify", Connector: "shell", Action: "run",
+				Input: map[string]any{"command": `echo ${{ input.ok && steps.later.output.x }}`}},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected errors for malformed expressions")
+	}
+	for _, want := range []string{
+		`step "deploy": when: invalid expression`,
+		"at column 56",
+		`step "deploy": invalid expression "input.env ==": unexpected end of expression at column 13`,
+		`step "notify": references unknown step "later"`,
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error containing %q, got: %v", want, err)
+		}
+	}
+}
+
+func TestCheckFlowShellQuotingWarnings(t *testing.T) {
+	flow := &types.FlowDef{
+		Name: "test",
+		Steps: []types.StepDef{
+			{Name: "unquoted", Connector: "shell", Action: "run",
+				Input: map[string]any{"command": `echo "${{ input.name }}" ${{ input.name | upper }}`}},
+			{Name: "quoted", Connector: "shell", Action: "run",
+				Input: map[string]any{"command": `echo ${{ input.name | trim | shellquote }} ${{ env.HOME }}`}},
+			{Name: "argv", Connector: "shell", Action: "run",
+				Input: map[string]any{"args": []any{"echo", "${{ input.name }}"}}},
+		},
+		Finally: []types.StepDef{
+			{Name: "cleanup", Connector: "shell", Action: "run",
+				Input: map[string]any{"command": `rm -rf ${{ input.dir }}`}},
+		},
+	}
+	diags, err := CheckFlow(flow, testRegistry())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	warnings := warningMessages(diags)
+	if len(warnings) != 2 {
+		t.Fatalf("expected 2 warnings, got %d: %v", len(warnings), warnings)
+	}
+	for i, want := range []string{
+		`step "unquoted": input.name is interpolated into 'command' without quoting`,
+		`step "cleanup": input.dir is interpolated into 'command' without quoting; use ${{ input.dir | shellquote }} or 'args'`,
+	} {
+		if !strings.Contains(warnings[i], want) {
+			t.Errorf("warning %d = %q, want %q", i, warnings[i], want)
+		}
+	}
+	if err := ValidateFlow(flow, testRegistry()); err != nil {
+		t.Errorf("warnings must not fail validation: %v", err)
+	}
+}
+
+// warningMessages returns the messages of the warnings among diags.
+func warningMessages(diags []Diagnostic) []string {
+	var msgs []string
+	for _, d := range diags {
+		if d.Severity == SeverityWarning {
+			msgs = append(msgs, d.Message)
+		}
+	}
+	return msgs
+}
+
+func TestValidateFlowSecrets(t *testing.T) {
+	flow := &types.FlowDef{
+		Name:            "test",
+		RequiresSecrets: []string{"API_KEY", "BAD NAME"},
+		Steps: []types.StepDef{
+			{Name: "child", Connector: "flow", Flow: "other", Secrets: types.SecretMapping{"TOKEN": "API_KEY"}},
+			{Name: "log", Connector: "log", Action: "print", Secrets: types.SecretMapping{"API_KEY": "API_KEY"}},
+		},
+	}
+	err := ValidateFlow(flow, testRegistry())
+	if err == nil {
+		t.Fatal("expected validation errors")
+	}
+	for _, want := range []string{`invalid secret name "BAD NAME"`, `step "log": 'secrets' is only supported on flow steps`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %v does not mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), `step "child"`) {
+		t.Errorf("unexpected error for the flow step: %v", err)
+	}
+}
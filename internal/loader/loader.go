@@ -18,10 +18,19 @@ func LoadFlow(path string) (*types.FlowDef, error) {
 		return nil, fmt.Errorf("reading flow file %s: %w", path, err)
 	}
 
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("parsing flow file %s: %w", path, err)
+	}
 	var flow types.FlowDef
-	if err := yaml.Unmarshal(data, &flow); err != nil {
+	if err := doc.Decode(&flow); err != nil {
 		return nil, fmt.Errorf("parsing flow file %s: %w", path, err)
 	}
+	flow.File = path
+	flow.Positions = make(map[string]types.Position)
+	if len(doc.Content) > 0 {
+		recordMapping(doc.Content[0], "", "flow", flow.Positions)
+	}
 
 	if flow.Name == "" {
 		return nil, fmt.Errorf("flow file %s: missing required field 'name'", path)
@@ -66,3 +75,69 @@ func LoadFlows(dir string) (map[string]*types.FlowDef, error) {
 
 	return flows, nil
 }
+
+// recordMapping records the position of every key of a YAML mapping under
+// its dotted path. kind tells which part of a flow the mapping is ("flow",
+// "step", "loop" or "other"), so step lists can be recognized: their steps
+// are recorded by name under "steps.<name>", wherever they are nested.
+func recordMapping(node *yaml.Node, path, kind string, pos map[string]types.Position) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, val := node.Content[i], node.Content[i+1]
+		p := key.Value
+		if path != "" {
+			p = path + "." + key.Value
+		}
+		pos[p] = types.Position{Line: key.Line, Column: key.Column}
+
+		switch {
+		case kind == "flow" && (key.Value == "steps" || key.Value == "on_failure" || key.Value == "finally"),
+			kind == "step" && key.Value == "parallel",
+			kind == "loop" && key.Value == "steps":
+			recordSteps(val, p, pos)
+		case kind == "step" && key.Value == "loop":
+			recordMapping(val, p, "loop", pos)
+		case kind == "step" && key.Value == "compensate":
+			name := mappingValue(val, "name")
+			if name == "" {
+				name = "compensate-" + strings.TrimPrefix(path, "steps.")
+			}
+			recordStep(val, name, pos)
+		default:
+			recordMapping(val, p, "other", pos)
+		}
+	}
+}
+
+// recordSteps records the steps of a step list by index and by name.
+func recordSteps(node *yaml.Node, path string, pos map[string]types.Position) {
+	if node.Kind != yaml.SequenceNode {
+		return
+	}
+	for j, item := range node.Content {
+		pos[fmt.Sprintf("%s.%d", path, j)] = types.Position{Line: item.Line, Column: item.Column}
+		if name := mappingValue(item, "name"); name != "" {
+			recordStep(item, name, pos)
+		}
+	}
+}
+
+func recordStep(node *yaml.Node, name string, pos map[string]types.Position) {
+	pos["steps."+name] = types.Position{Line: node.Line, Column: node.Column}
+	recordMapping(node, "steps."+name, "step", pos)
+}
+
+// mappingValue returns the scalar value of key in a YAML mapping.
+func mappingValue(node *yaml.Node, key string) string {
+	if node.Kind != yaml.MappingNode {
+		return ""
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1].Value
+		}
+	}
+	return ""
+}
@@ -134,3 +134,102 @@ steps:
 		t.Fatal("expected error for duplicate flow names")
 	}
 }
+
+func TestLoadFlowPositions(t *testing.T) {
+	dir := t.TempDir()
+	content := `name: positions
+steps:
+  - name: fetch
+    connector: http
+    action: request
+    input:
+      url: https://example.com
+  - name: block
+    loop:
+      until: "true"
+      steps:
+        - name: inner
+          connector: shell
+          action: run
+`
+	path := filepath.Join(dir, "flow.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flow, err := LoadFlow(path)
+	if err != nil {
+		t.Fatalf("LoadFlow error: %v", err)
+	}
+	if flow.File != path {
+		t.Errorf("File = %q, want %q", flow.File, path)
+	}
+	for p, want := range map[string][2]int{
+		"name":                     {1, 1},
+		"steps.fetch":              {3, 5},
+		"steps.fetch.input.url":    {7, 7},
+		"steps.fetch.input.url.x":  {7, 7},
+		"steps.block.loop.until":   {10, 7},
+		"steps.inner.action":       {14, 11},
+		"steps.block.loop.steps.0": {12, 11},
+	} {
+		pos, ok := flow.Position(p)
+		if !ok || pos.Line != want[0] || pos.Column != want[1] {
+			t.Errorf("Position(%q) = %v, %v; want line %d column %d", p, pos, ok, want[0], want[1])
+		}
+	}
+}
+
+func TestLoadFlowSecretMapping(t *testing.T) {
+	dir := t.TempDir()
+	content := `
+name: parent
+requires_secrets: [GITHUB_TOKEN, API_KEY]
+steps:
+  - name: list
+    connector: flow
+    flow: child
+    secrets: [API_KEY]
+  - name: mapping
+    connector: flow
+    flow: child
+    secrets:
+      DEPLOY_TOKEN: GITHUB_TOKEN
+  - name: none
+    connector: flow
+    flow: child
+    secrets: []
+  - name: all
+    connector: flow
+    flow: child
+`
+	path := filepath.Join(dir, "parent.yaml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	flow, err := LoadFlow(path)
+	if err != nil {
+		t.Fatalf("LoadFlow error: %v", err)
+	}
+	if len(flow.RequiresSecrets) != 2 || flow.RequiresSecrets[0] != "GITHUB_TOKEN" {
+		t.Errorf("requires_secrets = %v", flow.RequiresSecrets)
+	}
+	if m := flow.Steps[0].Secrets; len(m) != 1 || m["API_KEY"] != "API_KEY" {
+		t.Errorf("list form = %v", m)
+	}
+	if m := flow.Steps[1].Secrets; len(m) != 1 || m["DEPLOY_TOKEN"] != "GITHUB_TOKEN" {
+		t.Errorf("mapping form = %v", m)
+	}
+	if m := flow.Steps[2].Secrets; m == nil || len(m) != 0 {
+		t.Errorf("empty list = %#v, want an empty, non-nil mapping", m)
+	}
+	if flow.Steps[3].Secrets != nil {
+		t.Errorf("no secrets = %v, want nil", flow.Steps[3].Secrets)
+	}
+
+	os.WriteFile(path, []byte("name: bad\nsteps:\n  - name: a\n    connector: flow\n    secrets: API_KEY\n"), 0644)
+	if _, err := LoadFlow(path); err == nil {
+		t.Error("expected an error for a scalar secrets value")
+	}
+}
@@ -30,13 +30,13 @@ func (l *LogConnector) Actions() []plugin.ActionDef {
 	}
 }
 
-func (l *LogConnector) Execute(_ context.Context, action string, input map[string]any) (*types.StepResult, error) {
+func (l *LogConnector) Execute(ctx context.Context, action string, input map[string]any) (*types.StepResult, error) {
 	if action != "print" {
 		return nil, fmt.Errorf("log connector: unknown action %q", action)
 	}
 
 	message := fmt.Sprintf("%v", input["message"])
-	fmt.Println("[log]", message)
+	fmt.Println("[log]", plugin.Redact(ctx, message))
 
 	return &types.StepResult{
 		Status: "success",
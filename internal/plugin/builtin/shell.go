@@ -5,12 +5,18 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+	"time"
 
 	"piper/internal/plugin"
 	"piper/internal/types"
 )
 
-// ShellConnector executes shell commands.
+// waitDelay bounds how long a cancelled command may keep its I/O open.
+const waitDelay = 2 * time.Second
+
+// ShellConnector executes shell commands, or a program with an argument
+// list when 'args' is given, in which case no shell is involved and the
+// arguments need no quoting.
 type ShellConnector struct{}
 
 func NewShellConnector() *ShellConnector { return &ShellConnector{} }
@@ -21,9 +27,10 @@ func (s *ShellConnector) Actions() []plugin.ActionDef {
 	return []plugin.ActionDef{
 		{
 			Name:        "run",
-			Description: "Execute a shell command",
+			Description: "Execute a shell command, or a program with arguments",
 			Input: map[string]types.FieldDef{
-				"command": {Type: "string", Description: "Command to execute", Required: true},
+				"command": {Type: "string", Description: "Command to execute with sh -c (required unless args is set)", Required: false},
+				"args":    {Type: "array", Description: "Program and arguments to execute directly, without a shell", Required: false},
 				"dir":     {Type: "string", Description: "Working directory", Required: false},
 			},
 			Output: map[string]types.FieldDef{
@@ -40,12 +47,15 @@ func (s *ShellConnector) Execute(ctx context.Context, action string, input map[s
 		return nil, fmt.Errorf("shell connector: unknown action %q", action)
 	}
 
-	command, _ := input["command"].(string)
-	if command == "" {
-		return nil, fmt.Errorf("shell connector: 'command' is required")
+	argv, err := shellArgs(input)
+	if err != nil {
+		return nil, err
 	}
 
-	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	// Don't wait forever for output pipes held open by orphaned children
+	// once the command has been killed on timeout.
+	cmd.WaitDelay = waitDelay
 
 	if dir, ok := input["dir"].(string); ok && dir != "" {
 		cmd.Dir = dir
@@ -55,10 +65,14 @@ func (s *ShellConnector) Execute(ctx context.Context, action string, input map[s
 	cmd.Stdout = &stdout
 	cmd.Stderr = &stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 
 	exitCode := 0
 	if err != nil {
+		// A command killed because the context ended failed because of it.
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("shell connector: %w", ctxErr)
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			exitCode = exitErr.ExitCode()
 		} else {
@@ -82,3 +96,42 @@ func (s *ShellConnector) Execute(ctx context.Context, action string, input map[s
 }
 
 func (s *ShellConnector) Validate() error { return nil }
+
+// shellArgs returns the argv to execute: sh -c <command>, or args as given.
+func shellArgs(input map[string]any) ([]string, error) {
+	command, _ := input["command"].(string)
+	rawArgs, hasArgs := input["args"]
+	switch {
+	case hasArgs && command != "":
+		return nil, fmt.Errorf("shell connector: set either 'command' or 'args', not both")
+	case !hasArgs:
+		if command == "" {
+			return nil, fmt.Errorf("shell connector: 'command' or 'args' is required")
+		}
+		return []string{"sh", "-c", command}, nil
+	}
+
+	var argv []string
+	switch v := rawArgs.(type) {
+	case []string:
+		argv = v
+	case []any:
+		for _, a := range v {
+			// An array element (e.g. a whole ${{ input.files }} reference)
+			// expands to one argument per item.
+			if items, ok := a.([]any); ok {
+				for _, item := range items {
+					argv = append(argv, fmt.Sprintf("%v", item))
+				}
+				continue
+			}
+			argv = append(argv, fmt.Sprintf("%v", a))
+		}
+	default:
+		return nil, fmt.Errorf("shell connector: 'args' must be an array, got %T", rawArgs)
+	}
+	if len(argv) == 0 || argv[0] == "" {
+		return nil, fmt.Errorf("shell connector: 'args' must start with the program to run")
+	}
+	return argv, nil
+}
@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"piper/internal/types"
 )
@@ -81,9 +82,13 @@ func (ec *ExternalConnector) Execute(ctx context.Context, action string, input m
 
 	cmd := exec.CommandContext(ctx, ec.path)
 	cmd.Stdin = strings.NewReader(string(reqJSON))
+	cmd.WaitDelay = 2 * time.Second
 
 	out, err := cmd.Output()
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("running plugin: %w", ctxErr)
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
 			return &types.StepResult{
 				Status: "error",
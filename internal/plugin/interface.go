@@ -28,3 +28,20 @@ type ActionDef struct {
 	Input       map[string]types.FieldDef
 	Output      map[string]types.FieldDef
 }
+
+type redactorKey struct{}
+
+// WithRedactor returns a context that carries a function masking secret
+// values. The engine sets it for every step, so connectors can mask secrets
+// in what they write outside the step result, such as log lines.
+func WithRedactor(ctx context.Context, redact func(string) string) context.Context {
+	return context.WithValue(ctx, redactorKey{}, redact)
+}
+
+// Redact masks secret values in s using the context's redactor, if any.
+func Redact(ctx context.Context, s string) string {
+	if redact, ok := ctx.Value(redactorKey{}).(func(string) string); ok {
+		return redact(s)
+	}
+	return s
+}
@@ -0,0 +1,173 @@
+package secrets
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultEnvPrefix selects the environment variables read by the env
+// provider: PIPER_SECRET_API_KEY becomes the secret API_KEY.
+const DefaultEnvPrefix = "PIPER_SECRET_"
+
+// EnvFile reads a .env-style file (KEY=VALUE per line).
+type EnvFile struct {
+	Path     string
+	Optional bool
+}
+
+func (p *EnvFile) Name() string { return "env-file " + p.Path }
+
+func (p *EnvFile) Load() (map[string]string, error) {
+	f, err := os.Open(p.Path)
+	if missing(err, p.Optional) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("opening secrets file: %w", err)
+	}
+	defer f.Close()
+	return ParseEnvFile(f)
+}
+
+// ParseEnvFile parses KEY=VALUE lines. Lines starting with # are comments,
+// empty lines are skipped and values may be wrapped in single or double
+// quotes.
+func ParseEnvFile(r io.Reader) (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("secrets file line %d: invalid format (expected KEY=VALUE)", lineNum)
+		}
+
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+
+		// Strip surrounding quotes.
+		if len(value) >= 2 {
+			if (value[0] == '"' && value[len(value)-1] == '"') ||
+				(value[0] == '\'' && value[len(value)-1] == '\'') {
+				value = value[1 : len(value)-1]
+			}
+		}
+
+		secrets[key] = value
+	}
+
+	return secrets, scanner.Err()
+}
+
+// Env reads environment variables whose names start with Prefix, without
+// the prefix.
+type Env struct {
+	Prefix string
+}
+
+func (p *Env) Name() string { return "env " + p.Prefix + "*" }
+
+func (p *Env) Load() (map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, kv := range os.Environ() {
+		name, value, _ := strings.Cut(kv, "=")
+		if key, ok := strings.CutPrefix(name, p.Prefix); ok && key != "" {
+			secrets[key] = value
+		}
+	}
+	return secrets, nil
+}
+
+// Dir reads one secret per file, named after the file, as Docker and
+// Kubernetes mount them. A single trailing newline is removed; hidden files
+// and subdirectories are skipped.
+type Dir struct {
+	Path     string
+	Optional bool
+}
+
+func (p *Dir) Name() string { return "dir " + p.Path }
+
+func (p *Dir) Load() (map[string]string, error) {
+	entries, err := os.ReadDir(p.Path)
+	if missing(err, p.Optional) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(p.Path, e.Name())
+		// Stat follows symlinks, which Kubernetes uses for every key.
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		value := strings.TrimSuffix(string(data), "\n")
+		secrets[e.Name()] = strings.TrimSuffix(value, "\r")
+	}
+	return secrets, nil
+}
+
+// execTimeout bounds how long a secrets helper may run.
+const execTimeout = 30 * time.Second
+
+// Exec runs a helper program that prints the secrets as a JSON object of
+// strings, such as a wrapper around a password manager's CLI.
+type Exec struct {
+	Command []string
+	Dir     string
+}
+
+func (p *Exec) Name() string { return "exec " + strings.Join(p.Command, " ") }
+
+func (p *Exec) Load() (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.Command[0], p.Command[1:]...)
+	cmd.Dir = p.Dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(stdout.Bytes(), &secrets); err != nil {
+		return nil, fmt.Errorf("parsing output: expected a JSON object of strings: %w", err)
+	}
+	return secrets, nil
+}
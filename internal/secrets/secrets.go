@@ -0,0 +1,132 @@
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Provider is a source of secrets, referenced in flows as ${{ secret.KEY }}.
+type Provider interface {
+	// Name describes the provider in errors, e.g. "env-file .env".
+	Name() string
+	// Load returns the provider's secrets by key.
+	Load() (map[string]string, error)
+}
+
+// KeyLoader is implemented by providers that can read some of their
+// secrets without the others, such as the vault, which then only decrypts
+// the secrets a flow uses.
+type KeyLoader interface {
+	Provider
+	// LoadKeys returns the provider's secrets among keys.
+	LoadKeys(keys []string) (map[string]string, error)
+}
+
+// Spec configures a provider. It is one entry of the secrets list in the
+// project config (piper.yaml).
+type Spec struct {
+	// Type is the provider: env-file, env, dir, vault or exec.
+	Type string `yaml:"type"`
+	// Path is the file (env-file, vault) or directory (dir) to read.
+	Path string `yaml:"path,omitempty"`
+	// Prefix selects environment variables (env); it is stripped from keys.
+	Prefix string `yaml:"prefix,omitempty"`
+	// Command is the program and arguments to run (exec).
+	Command []string `yaml:"command,omitempty"`
+	// KeyFile holds the vault key; PassphraseEnv names the environment
+	// variable with the vault passphrase, used when KeyFile is not set.
+	KeyFile       string `yaml:"key_file,omitempty"`
+	PassphraseEnv string `yaml:"passphrase_env,omitempty"`
+	// Optional skips a file or directory that does not exist.
+	Optional bool `yaml:"optional,omitempty"`
+}
+
+// New creates the provider a spec describes. Relative paths are resolved
+// against baseDir, the directory of the config file.
+func New(spec Spec, baseDir string) (Provider, error) {
+	path := spec.Path
+	if path != "" && !filepath.IsAbs(path) {
+		path = filepath.Join(baseDir, path)
+	}
+	keyFile := spec.KeyFile
+	if keyFile != "" && !filepath.IsAbs(keyFile) {
+		keyFile = filepath.Join(baseDir, keyFile)
+	}
+
+	switch spec.Type {
+	case "env-file":
+		if path == "" {
+			return nil, fmt.Errorf("secrets provider env-file: 'path' is required")
+		}
+		return &EnvFile{Path: path, Optional: spec.Optional}, nil
+	case "env":
+		prefix := spec.Prefix
+		if prefix == "" {
+			prefix = DefaultEnvPrefix
+		}
+		return &Env{Prefix: prefix}, nil
+	case "dir":
+		if path == "" {
+			return nil, fmt.Errorf("secrets provider dir: 'path' is required")
+		}
+		return &Dir{Path: path, Optional: spec.Optional}, nil
+	case "vault":
+		if path == "" {
+			return nil, fmt.Errorf("secrets provider vault: 'path' is required")
+		}
+		return &VaultFile{Path: path, KeyFile: keyFile, PassphraseEnv: spec.PassphraseEnv, Optional: spec.Optional}, nil
+	case "exec":
+		if len(spec.Command) == 0 {
+			return nil, fmt.Errorf("secrets provider exec: 'command' is required")
+		}
+		return &Exec{Command: spec.Command, Dir: baseDir}, nil
+	case "":
+		return nil, fmt.Errorf("secrets provider: 'type' is required")
+	}
+	return nil, fmt.Errorf("unknown secrets provider type %q (want env-file, env, dir, vault or exec)", spec.Type)
+}
+
+// Load merges the secrets of the providers in order; a later provider
+// overrides keys of an earlier one.
+func Load(providers ...Provider) (map[string]string, error) {
+	merged := make(map[string]string)
+	for _, p := range providers {
+		values, err := p.Load()
+		if err != nil {
+			return nil, fmt.Errorf("loading secrets from %s: %w", p.Name(), err)
+		}
+		for k, v := range values {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// LoadUsed is Load for a run that uses the given secrets: providers that
+// implement KeyLoader only read those keys. Other providers are read
+// whole.
+func LoadUsed(keys []string, providers ...Provider) (map[string]string, error) {
+	merged := make(map[string]string)
+	for _, p := range providers {
+		var values map[string]string
+		var err error
+		if kl, ok := p.(KeyLoader); ok {
+			values, err = kl.LoadKeys(keys)
+		} else {
+			values, err = p.Load()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loading secrets from %s: %w", p.Name(), err)
+		}
+		for k, v := range values {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// missing reports whether err means an optional file is absent.
+func missing(err error, optional bool) bool {
+	return optional && os.IsNotExist(err)
+}
@@ -0,0 +1,121 @@
+package secrets
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, ".env")
+	os.WriteFile(path, []byte("# comment\nAPI_KEY='sk-test-123'\n\nDB_PASSWORD=\"super secret\"\n"), 0644)
+
+	values, err := (&EnvFile{Path: path}).Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if values["API_KEY"] != "sk-test-123" || values["DB_PASSWORD"] != "super secret" || len(values) != 2 {
+		t.Errorf("values = %v", values)
+	}
+
+	if _, err := (&EnvFile{Path: filepath.Join(dir, "missing")}).Load(); err == nil {
+		t.Error("expected error for a missing file")
+	}
+	if values, err := (&EnvFile{Path: filepath.Join(dir, "missing"), Optional: true}).Load(); err != nil || len(values) != 0 {
+		t.Errorf("optional missing file = %v, %v; want no secrets", values, err)
+	}
+}
+
+func TestEnv(t *testing.T) {
+	t.Setenv("PIPER_SECRET_API_KEY", "from-env")
+	t.Setenv("PIPER_SECRET_", "ignored")
+	t.Setenv("OTHER_API_KEY", "ignored")
+
+	values, err := (&Env{Prefix: DefaultEnvPrefix}).Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if values["API_KEY"] != "from-env" {
+		t.Errorf("API_KEY = %q, want from-env", values["API_KEY"])
+	}
+	if _, ok := values[""]; ok {
+		t.Error("the bare prefix must not become a secret")
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "db_password"), []byte("hunter2\n"), 0600)
+	os.WriteFile(filepath.Join(dir, "token"), []byte("multi\nline"), 0600)
+	os.WriteFile(filepath.Join(dir, ".hidden"), []byte("x"), 0600)
+	os.Mkdir(filepath.Join(dir, "..data"), 0755)
+	os.WriteFile(filepath.Join(dir, "..data", "api_key"), []byte("linked"), 0600)
+	os.Symlink(filepath.Join("..data", "api_key"), filepath.Join(dir, "api_key"))
+
+	values, err := (&Dir{Path: dir}).Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	want := map[string]string{"db_password": "hunter2", "token": "multi\nline", "api_key": "linked"}
+	if len(values) != len(want) {
+		t.Errorf("values = %v, want %v", values, want)
+	}
+	for k, v := range want {
+		if values[k] != v {
+			t.Errorf("%s = %q, want %q", k, values[k], v)
+		}
+	}
+}
+
+func TestExec(t *testing.T) {
+	values, err := (&Exec{Command: []string{"sh", "-c", `echo '{"API_KEY": "from-helper"}'`}}).Load()
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if values["API_KEY"] != "from-helper" {
+		t.Errorf("API_KEY = %q, want from-helper", values["API_KEY"])
+	}
+
+	_, err = (&Exec{Command: []string{"sh", "-c", "echo locked >&2; exit 1"}}).Load()
+	if err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("expected the helper's stderr in the error, got %v", err)
+	}
+	_, err = (&Exec{Command: []string{"sh", "-c", `echo '{"PORT": 5432}'`}}).Load()
+	if err == nil || !strings.Contains(err.Error(), "JSON object of strings") {
+		t.Errorf("expected a parse error, got %v", err)
+	}
+}
+
+func TestNewAndLoad(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("A=file\nB=file\n"), 0644)
+	t.Setenv("APP_B", "env")
+
+	var providers []Provider
+	for _, spec := range []Spec{
+		{Type: "env-file", Path: ".env"},
+		{Type: "env", Prefix: "APP_"},
+		{Type: "dir", Path: "missing", Optional: true},
+	} {
+		p, err := New(spec, dir)
+		if err != nil {
+			t.Fatalf("New(%+v): %v", spec, err)
+		}
+		providers = append(providers, p)
+	}
+	values, err := Load(providers...)
+	if err != nil {
+		t.Fatalf("Load error: %v", err)
+	}
+	if values["A"] != "file" || values["B"] != "env" {
+		t.Errorf("values = %v, want A from the file and B overridden by env", values)
+	}
+
+	for _, spec := range []Spec{{}, {Type: "keychain"}, {Type: "env-file"}, {Type: "exec"}} {
+		if _, err := New(spec, dir); err == nil {
+			t.Errorf("New(%+v): expected error", spec)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultPassphraseEnv is the environment variable holding the vault
+// passphrase when no key file is configured.
+const DefaultPassphraseEnv = "PIPER_VAULT_PASSPHRASE"
+
+// ErrWrongPassphrase is returned when a vault cannot be opened with the
+// given passphrase or key.
+var ErrWrongPassphrase = errors.New("wrong vault passphrase or key")
+
+// vaultIterations is the PBKDF2 iteration count of new vaults.
+var vaultIterations = 600_000
+
+const (
+	vaultVersion = 1
+	vaultKDF     = "pbkdf2-sha256"
+	vaultCheck   = "piper-vault"
+)
+
+// vaultData is the JSON form of a vault file. Every value is encrypted on
+// its own with AES-256-GCM, bound to its key name, so a vault can be listed
+// without decrypting it and changes show up per key in version control.
+type vaultData struct {
+	Version int               `json:"version"`
+	KDF     vaultKDFParams    `json:"kdf"`
+	Check   string            `json:"check"`
+	Secrets map[string]string `json:"secrets"`
+}
+
+type vaultKDFParams struct {
+	Name       string `json:"name"`
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+}
+
+// Vault is an encrypted secrets file. The encryption key is derived from a
+// passphrase (or the contents of a key file) with PBKDF2-SHA256. A vault read
+// by ReadVault is locked: its keys can be listed, but values can only be
+// read or written after Unlock.
+type Vault struct {
+	path string
+	data vaultData
+	aead cipher.AEAD
+}
+
+// CreateVault returns a new, empty vault for path. It is written by Save.
+func CreateVault(path, passphrase string) (*Vault, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	v := &Vault{path: path, data: vaultData{
+		Version: vaultVersion,
+		Secrets: make(map[string]string),
+	}}
+	if err := v.rekey(passphrase, salt); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// OpenVault reads a vault file and unlocks it. Values are only decrypted by
+// Get and All.
+func OpenVault(path, passphrase string) (*Vault, error) {
+	v, err := ReadVault(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ReadVault reads a vault file without unlocking it.
+func ReadVault(path string) (*Vault, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	v := &Vault{path: path}
+	if err := json.Unmarshal(raw, &v.data); err != nil {
+		return nil, fmt.Errorf("parsing vault %s: %w", path, err)
+	}
+	if v.data.Version != vaultVersion {
+		return nil, fmt.Errorf("vault %s: unsupported version %d", path, v.data.Version)
+	}
+	if v.data.KDF.Name != vaultKDF || v.data.KDF.Iterations <= 0 {
+		return nil, fmt.Errorf("vault %s: unsupported key derivation %q", path, v.data.KDF.Name)
+	}
+	if v.data.Secrets == nil {
+		v.data.Secrets = make(map[string]string)
+	}
+	return v, nil
+}
+
+// Path returns the vault's file.
+func (v *Vault) Path() string { return v.path }
+
+// Unlock derives the vault's key from the passphrase and checks it.
+func (v *Vault) Unlock(passphrase string) error {
+	salt, err := base64.StdEncoding.DecodeString(v.data.KDF.Salt)
+	if err != nil {
+		return fmt.Errorf("vault %s: invalid salt: %w", v.path, err)
+	}
+	aead, err := deriveAEAD(passphrase, salt, v.data.KDF.Iterations)
+	if err != nil {
+		return err
+	}
+	locked := v.aead
+	v.aead = aead
+	if check, err := v.open("", v.data.Check); err != nil || check != vaultCheck {
+		v.aead = locked
+		return ErrWrongPassphrase
+	}
+	return nil
+}
+
+// Rotate re-encrypts every secret under a new passphrase and a new salt.
+func (v *Vault) Rotate(passphrase string) error {
+	if v.aead == nil {
+		return v.errLocked()
+	}
+	values, err := v.All()
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	if err := v.rekey(passphrase, salt); err != nil {
+		return err
+	}
+	v.data.Secrets = make(map[string]string, len(values))
+	for key, value := range values {
+		if err := v.Set(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rekey sets up a new key derived from passphrase and salt, with the
+// current iteration count, and seals the passphrase check with it.
+func (v *Vault) rekey(passphrase string, salt []byte) error {
+	if passphrase == "" {
+		return errors.New("vault passphrase is empty")
+	}
+	kdf := vaultKDFParams{Name: vaultKDF, Iterations: vaultIterations, Salt: base64.StdEncoding.EncodeToString(salt)}
+	aead, err := deriveAEAD(passphrase, salt, kdf.Iterations)
+	if err != nil {
+		return err
+	}
+	v.aead = aead
+	v.data.KDF = kdf
+	check, err := v.seal("", vaultCheck)
+	if err != nil {
+		return err
+	}
+	v.data.Check = check
+	return nil
+}
+
+func deriveAEAD(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key := pbkdf2SHA256([]byte(passphrase), salt, iterations, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// errLocked is returned when a value is read or written before Unlock.
+func (v *Vault) errLocked() error {
+	return fmt.Errorf("vault %s is locked", v.path)
+}
+
+// seal encrypts a value for key; the result is the base64 of nonce and
+// ciphertext.
+func (v *Vault) seal(key, value string) (string, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := v.aead.Seal(nonce, nonce, []byte(value), []byte(key))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (v *Vault) open(key, sealed string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < v.aead.NonceSize() {
+		return "", fmt.Errorf("vault %s: secret %q is corrupt", v.path, key)
+	}
+	n := v.aead.NonceSize()
+	plain, err := v.aead.Open(nil, raw[:n], raw[n:], []byte(key))
+	if err != nil {
+		return "", fmt.Errorf("vault %s: secret %q cannot be decrypted", v.path, key)
+	}
+	return string(plain), nil
+}
+
+// Keys returns the names of the vault's secrets, sorted.
+func (v *Vault) Keys() []string {
+	keys := make([]string, 0, len(v.data.Secrets))
+	for k := range v.data.Secrets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Has reports whether the vault holds key.
+func (v *Vault) Has(key string) bool {
+	_, ok := v.data.Secrets[key]
+	return ok
+}
+
+// Get decrypts one secret.
+func (v *Vault) Get(key string) (string, error) {
+	if v.aead == nil {
+		return "", v.errLocked()
+	}
+	sealed, ok := v.data.Secrets[key]
+	if !ok {
+		return "", fmt.Errorf("vault %s has no secret %q", v.path, key)
+	}
+	return v.open(key, sealed)
+}
+
+// All decrypts every secret.
+func (v *Vault) All() (map[string]string, error) {
+	values := make(map[string]string, len(v.data.Secrets))
+	for key := range v.data.Secrets {
+		value, err := v.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Set encrypts and stores a secret, replacing any previous value.
+func (v *Vault) Set(key, value string) error {
+	if key == "" || strings.ContainsAny(key, " \t\r\n") {
+		return fmt.Errorf("invalid secret name %q", key)
+	}
+	if v.aead == nil {
+		return v.errLocked()
+	}
+	sealed, err := v.seal(key, value)
+	if err != nil {
+		return err
+	}
+	v.data.Secrets[key] = sealed
+	return nil
+}
+
+// Remove deletes a secret and reports whether the vault held it.
+func (v *Vault) Remove(key string) bool {
+	_, ok := v.data.Secrets[key]
+	delete(v.data.Secrets, key)
+	return ok
+}
+
+// Save writes the vault to its file, replacing it atomically.
+func (v *Vault) Save() error {
+	raw, err := json.MarshalIndent(v.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+
+	tmp, err := os.CreateTemp(filepath.Dir(v.path), "."+filepath.Base(v.path)+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("writing vault %s: %w", v.path, err)
+	}
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing vault %s: %w", v.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing vault %s: %w", v.path, err)
+	}
+	if err := os.Rename(tmp.Name(), v.path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing vault %s: %w", v.path, err)
+	}
+	return nil
+}
+
+// VaultPassphrase returns the vault passphrase: the contents of keyFile
+// (without surrounding whitespace) if set, or else the value of the
+// environment variable envName, DefaultPassphraseEnv by default.
+func VaultPassphrase(keyFile, envName string) (string, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", fmt.Errorf("reading vault key file: %w", err)
+		}
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return "", fmt.Errorf("vault key file %s is empty", keyFile)
+		}
+		return key, nil
+	}
+	if envName == "" {
+		envName = DefaultPassphraseEnv
+	}
+	passphrase := os.Getenv(envName)
+	if passphrase == "" {
+		return "", fmt.Errorf("no vault passphrase: set %s or configure a key file", envName)
+	}
+	return passphrase, nil
+}
+
+// VaultFile provides the secrets of a vault file.
+type VaultFile struct {
+	Path          string
+	KeyFile       string
+	PassphraseEnv string
+	Optional      bool
+}
+
+func (p *VaultFile) Name() string { return "vault " + p.Path }
+
+func (p *VaultFile) Load() (map[string]string, error) {
+	return p.LoadKeys(nil)
+}
+
+// LoadKeys decrypts only the given secrets, or all of them if keys is nil.
+// The passphrase is not needed when the vault holds none of the keys.
+func (p *VaultFile) LoadKeys(keys []string) (map[string]string, error) {
+	v, err := ReadVault(p.Path)
+	if missing(err, p.Optional) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = v.Keys()
+	}
+	var wanted []string
+	for _, key := range keys {
+		if v.Has(key) {
+			wanted = append(wanted, key)
+		}
+	}
+	if len(wanted) == 0 {
+		return nil, nil
+	}
+
+	passphrase, err := VaultPassphrase(p.KeyFile, p.PassphraseEnv)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.Unlock(passphrase); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(wanted))
+	for _, key := range wanted {
+		if values[key], err = v.Get(key); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// pbkdf2SHA256 derives a key with PBKDF2 (RFC 8018) using HMAC-SHA256.
+func pbkdf2SHA256(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	blocks := (keyLen + hashLen - 1) / hashLen
+
+	key := make([]byte, 0, blocks*hashLen)
+	var buf [4]byte
+	u := make([]byte, hashLen)
+	t := make([]byte, hashLen)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		u = prf.Sum(u[:0])
+		copy(t, u)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,200 @@
+package secrets
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// Keep key derivation fast in tests.
+	vaultIterations = 1000
+}
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914, section 11.
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64))
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if got != want {
+		t.Errorf("pbkdf2 = %s, want %s", got, want)
+	}
+}
+
+func TestVault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.vault")
+	v, err := CreateVault(path, "correct horse")
+	if err != nil {
+		t.Fatalf("CreateVault: %v", err)
+	}
+	if err := v.Set("API_KEY", "sk-test-123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Set("DB_PASSWORD", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	if strings.Contains(string(raw), "sk-test-123") || strings.Contains(string(raw), "hunter2") {
+		t.Fatalf("vault file contains plaintext: %s", raw)
+	}
+	if !strings.Contains(string(raw), `"API_KEY"`) {
+		t.Errorf("vault file should list key names: %s", raw)
+	}
+
+	if _, err := OpenVault(path, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("OpenVault with a wrong passphrase = %v, want ErrWrongPassphrase", err)
+	}
+
+	v, err = OpenVault(path, "correct horse")
+	if err != nil {
+		t.Fatalf("OpenVault: %v", err)
+	}
+	if keys := v.Keys(); len(keys) != 2 || keys[0] != "API_KEY" || keys[1] != "DB_PASSWORD" {
+		t.Errorf("Keys = %v", keys)
+	}
+	if value, err := v.Get("DB_PASSWORD"); err != nil || value != "hunter2" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+
+	// A value moved to another key must not decrypt.
+	v.data.Secrets["DB_PASSWORD"] = v.data.Secrets["API_KEY"]
+	if _, err := v.Get("DB_PASSWORD"); err == nil {
+		t.Error("expected an error for a value sealed for another key")
+	}
+}
+
+func TestVaultFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secrets.vault")
+	keyFile := filepath.Join(dir, "vault.key")
+	os.WriteFile(keyFile, []byte("key-material\n"), 0600)
+
+	v, err := CreateVault(path, "key-material")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Set("API_KEY", "sk-test-123")
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := (&VaultFile{Path: path, KeyFile: keyFile}).Load()
+	if err != nil || values["API_KEY"] != "sk-test-123" {
+		t.Errorf("key file: values = %v, err = %v", values, err)
+	}
+
+	t.Setenv(DefaultPassphraseEnv, "key-material")
+	values, err = (&VaultFile{Path: path}).Load()
+	if err != nil || values["API_KEY"] != "sk-test-123" {
+		t.Errorf("passphrase env: values = %v, err = %v", values, err)
+	}
+
+	t.Setenv(DefaultPassphraseEnv, "")
+	if _, err := (&VaultFile{Path: path}).Load(); err == nil || !strings.Contains(err.Error(), DefaultPassphraseEnv) {
+		t.Errorf("expected a missing passphrase error, got %v", err)
+	}
+}
+
+func TestVaultRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.vault")
+	v, err := CreateVault(path, "old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Set("API_KEY", "sk-test-123")
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	oldSalt := v.data.KDF.Salt
+
+	if err := v.Rotate("new"); err != nil {
+		t.Fatalf("Rotate: %v", err)
+	}
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if v.data.KDF.Salt == oldSalt {
+		t.Error("Rotate should use a new salt")
+	}
+
+	if _, err := OpenVault(path, "old"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("OpenVault with the old passphrase = %v, want ErrWrongPassphrase", err)
+	}
+	v, err = OpenVault(path, "new")
+	if err != nil {
+		t.Fatalf("OpenVault: %v", err)
+	}
+	if value, err := v.Get("API_KEY"); err != nil || value != "sk-test-123" {
+		t.Errorf("Get = %q, %v", value, err)
+	}
+}
+
+func TestVaultLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.vault")
+	v, _ := CreateVault(path, "correct horse")
+	v.Set("API_KEY", "sk-test-123")
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := ReadVault(path)
+	if err != nil {
+		t.Fatalf("ReadVault: %v", err)
+	}
+	if keys := v.Keys(); len(keys) != 1 || keys[0] != "API_KEY" {
+		t.Errorf("Keys = %v", keys)
+	}
+	if _, err := v.Get("API_KEY"); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("Get on a locked vault = %v, want a locked error", err)
+	}
+	if err := v.Set("OTHER", "x"); err == nil {
+		t.Error("expected Set on a locked vault to fail")
+	}
+	if err := v.Unlock("wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("Unlock = %v, want ErrWrongPassphrase", err)
+	}
+	if _, err := v.Get("API_KEY"); err == nil {
+		t.Error("a failed Unlock should leave the vault locked")
+	}
+	if !v.Remove("API_KEY") || v.Remove("API_KEY") {
+		t.Error("Remove should report whether the key was present")
+	}
+}
+
+func TestVaultFileLoadKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.vault")
+	v, _ := CreateVault(path, "key-material")
+	v.Set("API_KEY", "sk-test-123")
+	v.Set("DB_PASSWORD", "hunter2")
+	if err := v.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No passphrase is needed when the vault holds none of the keys.
+	t.Setenv(DefaultPassphraseEnv, "")
+	values, err := (&VaultFile{Path: path}).LoadKeys([]string{"OTHER"})
+	if err != nil || len(values) != 0 {
+		t.Errorf("LoadKeys of unknown keys = %v, %v", values, err)
+	}
+
+	t.Setenv(DefaultPassphraseEnv, "key-material")
+	values, err = (&VaultFile{Path: path}).LoadKeys([]string{"API_KEY", "OTHER"})
+	if err != nil {
+		t.Fatalf("LoadKeys: %v", err)
+	}
+	if len(values) != 1 || values["API_KEY"] != "sk-test-123" {
+		t.Errorf("LoadKeys = %v, want only API_KEY", values)
+	}
+
+	t.Setenv("PIPER_TEST_EXTRA", "x")
+	values, err = LoadUsed([]string{"DB_PASSWORD"}, &VaultFile{Path: path}, &Env{Prefix: "PIPER_TEST_"})
+	if err != nil || len(values) != 2 || values["DB_PASSWORD"] != "hunter2" || values["EXTRA"] != "x" {
+		t.Errorf("LoadUsed = %v, %v", values, err)
+	}
+}
@@ -16,6 +16,13 @@ import (
 type MCPServer struct {
 	engine *engine.Engine
 	flows  map[string]*types.FlowDef
+	// MappedOutput makes tools/call return only the flow's mapped output
+	// instead of the full flow result. If a value could not be mapped, the
+	// call is an error that returns the output with its output_errors.
+	MappedOutput bool
+	// AllowApprovals exposes the approval tool. It is off by default, since
+	// an agent that starts a flow could otherwise approve its own gate.
+	AllowApprovals bool
 }
 
 // NewMCPServer creates a new MCP server.
@@ -160,8 +167,17 @@ func (s *MCPServer) handleRequest(req jsonRPCRequest) *jsonRPCResponse {
 	}
 }
 
+// approvalTool is the name of the built-in tool that approves or rejects a
+// run waiting at an approval step.
+const approvalTool = "piper_resolve_approval"
+
+// approvalsEnabled reports whether the approval tool is offered.
+func (s *MCPServer) approvalsEnabled() bool {
+	return s.AllowApprovals && s.engine.Store != nil
+}
+
 func (s *MCPServer) listTools() mcpToolsResult {
-	tools := make([]mcpTool, 0, len(s.flows))
+	tools := make([]mcpTool, 0, len(s.flows)+1)
 	for _, flow := range s.flows {
 		tool := mcpTool{
 			Name:        flow.Name,
@@ -170,49 +186,86 @@ func (s *MCPServer) listTools() mcpToolsResult {
 		}
 		tools = append(tools, tool)
 	}
+	if s.approvalsEnabled() {
+		tools = append(tools, mcpTool{
+			Name:        approvalTool,
+			Description: "Approve or reject a flow run that is waiting at an approval step, then continue it.",
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"run_id":   map[string]any{"type": "string", "description": "ID of the waiting run"},
+					"decision": map[string]any{"type": "string", "enum": []string{"approve", "reject"}},
+					"comment":  map[string]any{"type": "string", "description": "Optional reason, available as steps.<name>.output.comment"},
+				},
+				"required": []string{"run_id", "decision"},
+			},
+		})
+	}
 	return mcpToolsResult{Tools: tools}
 }
 
 func (s *MCPServer) buildInputSchema(flow *types.FlowDef) map[string]any {
-	schema := map[string]any{
-		"type": "object",
+	if flow.Input == nil {
+		return map[string]any{"type": "object"}
+	}
+	return flow.Input.JSONSchema()
+}
+
+func (s *MCPServer) callTool(params mcpCallToolParams) (string, bool) {
+	if params.Name == approvalTool && s.approvalsEnabled() {
+		return s.resolveApproval(params.Arguments)
 	}
 
-	if flow.Input == nil || len(flow.Input.Properties) == 0 {
-		return schema
+	flow, ok := s.flows[params.Name]
+	if !ok {
+		return fmt.Sprintf("flow %q not found", params.Name), true
 	}
 
-	properties := make(map[string]any)
-	var required []string
+	result, err := s.engine.Run(context.Background(), flow, params.Arguments)
+	if err != nil {
+		return fmt.Sprintf("error: %v", err), true
+	}
 
-	for name, field := range flow.Input.Properties {
-		prop := map[string]any{
-			"type": field.Type,
+	if s.MappedOutput {
+		if result.Failed() {
+			return fmt.Sprintf("flow failed: %s", result.Error), true
+		}
+		if result.Status == "waiting_approval" {
+			return fmt.Sprintf("run %s is waiting for approval", result.RunID), false
 		}
-		if field.Description != "" {
-			prop["description"] = field.Description
+		output := result.Output
+		if output == nil {
+			output = map[string]any{}
 		}
-		properties[name] = prop
-		if field.Required {
-			required = append(required, name)
+		// A mapping error would otherwise leave a field out silently.
+		var body any = output
+		if len(result.OutputErrors) > 0 {
+			body = map[string]any{"output": output, "output_errors": result.OutputErrors}
 		}
+		outputJSON, err := json.MarshalIndent(body, "", "  ")
+		if err != nil {
+			return fmt.Sprintf("error marshaling output: %v", err), true
+		}
+		return string(outputJSON), len(result.OutputErrors) > 0
 	}
 
-	schema["properties"] = properties
-	if len(required) > 0 {
-		schema["required"] = required
+	resultJSON, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("error marshaling result: %v", err), true
 	}
 
-	return schema
+	return string(resultJSON), result.Failed()
 }
 
-func (s *MCPServer) callTool(params mcpCallToolParams) (string, bool) {
-	flow, ok := s.flows[params.Name]
-	if !ok {
-		return fmt.Sprintf("flow %q not found", params.Name), true
+func (s *MCPServer) resolveApproval(args map[string]any) (string, bool) {
+	runID, _ := args["run_id"].(string)
+	decision, _ := args["decision"].(string)
+	comment, _ := args["comment"].(string)
+	if runID == "" || (decision != "approve" && decision != "reject") {
+		return "run_id and decision (approve or reject) are required", true
 	}
 
-	result, err := s.engine.Run(context.Background(), flow, params.Arguments)
+	result, err := s.engine.ResolveApproval(context.Background(), runID, engine.Decision{Approved: decision == "approve", Comment: comment}, s.engine.Secrets)
 	if err != nil {
 		return fmt.Sprintf("error: %v", err), true
 	}
@@ -221,6 +274,5 @@ func (s *MCPServer) callTool(params mcpCallToolParams) (string, bool) {
 	if err != nil {
 		return fmt.Sprintf("error marshaling result: %v", err), true
 	}
-
-	return string(resultJSON), result.Status == "failed"
+	return string(resultJSON), result.Failed()
 }
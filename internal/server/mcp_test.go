@@ -0,0 +1,63 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"piper/internal/engine"
+	"piper/internal/plugin"
+	"piper/internal/plugin/builtin"
+	"piper/internal/store"
+	"piper/internal/types"
+)
+
+func TestMCPApprovalToolOptIn(t *testing.T) {
+	eng := engine.NewEngine(plugin.NewRegistry())
+	eng.Store = store.NewDirStore(t.TempDir())
+	srv := NewMCPServer(eng, map[string]*types.FlowDef{})
+
+	hasTool := func() bool {
+		for _, tool := range srv.listTools().Tools {
+			if tool.Name == approvalTool {
+				return true
+			}
+		}
+		return false
+	}
+
+	if hasTool() {
+		t.Error("the approval tool must not be listed without AllowApprovals")
+	}
+	text, isErr := srv.callTool(mcpCallToolParams{Name: approvalTool, Arguments: map[string]any{"run_id": "r1", "decision": "approve"}})
+	if !isErr || !strings.Contains(text, "not found") {
+		t.Errorf("callTool = %q, %v; want the tool to be unavailable", text, isErr)
+	}
+
+	srv.AllowApprovals = true
+	if !hasTool() {
+		t.Error("the approval tool should be listed with AllowApprovals")
+	}
+}
+
+func TestMCPMappedOutputErrors(t *testing.T) {
+	registry := plugin.NewRegistry()
+	registry.Register(builtin.NewLogConnector())
+	flow := &types.FlowDef{
+		Name: "greet",
+		Steps: []types.StepDef{
+			{Name: "greet", Connector: "log", Action: "print", Input: map[string]any{"message": "hello"}},
+		},
+		Output: &types.SchemaDef{
+			Properties: map[string]types.FieldDef{
+				"count": {Type: "integer", Value: "${{ steps.greet.output.message }}"},
+			},
+		},
+	}
+	srv := NewMCPServer(engine.NewEngine(registry), map[string]*types.FlowDef{"greet": flow})
+	srv.MappedOutput = true
+
+	text, isErr := srv.callTool(mcpCallToolParams{Name: "greet"})
+	if !isErr || !strings.Contains(text, "output_errors") {
+		t.Errorf("callTool = %q, %v; want an error with output_errors", text, isErr)
+	}
+}
@@ -2,11 +2,18 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"mime"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"piper/internal/engine"
+	"piper/internal/store"
 	"piper/internal/types"
 )
 
@@ -15,6 +22,15 @@ type WebhookServer struct {
 	engine *engine.Engine
 	flows  map[string]*types.FlowDef
 	routes map[string]*types.FlowDef // trigger path -> flow
+
+	// AllowApprovals serves the /runs/ routes, which read stored runs and
+	// approve or reject waiting ones. It is off by default, since a caller
+	// that triggers a flow could otherwise read every run, including CLI
+	// runs, and approve its own gate.
+	AllowApprovals bool
+	// ApprovalToken is the bearer token requests to /runs/ must send in
+	// their Authorization header. Without one the routes are not served.
+	ApprovalToken string
 }
 
 // NewWebhookServer creates a new webhook server.
@@ -37,10 +53,99 @@ func (s *WebhookServer) ListenAndServe(addr string) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.handleHealth)
 	mux.HandleFunc("/flows", s.handleListFlows)
+	mux.HandleFunc("/runs/", s.handleRun)
 	mux.HandleFunc("/", s.handleTrigger)
+	if s.engine.Store != nil {
+		go s.expireApprovals(time.Minute)
+	}
 	return http.ListenAndServe(addr, mux)
 }
 
+// expireApprovals periodically applies the default decision to approvals
+// whose timeout has passed.
+func (s *WebhookServer) expireApprovals(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := s.engine.ExpireApprovals(context.Background(), s.engine.Secrets); err != nil {
+			fmt.Fprintf(os.Stderr, "expiring approvals: %v\n", err)
+		}
+	}
+}
+
+// approvalsEnabled reports whether the /runs/ routes are served.
+func (s *WebhookServer) approvalsEnabled() bool {
+	return s.AllowApprovals && s.ApprovalToken != "" && s.engine.Store != nil
+}
+
+// authorized reports whether a request carries the approval token.
+func (s *WebhookServer) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.ApprovalToken)) == 1
+}
+
+// handleRun serves GET /runs/<id> and POST /runs/<id>/approve or
+// /runs/<id>/reject with an optional {"comment": "..."} body, for requests
+// with the approval token.
+func (s *WebhookServer) handleRun(w http.ResponseWriter, r *http.Request) {
+	if !s.approvalsEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "missing or invalid approval token"})
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/runs/"), "/")
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		run, err := s.engine.Store.Get(id)
+		if err != nil {
+			writeJSON(w, runErrorStatus(err), map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+
+	case (action == "approve" || action == "reject") && r.Method == http.MethodPost:
+		var body struct {
+			Comment string `json:"comment"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body: " + err.Error()})
+				return
+			}
+		}
+		decision := engine.Decision{Approved: action == "approve", Comment: body.Comment}
+		result, err := s.engine.ResolveApproval(context.WithoutCancel(r.Context()), id, decision, s.engine.Secrets)
+		if err != nil {
+			writeJSON(w, runErrorStatus(err), map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, result)
+
+	case action == "" || action == "approve" || action == "reject":
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// runErrorStatus maps a run lookup or approval error to an HTTP status.
+func runErrorStatus(err error) int {
+	if errors.Is(err, store.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusConflict
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
 func (s *WebhookServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
@@ -92,21 +197,16 @@ func (s *WebhookServer) handleTrigger(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var input map[string]any
-	if r.Body != nil {
-		defer r.Body.Close()
-		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(map[string]string{"error": "invalid JSON body: " + err.Error()})
-			return
-		}
-	}
-	if input == nil {
-		input = make(map[string]any)
+	input, err := readInput(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
 	}
 
-	result, err := s.engine.Run(context.Background(), flow, input)
+	// Tie the run to the request so a disconnecting client cancels it.
+	result, err := s.engine.Run(r.Context(), flow, input)
 	if err != nil {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
@@ -114,12 +214,91 @@ func (s *WebhookServer) handleTrigger(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	mapped := r.URL.Query().Get("output") == "mapped"
 	statusCode := http.StatusOK
-	if result.Status == "failed" {
+	if result.Failed() {
+		statusCode = http.StatusInternalServerError
+	} else if result.Status == "waiting_approval" {
+		statusCode = http.StatusAccepted
+	} else if mapped && len(result.OutputErrors) > 0 {
+		// Only the mapped output is returned, so a field left out of it
+		// must not look like a success.
 		statusCode = http.StatusInternalServerError
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
+
+	// ?output=mapped returns only the flow's mapped output instead of the full result.
+	if mapped {
+		if result.Failed() {
+			json.NewEncoder(w).Encode(map[string]string{"error": result.Error})
+			return
+		}
+		if result.Status == "waiting_approval" {
+			json.NewEncoder(w).Encode(map[string]string{"run_id": result.RunID, "status": result.Status})
+			return
+		}
+		output := result.Output
+		if output == nil {
+			output = map[string]any{}
+		}
+		if len(result.OutputErrors) > 0 {
+			json.NewEncoder(w).Encode(map[string]any{
+				"error":         "output mapping failed",
+				"output":        output,
+				"output_errors": result.OutputErrors,
+			})
+			return
+		}
+		json.NewEncoder(w).Encode(output)
+		return
+	}
 	json.NewEncoder(w).Encode(result)
 }
+
+// readInput reads the flow input from a JSON or form-encoded request body.
+// Form fields arrive as strings (repeated fields as arrays) and are converted
+// to the types of the flow's input schema during validation.
+func readInput(r *http.Request) (map[string]any, error) {
+	input := make(map[string]any)
+	if r.Body == nil {
+		return input, nil
+	}
+	defer r.Body.Close()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		var err error
+		if mediaType == "multipart/form-data" {
+			err = r.ParseMultipartForm(10 << 20)
+		} else {
+			err = r.ParseForm()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid form body: %w", err)
+		}
+		for key, values := range r.PostForm {
+			if len(values) == 1 {
+				input[key] = values[0]
+				continue
+			}
+			list := make([]any, len(values))
+			for i, v := range values {
+				list[i] = v
+			}
+			input[key] = list
+		}
+		return input, nil
+	}
+
+	var body map[string]any
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	if body != nil {
+		input = body
+	}
+	return input, nil
+}
@@ -3,13 +3,17 @@ package server
 import (
 	"bytes"
 	"encoding/json"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
 
 	"piper/internal/engine"
 	"piper/internal/plugin"
 	"piper/internal/plugin/builtin"
+	"piper/internal/store"
 	"piper/internal/types"
 )
 
@@ -112,3 +116,187 @@ func TestTriggerMethodNotAllowed(t *testing.T) {
 		t.Errorf("status = %d, want 405", w.Code)
 	}
 }
+
+func TestTriggerFlowMappedOutput(t *testing.T) {
+	srv := testSetup()
+	srv.routes["/test"].Output = &types.SchemaDef{
+		Properties: map[string]types.FieldDef{
+			"message": {Type: "string", Value: "${{ steps.greet.output.message }}"},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", srv.handleTrigger)
+
+	body, _ := json.Marshal(map[string]any{"name": "World"})
+	req := httptest.NewRequest("POST", "/test?output=mapped", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	var output map[string]any
+	json.NewDecoder(w.Body).Decode(&output)
+	if output["message"] != "Hello World" {
+		t.Errorf("output = %v, want only the mapped message", output)
+	}
+	if _, ok := output["steps"]; ok {
+		t.Error("mapped output should not include the step log")
+	}
+}
+
+func TestTriggerFlowMappedOutputErrors(t *testing.T) {
+	srv := testSetup()
+	srv.routes["/test"].Output = &types.SchemaDef{
+		Properties: map[string]types.FieldDef{
+			"message": {Type: "string", Value: "${{ steps.greet.output.message }}"},
+			"count":   {Type: "integer", Value: "${{ steps.greet.output.message }}"},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", srv.handleTrigger)
+
+	body, _ := json.Marshal(map[string]any{"name": "World"})
+	req := httptest.NewRequest("POST", "/test?output=mapped", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500 for an output that could not be mapped", w.Code)
+	}
+	var got struct {
+		Output       map[string]any `json:"output"`
+		OutputErrors []string       `json:"output_errors"`
+	}
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.Output["message"] != "Hello World" || len(got.OutputErrors) != 1 || !strings.Contains(got.OutputErrors[0], `"count"`) {
+		t.Errorf("body = %+v, want the mapped message and an error for count", got)
+	}
+}
+
+func TestTriggerFlowFormBody(t *testing.T) {
+	srv := testSetup()
+	srv.routes["/test"].Input = &types.SchemaDef{
+		Properties: map[string]types.FieldDef{
+			"name":  {Type: "string", Required: true},
+			"count": {Type: "integer"},
+			"tags":  {Type: "array"},
+		},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", srv.handleTrigger)
+
+	form := url.Values{"name": {"World"}, "count": {"3"}, "tags": {"a", "b"}}
+	req := httptest.NewRequest("POST", "/test", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var result types.FlowResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if result.Input["count"] != float64(3) {
+		t.Errorf("count = %#v, want the number 3", result.Input["count"])
+	}
+	if tags, _ := result.Input["tags"].([]any); len(tags) != 2 {
+		t.Errorf("tags = %#v, want both values", result.Input["tags"])
+	}
+
+	req = httptest.NewRequest("POST", "/test", strings.NewReader("name=World&count=many"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), `cannot convert \"many\" to integer`) {
+		t.Errorf("status = %d, body = %s; want a coercion error", w.Code, w.Body.String())
+	}
+}
+
+func TestApproveRun(t *testing.T) {
+	srv := testSetup()
+	gated := &types.FlowDef{
+		Name:    "gated",
+		Trigger: &types.TriggerDef{Type: "webhook", Path: "/gated"},
+		Steps: []types.StepDef{
+			{Name: "gate", Connector: "approval", Input: map[string]any{"message": "ok?"}},
+			{Name: "after", Connector: "log", Action: "print", Input: map[string]any{"message": "${{ steps.gate.output.comment }}"}},
+		},
+	}
+	srv.flows["gated"] = gated
+	srv.routes["/gated"] = gated
+	srv.engine.Store = store.NewDirStore(t.TempDir())
+	srv.engine.FlowLoader = func(name string) (*types.FlowDef, error) { return srv.flows[name], nil }
+	srv.ApprovalToken = "s3cret-token"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/runs/", srv.handleRun)
+	mux.HandleFunc("/", srv.handleTrigger)
+	runRequest := func(method, path string, body io.Reader) *http.Request {
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer s3cret-token")
+		return req
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/gated", bytes.NewReader([]byte("{}"))))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("trigger status = %d, want 202", w.Code)
+	}
+	var waiting types.FlowResult
+	json.NewDecoder(w.Body).Decode(&waiting)
+	if waiting.Status != "waiting_approval" || waiting.RunID == "" {
+		t.Fatalf("run = %q %q, want waiting_approval with run ID", waiting.RunID, waiting.Status)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, runRequest("GET", "/runs/"+waiting.RunID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("get run without --allow-approvals status = %d, want 404", w.Code)
+	}
+	srv.AllowApprovals = true
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/runs/"+waiting.RunID+"/approve", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("approve without token status = %d, want 401", w.Code)
+	}
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/runs/"+waiting.RunID, nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("get run with wrong token status = %d, want 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, runRequest("GET", "/runs/"+waiting.RunID, nil))
+	if w.Code != 200 {
+		t.Errorf("get run status = %d, want 200", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	body := bytes.NewReader([]byte(`{"comment": "ship it"}`))
+	mux.ServeHTTP(w, runRequest("POST", "/runs/"+waiting.RunID+"/approve", body))
+	if w.Code != 200 {
+		t.Fatalf("approve status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	var result types.FlowResult
+	json.NewDecoder(w.Body).Decode(&result)
+	if result.Status != "success" || result.Steps[1].Output["message"] != "ship it" {
+		t.Errorf("result = %q %+v, want success with comment", result.Status, result.Steps)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, runRequest("POST", "/runs/"+waiting.RunID+"/reject", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("reject finished run status = %d, want 409", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, runRequest("GET", "/runs/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing run status = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+
+	"piper/internal/types"
+)
+
+// newClaim returns a claim for the current process.
+func newClaim() *types.RunClaim {
+	host, _ := os.Hostname()
+	return &types.RunClaim{Host: host, PID: os.Getpid(), At: time.Now().UTC()}
+}
+
+// Stale reports whether a "running" run was left behind by a process that
+// died: its claim names a process on this host that no longer exists, or
+// it has no claim at all. A claim by a process on another host is never
+// stale, since that process cannot be checked.
+func Stale(run *types.FlowResult) bool {
+	if run.Status != "running" {
+		return false
+	}
+	if run.Claim == nil {
+		return true
+	}
+	if host, _ := os.Hostname(); run.Claim.Host != host {
+		return false
+	}
+	return !processAlive(run.Claim.PID)
+}
+
+// processAlive reports whether a process with the given ID exists.
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	defer p.Release()
+	// On Windows, FindProcess already fails for processes that do not
+	// exist; elsewhere, signal 0 checks for the process without affecting it.
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
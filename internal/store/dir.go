@@ -0,0 +1,235 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"piper/internal/types"
+)
+
+// DirStore stores each run as a JSON file named <run-id>.json in a directory.
+// The directory is created on the first Save.
+type DirStore struct {
+	Dir string
+}
+
+// NewDirStore creates a store backed by dir.
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{Dir: dir}
+}
+
+// Save writes the run to disk, replacing any previous version atomically.
+func (s *DirStore) Save(result *types.FlowResult) error {
+	if err := checkID(result.RunID); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return fmt.Errorf("creating run directory: %w", err)
+	}
+	return writeRun(s.path(result.RunID), result)
+}
+
+// SaveState writes the state of a run to <dir>/.state/<run-id>.json. Since
+// step outputs may hold sensitive data that is not a known secret, the
+// directory is only accessible to its owner.
+func (s *DirStore) SaveState(result *types.FlowResult) error {
+	if err := checkID(result.RunID); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.stateDir(), 0o700); err != nil {
+		return fmt.Errorf("creating run state directory: %w", err)
+	}
+	return writeRun(s.statePath(result.RunID), result)
+}
+
+// writeRun writes a run to path atomically, via a temporary file in the
+// same directory. Like all temporary files, it is only readable by its owner.
+func writeRun(path string, result *types.FlowResult) error {
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding run %s: %w", result.RunID, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+result.RunID+"-*.tmp")
+	if err != nil {
+		return fmt.Errorf("writing run %s: %w", result.RunID, err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing run %s: %w", result.RunID, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing run %s: %w", result.RunID, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing run %s: %w", result.RunID, err)
+	}
+	return nil
+}
+
+// Get reads a single run.
+func (s *DirStore) Get(id string) (*types.FlowResult, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+	return readRun(id, s.path(id))
+}
+
+// State reads the state of a run stored by SaveState.
+func (s *DirStore) State(id string) (*types.FlowResult, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+	return readRun(id, s.statePath(id))
+}
+
+func readRun(id, path string) (*types.FlowResult, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading run %s: %w", id, err)
+	}
+
+	var result types.FlowResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("parsing run %s: %w", id, err)
+	}
+	return &result, nil
+}
+
+// List reads all runs matching filter, newest first. Files that cannot be
+// read or parsed are skipped and reported in a *SkippedError.
+func (s *DirStore) List(filter Filter) ([]*types.FlowResult, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading run directory: %w", err)
+	}
+
+	var runs []*types.FlowResult
+	var skipped []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) != ".json" {
+			continue
+		}
+		result, err := s.Get(strings.TrimSuffix(name, ".json"))
+		if err != nil {
+			skipped = append(skipped, err)
+			continue
+		}
+		if filter.Matches(result) {
+			runs = append(runs, result)
+		}
+	}
+
+	sort.Slice(runs, func(i, j int) bool {
+		if runs[i].StartedAt.Equal(runs[j].StartedAt) {
+			return runs[i].RunID > runs[j].RunID
+		}
+		return runs[i].StartedAt.After(runs[j].StartedAt)
+	})
+	if filter.Limit > 0 && len(runs) > filter.Limit {
+		runs = runs[:filter.Limit]
+	}
+	if len(skipped) > 0 {
+		return runs, &SkippedError{Errs: skipped}
+	}
+	return runs, nil
+}
+
+// SwapStatus changes the status of a run under its lock file, which
+// serializes status changes between goroutines and processes sharing the
+// directory.
+func (s *DirStore) SwapStatus(id, from, to string) (*types.FlowResult, error) {
+	if err := checkID(id); err != nil {
+		return nil, err
+	}
+	unlock, err := s.lock(id)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	result, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status != from && !Stale(result) {
+		return nil, &StatusError{RunID: id, Status: result.Status, Want: from}
+	}
+	result.Status = to
+	result.Claim = nil
+	if to == "running" {
+		result.Claim = newClaim()
+	}
+	if err := s.Save(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Lock files are only held while a run is read and written, so one older
+// than staleLock was left behind by a process that died.
+const (
+	lockWait  = 5 * time.Second
+	staleLock = 30 * time.Second
+)
+
+// lock creates the lock file of a run, waiting up to lockWait for another
+// holder to release it. It returns a function that releases the lock.
+func (s *DirStore) lock(id string) (func(), error) {
+	path := filepath.Join(s.Dir, "."+id+".lock")
+	deadline := time.Now().Add(lockWait)
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("locking run %s: %w", id, err)
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) > staleLock {
+			os.Remove(path)
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("locking run %s: %s is held by another process", id, path)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *DirStore) path(id string) string {
+	return filepath.Join(s.Dir, id+".json")
+}
+
+func (s *DirStore) stateDir() string {
+	return filepath.Join(s.Dir, ".state")
+}
+
+func (s *DirStore) statePath(id string) string {
+	return filepath.Join(s.stateDir(), id+".json")
+}
+
+// checkID rejects IDs that could escape the store directory.
+func checkID(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("invalid run ID %q", id)
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"piper/internal/types"
+)
+
+func TestDirStoreSaveGet(t *testing.T) {
+	s := NewDirStore(t.TempDir())
+
+	result := &types.FlowResult{
+		RunID:     NewRunID(),
+		Flow:      "demo",
+		Status:    "success",
+		StartedAt: time.Now().UTC(),
+		Input:     map[string]any{"url": "https://example.com"},
+		Steps:     []types.StepResult{{Name: "fetch", Status: "success", Output: map[string]any{"status_code": float64(200)}}},
+	}
+	if err := s.Save(result); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	got, err := s.Get(result.RunID)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if got.Flow != "demo" || got.Input["url"] != "https://example.com" {
+		t.Errorf("got %+v, want saved run", got)
+	}
+	if len(got.Steps) != 1 || got.Steps[0].Output["status_code"] != float64(200) {
+		t.Errorf("steps = %+v, want saved step output", got.Steps)
+	}
+
+	if _, err := s.Get("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Get("../etc/passwd"); err == nil {
+		t.Error("expected error for ID with path separator")
+	}
+}
+
+func TestDirStoreState(t *testing.T) {
+	dir := t.TempDir()
+	s := NewDirStore(dir)
+
+	result := &types.FlowResult{RunID: NewRunID(), Flow: "demo", Status: "success", StartedAt: time.Now().UTC()}
+	if err := s.Save(result); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if _, err := s.State(result.RunID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound before SaveState, got %v", err)
+	}
+
+	state := *result
+	state.Input = map[string]any{"token": "unmasked"}
+	if err := s.SaveState(&state); err != nil {
+		t.Fatalf("save state: %v", err)
+	}
+	got, err := s.State(result.RunID)
+	if err != nil {
+		t.Fatalf("state: %v", err)
+	}
+	if got.Input["token"] != "unmasked" {
+		t.Errorf("state input = %v, want the saved state", got.Input)
+	}
+	info, err := os.Stat(filepath.Join(dir, ".state"))
+	if err != nil {
+		t.Fatalf("stat state directory: %v", err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Errorf("state directory mode = %v, want 0700", info.Mode().Perm())
+	}
+
+	runs, err := s.List(Filter{})
+	if err != nil || len(runs) != 1 || runs[0].Input != nil {
+		t.Errorf("List = %+v, %v; want only the saved run", runs, err)
+	}
+}
+
+func TestDirStoreList(t *testing.T) {
+	s := NewDirStore(t.TempDir())
+
+	base := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	runs := []*types.FlowResult{
+		{RunID: "a", Flow: "demo", Status: "success", StartedAt: base},
+		{RunID: "b", Flow: "demo", Status: "failed", StartedAt: base.Add(time.Hour)},
+		{RunID: "c", Flow: "deploy", Status: "failed", StartedAt: base.Add(2 * time.Hour)},
+	}
+	for _, r := range runs {
+		if err := s.Save(r); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []string
+	}{
+		{"all newest first", Filter{}, []string{"c", "b", "a"}},
+		{"by flow", Filter{Flow: "demo"}, []string{"b", "a"}},
+		{"by status", Filter{Status: "failed"}, []string{"c", "b"}},
+		{"since", Filter{Since: base.Add(30 * time.Minute)}, []string{"c", "b"}},
+		{"until", Filter{Until: base.Add(90 * time.Minute)}, []string{"b", "a"}},
+		{"limit", Filter{Limit: 1}, []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.List(tt.filter)
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			var ids []string
+			for _, r := range got {
+				ids = append(ids, r.RunID)
+			}
+			if len(ids) != len(tt.want) {
+				t.Fatalf("got %v, want %v", ids, tt.want)
+			}
+			for i := range ids {
+				if ids[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", ids, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDirStoreListMissingDir(t *testing.T) {
+	s := NewDirStore(t.TempDir() + "/none")
+	runs, err := s.List(Filter{})
+	if err != nil || len(runs) != 0 {
+		t.Errorf("got %v, %v; want no runs and no error", runs, err)
+	}
+}
+
+func TestDirStoreListSkipsCorruptRuns(t *testing.T) {
+	dir := t.TempDir()
+	s := NewDirStore(dir)
+	if err := s.Save(&types.FlowResult{RunID: "good", Flow: "demo", Status: "success"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	os.WriteFile(filepath.Join(dir, "bad.json"), []byte("{not json"), 0o644)
+
+	runs, err := s.List(Filter{})
+	var skipped *SkippedError
+	if !errors.As(err, &skipped) || len(skipped.Errs) != 1 || !strings.Contains(err.Error(), "bad") {
+		t.Fatalf("err = %v, want a SkippedError for bad.json", err)
+	}
+	if len(runs) != 1 || runs[0].RunID != "good" {
+		t.Errorf("runs = %v, want the readable run", runs)
+	}
+}
+
+func TestDirStoreSwapStatus(t *testing.T) {
+	s := NewDirStore(t.TempDir())
+	if err := s.Save(&types.FlowResult{RunID: "r1", Flow: "demo", Status: "waiting_approval"}); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+
+	got, err := s.SwapStatus("r1", "waiting_approval", "running")
+	if err != nil || got.Status != "running" {
+		t.Fatalf("SwapStatus = %v, %v; want running", got, err)
+	}
+	if saved, _ := s.Get("r1"); saved.Status != "running" || saved.Claim == nil || saved.Claim.PID != os.Getpid() {
+		t.Errorf("stored run = %q claimed by %+v, want running claimed by this process", saved.Status, saved.Claim)
+	}
+
+	_, err = s.SwapStatus("r1", "waiting_approval", "running")
+	var se *StatusError
+	if !errors.As(err, &se) || se.Status != "running" {
+		t.Errorf("second SwapStatus = %v, want a StatusError with status running", err)
+	}
+	if _, err := s.SwapStatus("missing", "waiting_approval", "running"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	entries, _ := os.ReadDir(s.Dir)
+	if len(entries) != 1 {
+		t.Errorf("lock file left behind: %v", entries)
+	}
+
+	got, err = s.SwapStatus("r1", "running", "waiting_approval")
+	if err != nil || got.Claim != nil {
+		t.Errorf("release = %+v, %v; want the claim cleared", got, err)
+	}
+}
+
+func TestDirStoreSwapStatusStaleClaim(t *testing.T) {
+	s := NewDirStore(t.TempDir())
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot start a process: %v", err)
+	}
+	host, _ := os.Hostname()
+
+	dead := &types.RunClaim{Host: host, PID: cmd.Process.Pid, At: time.Now().UTC()}
+	remote := &types.RunClaim{Host: host + ".elsewhere", PID: cmd.Process.Pid, At: time.Now().UTC()}
+	for _, tt := range []struct {
+		name    string
+		claim   *types.RunClaim
+		claimed bool
+	}{
+		{"dead process", dead, true},
+		{"no claim", nil, true},
+		{"live process", newClaim(), false},
+		{"other host", remote, false},
+	} {
+		id := NewRunID()
+		if err := s.Save(&types.FlowResult{RunID: id, Flow: "demo", Status: "running", Claim: tt.claim}); err != nil {
+			t.Fatalf("save: %v", err)
+		}
+		_, err := s.SwapStatus(id, "waiting_approval", "running")
+		if claimed := err == nil; claimed != tt.claimed {
+			t.Errorf("%s: SwapStatus error = %v, want claimed %v", tt.name, err, tt.claimed)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package store
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"piper/internal/types"
+)
+
+// ErrNotFound is returned when a run ID is not in the store.
+var ErrNotFound = errors.New("run not found")
+
+// RunStore persists flow results so runs can be inspected after they finish.
+type RunStore interface {
+	// Save creates or replaces the stored result for result.RunID.
+	Save(result *types.FlowResult) error
+	// Get returns the stored result for a run ID, or ErrNotFound.
+	Get(id string) (*types.FlowResult, error)
+	// List returns the runs matching filter, newest first. Runs that cannot
+	// be read are left out and reported with a *SkippedError, which is
+	// returned together with the other runs.
+	List(filter Filter) ([]*types.FlowResult, error)
+	// SwapStatus atomically changes the status of a stored run from `from`
+	// to `to` and returns the run with its new status. If the run's status
+	// is not `from`, it returns a *StatusError and changes nothing, so of
+	// several callers claiming the same run only one succeeds. Swapping to
+	// "running" records the current process as the run's Claim; a run left
+	// "running" by a process that died (see Stale) can be claimed again as
+	// if it had the status `from`.
+	SwapStatus(id, from, to string) (*types.FlowResult, error)
+	// SaveState stores the state of a run, from which resumed and approved
+	// runs restore step outputs. Unlike the result passed to Save, secrets in
+	// it are replaced by references rather than masked. Get and List never
+	// return it.
+	SaveState(result *types.FlowResult) error
+	// State returns the result stored by SaveState, or ErrNotFound.
+	State(id string) (*types.FlowResult, error)
+}
+
+// StatusError is returned by SwapStatus when a run does not have the
+// expected status.
+type StatusError struct {
+	RunID  string
+	Status string
+	Want   string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("run %s has status %q, not %q", e.RunID, e.Status, e.Want)
+}
+
+// SkippedError reports the stored runs List could not read.
+type SkippedError struct {
+	Errs []error
+}
+
+func (e *SkippedError) Error() string {
+	msgs := make([]string, len(e.Errs))
+	for i, err := range e.Errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("skipped %d unreadable run(s): %s", len(e.Errs), strings.Join(msgs, "; "))
+}
+
+// Filter selects runs by flow name, status and start time.
+// Zero fields match every run.
+type Filter struct {
+	Flow   string
+	Status string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+// Matches reports whether a run satisfies the filter (ignoring Limit).
+func (f Filter) Matches(r *types.FlowResult) bool {
+	if f.Flow != "" && r.Flow != f.Flow {
+		return false
+	}
+	if f.Status != "" && r.Status != f.Status {
+		return false
+	}
+	if !f.Since.IsZero() && r.StartedAt.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && r.StartedAt.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// NewRunID returns a new run ID. IDs start with the UTC start time so they
+// sort chronologically, followed by a random suffix, e.g.
+// "20260301T101500-3f9a1c2e".
+func NewRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
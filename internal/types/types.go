@@ -1,17 +1,61 @@
 package types
 
-import "time"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
-// FlowDef represents a parsed YAML flow definition.
+	"gopkg.in/yaml.v3"
+)
+
+// FlowDef represents a parsed YAML flow definition. OnFailure steps run
+// after the main steps when the flow failed; Finally steps always run last.
+// Strict makes references that do not resolve errors instead of empty values.
 type FlowDef struct {
-	Name        string            `yaml:"name" json:"name"`
-	Version     string            `yaml:"version" json:"version"`
-	Description string            `yaml:"description" json:"description"`
-	Input       *SchemaDef        `yaml:"input,omitempty" json:"input,omitempty"`
-	Output      *SchemaDef        `yaml:"output,omitempty" json:"output,omitempty"`
-	Trigger     *TriggerDef       `yaml:"trigger,omitempty" json:"trigger,omitempty"`
-	Steps       []StepDef         `yaml:"steps" json:"steps"`
-	Metadata    map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+	Name        string      `yaml:"name" json:"name"`
+	Version     string      `yaml:"version" json:"version"`
+	Description string      `yaml:"description" json:"description"`
+	Input       *SchemaDef  `yaml:"input,omitempty" json:"input,omitempty"`
+	Output      *SchemaDef  `yaml:"output,omitempty" json:"output,omitempty"`
+	Trigger     *TriggerDef `yaml:"trigger,omitempty" json:"trigger,omitempty"`
+	Steps       []StepDef   `yaml:"steps" json:"steps"`
+	OnFailure   []StepDef   `yaml:"on_failure,omitempty" json:"on_failure,omitempty"`
+	Finally     []StepDef   `yaml:"finally,omitempty" json:"finally,omitempty"`
+	Timeout     string      `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	Strict      bool        `yaml:"strict,omitempty" json:"strict,omitempty"`
+	// RequiresSecrets lists the secrets the flow needs; a run fails before
+	// its first step if one of them is not set.
+	RequiresSecrets []string          `yaml:"requires_secrets,omitempty" json:"requires_secrets,omitempty"`
+	Metadata        map[string]string `yaml:"metadata,omitempty" json:"metadata,omitempty"`
+
+	// File and Positions are set by the loader. Positions maps paths in the
+	// definition to their location in File; steps are addressed by name,
+	// e.g. "steps.fetch.input.url" or "input.properties.email".
+	File      string              `yaml:"-" json:"-"`
+	Positions map[string]Position `yaml:"-" json:"-"`
+}
+
+// Position is a 1-based line and column in a flow file.
+type Position struct {
+	Line   int
+	Column int
+}
+
+// Position returns the location of path, or of its closest recorded
+// parent, e.g. the step itself for an unrecorded field of a step.
+func (f *FlowDef) Position(path string) (Position, bool) {
+	for path != "" {
+		if pos, ok := f.Positions[path]; ok {
+			return pos, true
+		}
+		i := strings.LastIndex(path, ".")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return Position{}, false
 }
 
 // SchemaDef describes the input or output schema of a flow.
@@ -19,11 +63,97 @@ type SchemaDef struct {
 	Properties map[string]FieldDef `yaml:"properties" json:"properties"`
 }
 
-// FieldDef describes a single field in a schema.
+// FieldDef describes a single field in a schema. Besides the type it supports
+// a subset of JSON Schema: Properties describe the fields of an object and
+// Items the elements of an array.
 type FieldDef struct {
 	Type        string `yaml:"type" json:"type"`
 	Description string `yaml:"description" json:"description"`
 	Required    bool   `yaml:"required" json:"required"`
+	// Value maps a flow output field to an expression, e.g. ${{ steps.x.output.y }}.
+	Value string `yaml:"value,omitempty" json:"value,omitempty"`
+
+	Enum       []any               `yaml:"enum,omitempty" json:"enum,omitempty"`
+	Default    any                 `yaml:"default,omitempty" json:"default,omitempty"`
+	Pattern    string              `yaml:"pattern,omitempty" json:"pattern,omitempty"`
+	Minimum    *float64            `yaml:"minimum,omitempty" json:"minimum,omitempty"`
+	Maximum    *float64            `yaml:"maximum,omitempty" json:"maximum,omitempty"`
+	MinLength  *int                `yaml:"minLength,omitempty" json:"minLength,omitempty"`
+	MaxLength  *int                `yaml:"maxLength,omitempty" json:"maxLength,omitempty"`
+	Format     string              `yaml:"format,omitempty" json:"format,omitempty"`
+	Properties map[string]FieldDef `yaml:"properties,omitempty" json:"properties,omitempty"`
+	Items      *FieldDef           `yaml:"items,omitempty" json:"items,omitempty"`
+}
+
+// JSONSchema returns the schema as a JSON Schema object.
+func (s *SchemaDef) JSONSchema() map[string]any {
+	return objectSchema(s.Properties)
+}
+
+// JSONSchema returns the field as a JSON Schema.
+func (f FieldDef) JSONSchema() map[string]any {
+	schema := map[string]any{}
+	if f.Type != "" && f.Type != "any" {
+		schema["type"] = f.Type
+	}
+	if f.Description != "" {
+		schema["description"] = f.Description
+	}
+	if len(f.Enum) > 0 {
+		schema["enum"] = f.Enum
+	}
+	if f.Default != nil {
+		schema["default"] = f.Default
+	}
+	if f.Pattern != "" {
+		schema["pattern"] = f.Pattern
+	}
+	if f.Minimum != nil {
+		schema["minimum"] = *f.Minimum
+	}
+	if f.Maximum != nil {
+		schema["maximum"] = *f.Maximum
+	}
+	if f.MinLength != nil {
+		schema["minLength"] = *f.MinLength
+	}
+	if f.MaxLength != nil {
+		schema["maxLength"] = *f.MaxLength
+	}
+	if f.Format != "" {
+		schema["format"] = f.Format
+	}
+	if len(f.Properties) > 0 {
+		for k, v := range objectSchema(f.Properties) {
+			schema[k] = v
+		}
+	}
+	if f.Items != nil {
+		schema["items"] = f.Items.JSONSchema()
+	}
+	return schema
+}
+
+// objectSchema builds the JSON Schema of an object with the given fields.
+func objectSchema(fields map[string]FieldDef) map[string]any {
+	schema := map[string]any{"type": "object"}
+	if len(fields) == 0 {
+		return schema
+	}
+	properties := make(map[string]any, len(fields))
+	var required []string
+	for name, field := range fields {
+		properties[name] = field.JSONSchema()
+		if field.Required {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	schema["properties"] = properties
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
 }
 
 // TriggerDef describes how a flow is triggered.
@@ -32,10 +162,22 @@ type TriggerDef struct {
 	Path string `yaml:"path" json:"path"`
 }
 
-// RetryConfig defines retry behavior for a step.
+// RetryConfig defines retry behavior for a step. Timeout bounds all
+// attempts including backoff, while StepDef.Timeout bounds each attempt.
 type RetryConfig struct {
 	MaxRetries     int     `yaml:"max_retries" json:"max_retries"`
 	BackoffSeconds float64 `yaml:"backoff_seconds" json:"backoff_seconds"`
+	Timeout        string  `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+}
+
+// LoopConfig defines how a step (or a nested block of steps) is repeated.
+// Until is checked after each iteration, While before each iteration.
+type LoopConfig struct {
+	Until         string    `yaml:"until,omitempty" json:"until,omitempty"`
+	While         string    `yaml:"while,omitempty" json:"while,omitempty"`
+	MaxIterations int       `yaml:"max_iterations" json:"max_iterations"`
+	Interval      string    `yaml:"interval,omitempty" json:"interval,omitempty"`
+	Steps         []StepDef `yaml:"steps,omitempty" json:"steps,omitempty"`
 }
 
 // StepDef represents a single step in a flow.
@@ -47,26 +189,92 @@ type StepDef struct {
 	OnError   string         `yaml:"on_error" json:"on_error"`
 	When      string         `yaml:"when,omitempty" json:"when,omitempty"`
 	Retry     *RetryConfig   `yaml:"retry,omitempty" json:"retry,omitempty"`
+	Timeout   string         `yaml:"timeout,omitempty" json:"timeout,omitempty"`
 	Parallel  []StepDef      `yaml:"parallel,omitempty" json:"parallel,omitempty"`
+	DependsOn []string       `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+
+	// Foreach fields — run the step once per element of an array.
+	Foreach     string `yaml:"foreach,omitempty" json:"foreach,omitempty"`
+	As          string `yaml:"as,omitempty" json:"as,omitempty"`
+	Concurrency int    `yaml:"concurrency,omitempty" json:"concurrency,omitempty"`
+
+	// Loop repeats the step, or the nested loop.steps block, until a condition holds.
+	Loop *LoopConfig `yaml:"loop,omitempty" json:"loop,omitempty"`
+
+	// Flow connector fields — used when connector is "flow". Secrets, if
+	// set, restricts the secrets the child flow sees to those it maps.
+	Flow    string        `yaml:"flow,omitempty" json:"flow,omitempty"`
+	Secrets SecretMapping `yaml:"secrets,omitempty" json:"secrets,omitempty"`
+
+	// Compensate undoes this step if a later step aborts the flow.
+	Compensate *StepDef `yaml:"compensate,omitempty" json:"compensate,omitempty"`
+}
+
+// SecretMapping maps the names of the secrets a child flow sees to the names
+// of the parent's secrets. In YAML it is either a mapping (child: parent) or
+// a list of names that are passed on unchanged.
+type SecretMapping map[string]string
 
-	// Flow connector fields — used when connector is "flow".
-	Flow string `yaml:"flow,omitempty" json:"flow,omitempty"`
+// UnmarshalYAML decodes a list of secret names, each mapped to itself, or a
+// mapping of child to parent names.
+func (m *SecretMapping) UnmarshalYAML(node *yaml.Node) error {
+	mapping := make(SecretMapping)
+	switch node.Kind {
+	case yaml.SequenceNode:
+		var names []string
+		if err := node.Decode(&names); err != nil {
+			return err
+		}
+		for _, name := range names {
+			mapping[name] = name
+		}
+	case yaml.MappingNode:
+		var names map[string]string
+		if err := node.Decode(&names); err != nil {
+			return err
+		}
+		for child, parent := range names {
+			mapping[child] = parent
+		}
+	default:
+		return fmt.Errorf("line %d: secrets must be a list of names or a mapping of child to parent names", node.Line)
+	}
+	*m = mapping
+	return nil
 }
 
 // StepResult holds the result of executing a single step.
 type StepResult struct {
-	Name       string         `json:"name"`
-	Connector  string         `json:"connector"`
-	Action     string         `json:"action"`
+	Name       string            `json:"name"`
+	Connector  string            `json:"connector"`
+	Action     string            `json:"action"`
+	Status     string            `json:"status"`
+	Output     map[string]any    `json:"output,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	DurationMs int64             `json:"duration_ms"`
+	Retries    int               `json:"retries,omitempty"`
+	Iterations []IterationResult `json:"iterations,omitempty"`
+	// Restored is set when the result was copied from a previous run by resume.
+	Restored bool `json:"restored,omitempty"`
+	// Child is the result of the child flow run by a flow step.
+	Child *FlowResult `json:"child,omitempty"`
+}
+
+// IterationResult holds the result of one iteration of a repeated step.
+type IterationResult struct {
+	Index      int            `json:"index"`
+	Item       any            `json:"item,omitempty"`
 	Status     string         `json:"status"`
 	Output     map[string]any `json:"output,omitempty"`
 	Error      string         `json:"error,omitempty"`
 	DurationMs int64          `json:"duration_ms"`
-	Retries    int            `json:"retries,omitempty"`
+	Steps      []StepResult   `json:"steps,omitempty"`
 }
 
 // FlowResult holds the result of an entire flow execution.
 type FlowResult struct {
+	RunID       string         `json:"run_id,omitempty"`
+	ResumedFrom string         `json:"resumed_from,omitempty"`
 	Flow        string         `json:"flow"`
 	Status      string         `json:"status"`
 	StartedAt   time.Time      `json:"started_at"`
@@ -74,5 +282,27 @@ type FlowResult struct {
 	Input       map[string]any `json:"input"`
 	Steps       []StepResult   `json:"steps"`
 	Output      map[string]any `json:"output,omitempty"`
-	Error       string         `json:"error,omitempty"`
+	// OutputErrors describes output mapping values that were left out of
+	// Output because they did not match their declared types.
+	OutputErrors  []string     `json:"output_errors,omitempty"`
+	Error         string       `json:"error,omitempty"`
+	Compensations []StepResult `json:"compensations,omitempty"`
+	OnFailure     []StepResult `json:"on_failure,omitempty"`
+	Finally       []StepResult `json:"finally,omitempty"`
+	// Claim records the process continuing the run while its status is
+	// "running".
+	Claim *RunClaim `json:"claim,omitempty"`
+}
+
+// RunClaim identifies the process that claimed a stored run.
+type RunClaim struct {
+	Host string    `json:"host"`
+	PID  int       `json:"pid"`
+	At   time.Time `json:"at"`
+}
+
+// Failed reports whether the flow failed, including failures whose
+// completed steps were rolled back by compensation.
+func (r *FlowResult) Failed() bool {
+	return r.Status == "failed" || r.Status == "compensated"
 }